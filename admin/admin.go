@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package admin implements an HTTP API to inspect and control the state of the device manager.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	baseerrors "errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/deviceplugin"
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Prefix is the path under which the API is served.
+const Prefix = "/api/v1/"
+
+// TargetInfo describes the state of a USB/IP target.
+type TargetInfo struct {
+	Host      string     `json:"host"`
+	Port      int        `json:"port"`
+	Reachable bool       `json:"reachable"`
+	Since     *time.Time `json:"since,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type api struct {
+	dm     *deviceplugin.DeviceManager
+	token  string
+	logger log.Logger
+}
+
+// NewHandler returns a handler serving the admin API.
+// Read-only endpoints are always available. Mutating endpoints require the given bearer token,
+// and are disabled if the token is empty.
+func NewHandler(dm *deviceplugin.DeviceManager, token string, logger log.Logger) http.Handler {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	a := &api{dm: dm, token: token, logger: logger}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+Prefix+"devices", a.listDevices)
+	mux.HandleFunc("GET "+Prefix+"devices/{id}", a.getDevice)
+	mux.HandleFunc("GET "+Prefix+"targets", a.listTargets)
+	mux.HandleFunc("POST "+Prefix+"refresh", a.authenticated(a.refresh))
+	mux.HandleFunc("POST "+Prefix+"ports/{port}/detach", a.authenticated(a.detach))
+	mux.HandleFunc("POST "+Prefix+"devices/{id}/cordon", a.authenticated(a.cordon(true)))
+	mux.HandleFunc("POST "+Prefix+"devices/{id}/uncordon", a.authenticated(a.cordon(false)))
+	return mux
+}
+
+// HealthHandler serves the outcome of a health check as JSON, with status 503 if it failed.
+func HealthHandler(check func() deviceplugin.HealthReport) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		report := check()
+		status := http.StatusOK
+		if !report.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// authenticated only passes on requests carrying the configured bearer token.
+func (a *api) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.token == "" {
+			writeError(w, http.StatusForbidden, baseerrors.New("mutating endpoints are disabled"))
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, baseerrors.New("invalid or missing bearer token"))
+			return
+		}
+		_ = level.Info(a.logger).Log("msg", "admin request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+		next(w, r)
+	}
+}
+
+func (a *api) listDevices(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, a.dm.Devices())
+}
+
+func (a *api) getDevice(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	for _, dev := range a.dm.Devices() {
+		if dev.ID == id {
+			writeJSON(w, http.StatusOK, dev)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, deviceplugin.ErrUnknownDevice)
+}
+
+func (a *api) listTargets(w http.ResponseWriter, _ *http.Request) {
+	states := a.dm.TargetStates()
+	result := make([]TargetInfo, 0, len(states))
+	for target, state := range states {
+		info := TargetInfo{Host: target.Host, Port: target.Port, Reachable: state.Reachable}
+		if !state.Since.IsZero() {
+			info.Since = &state.Since
+		}
+		if !state.LastSeen.IsZero() {
+			info.LastSeen = &state.LastSeen
+		}
+		if state.LastError != nil {
+			info.LastError = state.LastError.Error()
+		}
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return net.JoinHostPort(result[i].Host, strconv.Itoa(result[i].Port)) < net.JoinHostPort(result[j].Host, strconv.Itoa(result[j].Port))
+	})
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (a *api) refresh(w http.ResponseWriter, r *http.Request) {
+	if err := a.dm.Refresh(r.Context()); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) detach(w http.ResponseWriter, r *http.Request) {
+	port, err := strconv.ParseUint(r.PathValue("port"), 10, 8)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	err = a.dm.ForceDetach(r.Context(), driver.VirtualPort(port))
+	if baseerrors.Is(err, deviceplugin.ErrUnknownPort) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) cordon(cordoned bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := a.dm.Cordon(r.PathValue("id"), cordoned)
+		if baseerrors.Is(err, deviceplugin.ErrUnknownDevice) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
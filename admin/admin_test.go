@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/deviceplugin"
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+)
+
+type fakeVHCIDriver struct {
+	slots []driver.VHCISlot
+}
+
+func (f *fakeVHCIDriver) AttachDevice(_ *net.TCPConn, _ uint32, _ driver.USBDeviceSpeed) (driver.VirtualPort, error) {
+	return 0, errors.New("not supported")
+}
+
+func (f *fakeVHCIDriver) DetachDevice(port driver.VirtualPort) error {
+	f.slots[port] = driver.VHCISlot{Port: port, Status: driver.VDevStatusNull}
+	return nil
+}
+
+func (f *fakeVHCIDriver) UpdateAttachedDevices() error {
+	return nil
+}
+
+func (f *fakeVHCIDriver) GetDeviceSlots() []driver.VHCISlot {
+	return f.slots
+}
+
+func (f *fakeVHCIDriver) InterfaceDevNodes(_ driver.VirtualPort) ([]string, error) {
+	return nil, nil
+}
+
+func request(t *testing.T, handler http.Handler, method string, path string, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminAPI(t *testing.T) {
+	vhci := &fakeVHCIDriver{slots: []driver.VHCISlot{{Port: 0, Status: driver.VDevStatusUsed}}}
+	dm := deviceplugin.NewDeviceManager("", nil, vhci, nil)
+	dev := &deviceplugin.KnownDevice{
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1050, Product: 0x0407},
+	}
+	if _, err := dm.Register("key", deviceplugin.ResourceOptions{}, []*deviceplugin.KnownDevice{dev}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(dm, "secret", nil)
+
+	rec := request(t, handler, http.MethodGet, Prefix+"devices", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	var devices []deviceplugin.DeviceInfo
+	if err := json.NewDecoder(rec.Body).Decode(&devices); err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].ID != dev.ID() || devices[0].Name != "key-0" {
+		t.Fatalf("unexpected devices %+v", devices)
+	}
+
+	t.Run("auth", func(t *testing.T) {
+		if rec := request(t, handler, http.MethodPost, Prefix+"devices/"+dev.ID()+"/cordon", ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected missing token to be rejected, got %d", rec.Code)
+		}
+		if rec := request(t, handler, http.MethodPost, Prefix+"devices/"+dev.ID()+"/cordon", "wrong"); rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected wrong token to be rejected, got %d", rec.Code)
+		}
+		disabled := NewHandler(dm, "", nil)
+		if rec := request(t, disabled, http.MethodPost, Prefix+"refresh", ""); rec.Code != http.StatusForbidden {
+			t.Errorf("expected mutating endpoints to be disabled without token, got %d", rec.Code)
+		}
+	})
+
+	t.Run("cordon", func(t *testing.T) {
+		if rec := request(t, handler, http.MethodPost, Prefix+"devices/"+dev.ID()+"/cordon", "secret"); rec.Code != http.StatusNoContent {
+			t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body)
+		}
+		if !dm.Devices()[0].Cordoned {
+			t.Errorf("device should be cordoned")
+		}
+		if rec := request(t, handler, http.MethodPost, Prefix+"devices/"+dev.ID()+"/uncordon", "secret"); rec.Code != http.StatusNoContent {
+			t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body)
+		}
+		if dm.Devices()[0].Cordoned {
+			t.Errorf("device should no longer be cordoned")
+		}
+		if rec := request(t, handler, http.MethodPost, Prefix+"devices/nope/cordon", "secret"); rec.Code != http.StatusNotFound {
+			t.Errorf("expected unknown device to be reported, got %d", rec.Code)
+		}
+	})
+
+	t.Run("health", func(t *testing.T) {
+		rec := request(t, HealthHandler(dm.Readiness), http.MethodGet, "/readyz", "")
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected not ready before refresh, got %d", rec.Code)
+		}
+		var report deviceplugin.HealthReport
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Healthy || len(report.Problems) == 0 {
+			t.Errorf("unexpected report %+v", report)
+		}
+		if rec := request(t, HealthHandler(dm.Liveness), http.MethodGet, "/livez", ""); rec.Code != http.StatusOK {
+			t.Errorf("expected live, got %d", rec.Code)
+		}
+	})
+
+	t.Run("detach", func(t *testing.T) {
+		if rec := request(t, handler, http.MethodPost, Prefix+"ports/0/detach", "secret"); rec.Code != http.StatusNoContent {
+			t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body)
+		}
+		if !vhci.slots[0].IsEmpty() {
+			t.Errorf("port should have been detached")
+		}
+		if rec := request(t, handler, http.MethodPost, Prefix+"ports/7/detach", "secret"); rec.Code != http.StatusNotFound {
+			t.Errorf("expected unknown port to be reported, got %d", rec.Code)
+		}
+	})
+}
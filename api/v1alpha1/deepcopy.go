@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func (in *USBIPTarget) DeepCopyInto(out *USBIPTarget) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+}
+
+func (in *USBIPTarget) DeepCopy() *USBIPTarget {
+	if in == nil {
+		return nil
+	}
+	out := new(USBIPTarget)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *USBIPTarget) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *USBIPTargetList) DeepCopyInto(out *USBIPTargetList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]USBIPTarget, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+func (in *USBIPTargetList) DeepCopy() *USBIPTargetList {
+	if in == nil {
+		return nil
+	}
+	out := new(USBIPTargetList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *USBIPTargetList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *USBIPDeviceSpec) DeepCopyInto(out *USBIPDeviceSpec) {
+	*out = *in
+	if in.Extras != nil {
+		out.Extras = make([]DeviceNode, len(in.Extras))
+		copy(out.Extras, in.Extras)
+	}
+}
+
+func (in *USBIPDeviceStatus) DeepCopyInto(out *USBIPDeviceStatus) {
+	*out = *in
+	if in.LastSeen != nil {
+		out.LastSeen = in.LastSeen.DeepCopy()
+	}
+}
+
+func (in *USBIPDevice) DeepCopyInto(out *USBIPDevice) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+func (in *USBIPDevice) DeepCopy() *USBIPDevice {
+	if in == nil {
+		return nil
+	}
+	out := new(USBIPDevice)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *USBIPDevice) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *USBIPDeviceList) DeepCopyInto(out *USBIPDeviceList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]USBIPDevice, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+func (in *USBIPDeviceList) DeepCopy() *USBIPDeviceList {
+	if in == nil {
+		return nil
+	}
+	out := new(USBIPDeviceList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *USBIPDeviceList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
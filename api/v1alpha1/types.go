@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package v1alpha1 contains the custom resources through which USB/IP devices can be
+// declared in the cluster, as an alternative to the static configuration file.
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// USBIPTarget is a USB/IP server exporting devices.
+type USBIPTarget struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec USBIPTargetSpec `json:"spec"`
+}
+
+type USBIPTargetSpec struct {
+	// Host is the host name or IP address of the USB/IP server.
+	Host string `json:"host"`
+	// Port is the port of the USB/IP server. The API server defaults it to 3240.
+	Port int `json:"port,omitempty"`
+}
+
+// USBIPTargetList is a list of USBIPTarget objects.
+type USBIPTargetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []USBIPTarget `json:"items"`
+}
+
+// USBIPDevice is a device exported by a USBIPTarget, advertised under a resource name.
+type USBIPDevice struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   USBIPDeviceSpec   `json:"spec"`
+	Status USBIPDeviceStatus `json:"status,omitempty"`
+}
+
+type USBIPDeviceSpec struct {
+	// Resource is the name of the resource under which the device is advertised,
+	// without the domain. Resources that aren't declared in the plugin's configuration file
+	// are advertised with default options.
+	Resource string `json:"resource"`
+	// Target is the name of the USBIPTarget exporting the device.
+	Target string `json:"target"`
+	// Selector selects the device among those exported by the target.
+	Selector USBSelector `json:"selector"`
+	// Extras are additional device nodes to expose to containers along with the device.
+	Extras []DeviceNode `json:"extras,omitempty"`
+	// ContainerPath is a template for the path of the USB device node inside the container.
+	ContainerPath string `json:"containerPath,omitempty"`
+	// InterfacePath is a template for the paths of interface device nodes inside the container.
+	InterfacePath string `json:"interfacePath,omitempty"`
+	// Replicas is the number of containers that can share the device on a single node.
+	Replicas int `json:"replicas,omitempty"`
+	// Permissions are the cgroup permissions of the USB device node and its interface nodes, mrw by default.
+	Permissions string `json:"permissions,omitempty"`
+	// ReadOnly only grants containers read access to the device and its extras.
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+// USBSelector selects a USB device. Empty fields match any device.
+type USBSelector struct {
+	// Vendor is the USB vendor ID, as a hexadecimal string (e.g. 1050).
+	Vendor string `json:"vendor,omitempty"`
+	// Product is the USB product ID, as a hexadecimal string (e.g. 0407).
+	Product string `json:"product,omitempty"`
+	// BusID is the bus ID of the device on the target (e.g. 1-1.2).
+	BusID string `json:"busId,omitempty"`
+}
+
+// DeviceNode is a device node on the host to expose to containers.
+type DeviceNode struct {
+	HostPath      string `json:"hostPath"`
+	ContainerPath string `json:"containerPath,omitempty"`
+	// Permissions are the cgroup permissions of the device node, mrw (or r for read-only devices) by default.
+	Permissions string `json:"permissions,omitempty"`
+}
+
+// DeviceHealth summarizes the state of a device.
+type DeviceHealth string
+
+const (
+	// DeviceHealthy means the device is offered by its target, or attached to a node.
+	DeviceHealthy DeviceHealth = "Healthy"
+	// DeviceMissing means the target is reachable, but doesn't offer the device.
+	DeviceMissing DeviceHealth = "Missing"
+	// DeviceUnreachable means the target of the device could not be reached.
+	DeviceUnreachable DeviceHealth = "Unreachable"
+	// DeviceInvalid means the device could not be registered, e.g. because its target doesn't exist.
+	DeviceInvalid DeviceHealth = "Invalid"
+)
+
+type USBIPDeviceStatus struct {
+	// Node is the name of the node the device is attached to, if any.
+	Node string `json:"node,omitempty"`
+	// LastSeen is the last time the device was offered by its target or seen attached to a node.
+	LastSeen *metav1.Time `json:"lastSeen,omitempty"`
+	// Health summarizes the state of the device, as last observed by any node.
+	Health DeviceHealth `json:"health,omitempty"`
+	// Message provides details about the health of the device.
+	Message string `json:"message,omitempty"`
+}
+
+// USBIPDeviceList is a list of USBIPDevice objects.
+type USBIPDeviceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []USBIPDevice `json:"items"`
+}
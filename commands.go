@@ -0,0 +1,467 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/deviceplugin"
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip/host"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	defaultUSBIPPort = 3240
+
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// commandEnv holds the dependencies of subcommands, so they can be replaced in tests.
+type commandEnv struct {
+	stdout io.Writer
+	dialer usbip.Dialer
+	// vhci sets up the VHCI driver, for commands that need it.
+	vhci func() (driver.VHCIDriver, func(), error)
+	// configFile is the config file to read configured devices from, if any.
+	configFile string
+	// domain is the domain under which resources are advertised.
+	domain string
+	// host sets up the driver for exporting local devices, for commands that need it.
+	host func() (host.Driver, func(), error)
+	// listen is the address at which to serve USB/IP clients.
+	listen string
+	logger log.Logger
+}
+
+type command struct {
+	args        string
+	description string
+	nArgs       int
+	// variadic allows more than nArgs arguments.
+	variadic bool
+	// flags defines the flags specific to the command, which store their values in env.
+	flags func(flags *flag.FlagSet, env *commandEnv)
+	// run executes the command. Output is rendered even if the command fails.
+	run func(env *commandEnv, args []string) (*commandOutput, error)
+}
+
+var commands = map[string]*command{
+	"list": {
+		args:        "<host[:port]>",
+		description: "List the devices exported by a USB/IP target.",
+		nArgs:       1,
+		run:         listCommand,
+	},
+	"attach": {
+		args:        "<host[:port]> <busid>",
+		description: "Import a device from a USB/IP target.",
+		nArgs:       2,
+		run:         attachCommand,
+	},
+	"detach": {
+		args:        "<port>",
+		description: "Detach the device attached to a VHCI port.",
+		nArgs:       1,
+		run:         detachCommand,
+	},
+	"port": {
+		args:        "",
+		description: "Show the state of all VHCI ports.",
+		nArgs:       0,
+		run:         portCommand,
+	},
+	"match": {
+		args:        "<host[:port]>",
+		description: "Show which configured devices match the devices exported by a USB/IP target.",
+		nArgs:       1,
+		run:         matchCommand,
+	},
+	"validate": {
+		args:        "",
+		description: "Check the config file for errors.",
+		nArgs:       0,
+		run:         validateCommand,
+	},
+	"schema": {
+		args:        "",
+		description: "Print a JSON schema for the config file.",
+		nArgs:       0,
+		run:         schemaCommand,
+	},
+	"serve": {
+		args:        "[busid...]",
+		description: "Export local devices over USB/IP. The given devices are bound to usbip-host until the server stops.",
+		nArgs:       0,
+		variadic:    true,
+		flags: func(flags *flag.FlagSet, env *commandEnv) {
+			flags.StringVar(&env.listen, "listen", fmt.Sprintf(":%d", defaultUSBIPPort), "The address at which to serve USB/IP clients.")
+		},
+		run: serveCommand,
+	},
+}
+
+// commandOutput is the result of a subcommand, which can be rendered as a table or as JSON.
+type commandOutput struct {
+	header []string
+	rows   [][]string
+	value  interface{}
+}
+
+func (o *commandOutput) render(w io.Writer, format string) error {
+	switch format {
+	case outputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(o.value)
+	case outputTable:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, strings.Join(o.header, "\t"))
+		for _, row := range o.rows {
+			_, _ = fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q; possible values are: %s, %s", format, outputTable, outputJSON)
+	}
+}
+
+// runCommand runs the subcommand with the given name and arguments.
+func runCommand(name string, args []string) error {
+	cmd := commands[name]
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	output := flags.StringP("output", "o", outputTable, fmt.Sprintf("Output format: %s or %s.", outputTable, outputJSON))
+	configFile := flags.String("config", "", "Path to the config file.")
+	domain := flags.String("domain", defaultDomain, "The domain to use when when declaring devices.")
+	logLevel := flags.String("log-level", logLevelWarn, fmt.Sprintf("Log level to use. Possible values: %s", availableLogLevels))
+	env := &commandEnv{stdout: os.Stdout, dialer: usbip.NetDialer{}}
+	if cmd.flags != nil {
+		cmd.flags(flags, env)
+	}
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] %s\n%s\n\n", os.Args[0], name, cmd.args, cmd.description)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output != outputTable && *output != outputJSON {
+		return fmt.Errorf("unknown output format %q; possible values are: %s, %s", *output, outputTable, outputJSON)
+	}
+	if flags.NArg() != cmd.nArgs && !(cmd.variadic && flags.NArg() > cmd.nArgs) {
+		flags.Usage()
+		return fmt.Errorf("%s expects %d argument(s), got %d", name, cmd.nArgs, flags.NArg())
+	}
+
+	logger, err := filterLogLevel(log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), *logLevel)
+	if err != nil {
+		return err
+	}
+	env.logger = logger
+	env.configFile = *configFile
+	env.domain = *domain
+	env.vhci = func() (driver.VHCIDriver, func(), error) {
+		sysroot, err := os.OpenRoot(driver.Sys)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to open /sys")
+		}
+		vhci, err := driver.NewSysfsVHCIDriver(sysroot.FS(), logger)
+		if err != nil {
+			_ = sysroot.Close()
+			return nil, nil, errors.Wrap(err, "failed to set up VHCI driver")
+		}
+		return vhci, func() { _ = sysroot.Close() }, nil
+	}
+	env.host = func() (host.Driver, func(), error) {
+		sysroot, err := os.OpenRoot(driver.Sys)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to open /sys")
+		}
+		d, err := host.NewSysfsHostDriver(sysroot.FS(), logger)
+		if err != nil {
+			_ = sysroot.Close()
+			return nil, nil, errors.Wrap(err, "failed to set up usbip-host driver")
+		}
+		return d, func() { _ = sysroot.Close() }, nil
+	}
+	out, err := cmd.run(env, flags.Args())
+	if out != nil {
+		if renderErr := out.render(env.stdout, *output); renderErr != nil && err == nil {
+			err = renderErr
+		}
+	}
+	return err
+}
+
+// parseTarget parses a target in host[:port] form.
+func parseTarget(value string) (usbip.Target, error) {
+	host, portStr, err := net.SplitHostPort(value)
+	if err != nil {
+		// no port
+		return usbip.Target{Host: strings.Trim(value, "[]"), Port: defaultUSBIPPort}, nil
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return usbip.Target{}, fmt.Errorf("invalid port in target %q", value)
+	}
+	return usbip.Target{Host: host, Port: int(port)}, nil
+}
+
+func listRemote(env *commandEnv, targetStr string) (usbip.Target, []driver.USBDevice, error) {
+	target, err := parseTarget(targetStr)
+	if err != nil {
+		return target, nil, err
+	}
+	conn, err := env.dialer.Dial(target)
+	if err != nil {
+		return target, nil, err
+	}
+	defer conn.Close()
+	devices, err := conn.ListRequest()
+	if err != nil {
+		return target, nil, errors.Wrapf(err, "failed to list devices on %s", targetStr)
+	}
+	return target, devices, nil
+}
+
+func listCommand(env *commandEnv, args []string) (*commandOutput, error) {
+	_, devices, err := listRemote(env, args[0])
+	if err != nil {
+		return nil, err
+	}
+	out := &commandOutput{header: []string{"BUSID", "VENDOR", "PRODUCT"}, value: devices}
+	for _, dev := range devices {
+		out.rows = append(out.rows, []string{dev.BusId, dev.Vendor.String(), dev.Product.String()})
+	}
+	return out, nil
+}
+
+func attachedOutput(dev *usbip.AttachedDevice) *commandOutput {
+	return &commandOutput{
+		header: []string{"PORT", "BUSID", "VENDOR", "PRODUCT", "PATH"},
+		rows: [][]string{{
+			strconv.Itoa(int(dev.Port)), dev.BusId, dev.Vendor.String(), dev.Product.String(), dev.DevMountPath,
+		}},
+		value: dev,
+	}
+}
+
+func attachCommand(env *commandEnv, args []string) (*commandOutput, error) {
+	target, err := parseTarget(args[0])
+	if err != nil {
+		return nil, err
+	}
+	vhci, closeVHCI, err := env.vhci()
+	if err != nil {
+		return nil, err
+	}
+	defer closeVHCI()
+	dev, err := usbip.Import(context.Background(), args[1], target, vhci, env.dialer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to import %s from %s", args[1], args[0])
+	}
+	return attachedOutput(dev), nil
+}
+
+func detachCommand(env *commandEnv, args []string) (*commandOutput, error) {
+	port, err := strconv.ParseUint(args[0], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", args[0])
+	}
+	vhci, closeVHCI, err := env.vhci()
+	if err != nil {
+		return nil, err
+	}
+	defer closeVHCI()
+	if int(port) >= len(vhci.GetDeviceSlots()) {
+		return nil, fmt.Errorf("port %d does not exist", port)
+	}
+	if err := usbip.Detach(context.Background(), driver.VirtualPort(port), vhci); err != nil {
+		return nil, errors.Wrapf(err, "failed to detach port %d", port)
+	}
+	return &commandOutput{
+		header: []string{"PORT", "STATUS"},
+		rows:   [][]string{{args[0], "detached"}},
+		value:  map[string]interface{}{"port": port, "detached": true},
+	}, nil
+}
+
+var slotStatusNames = map[driver.USBIPStatus]string{
+	driver.VDevStatusNull:        "free",
+	driver.VDevStatusNotAssigned: "not assigned",
+	driver.VDevStatusUsed:        "used",
+	driver.VDevStatusError:       "error",
+}
+
+var hubSpeedNames = map[driver.HubSpeed]string{
+	driver.HubSpeedHigh:  "high",
+	driver.HubSpeedSuper: "super",
+}
+
+// slotInfo describes a VHCI port in the output of the port command.
+type slotInfo struct {
+	Port         driver.VirtualPort `json:"port"`
+	Hub          string             `json:"hub"`
+	Status       string             `json:"status"`
+	DevMountPath string             `json:"dev_mount_path,omitempty"`
+	Device       *driver.USBDevice  `json:"device,omitempty"`
+}
+
+func portCommand(env *commandEnv, _ []string) (*commandOutput, error) {
+	vhci, closeVHCI, err := env.vhci()
+	if err != nil {
+		return nil, err
+	}
+	defer closeVHCI()
+	slots := vhci.GetDeviceSlots()
+	infos := make([]slotInfo, 0, len(slots))
+	out := &commandOutput{header: []string{"PORT", "HUB", "STATUS", "VENDOR", "PRODUCT", "PATH"}}
+	for i := range slots {
+		slot := &slots[i]
+		info := slotInfo{Port: slot.Port, Hub: hubSpeedNames[slot.HubSpeed], Status: slotStatusNames[slot.Status]}
+		vendor, product := "", ""
+		if slot.IsDeviceConnected() {
+			dev := slot.LocalDeviceInfo
+			info.Device = &dev
+			info.DevMountPath = slot.DevMountPath
+			vendor, product = dev.Vendor.String(), dev.Product.String()
+		}
+		infos = append(infos, info)
+		out.rows = append(out.rows, []string{
+			strconv.Itoa(int(slot.Port)), info.Hub, info.Status, vendor, product, info.DevMountPath,
+		})
+	}
+	out.value = infos
+	return out, nil
+}
+
+// deviceMatch describes a configured device matching a remote device.
+type deviceMatch struct {
+	Resource string `json:"resource"`
+	Name     string `json:"name"`
+}
+
+// remoteDeviceMatches describes the configured devices matching a remote device.
+type remoteDeviceMatches struct {
+	driver.USBDevice
+	Matches []deviceMatch `json:"matches"`
+}
+
+func matchCommand(env *commandEnv, args []string) (*commandOutput, error) {
+	if err := readConfigFile(env.configFile); err != nil {
+		return nil, err
+	}
+	resources, err := getConfiguredDevices()
+	if err != nil {
+		return nil, err
+	}
+	target, devices, err := listRemote(env, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// registering the devices fills in their defaults
+	dm := deviceplugin.NewDeviceManager("", nil, nil, nil)
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	configured := make([]deviceMatch, 0)
+	selectors := make([]*deviceplugin.KnownDevice, 0)
+	for _, name := range names {
+		resource := resources[name]
+		if _, err := dm.Register(name, resource.ResourceOptions, resource.Devices); err != nil {
+			return nil, errors.Wrapf(err, "invalid devices for resource %s", name)
+		}
+		for _, kd := range resource.Devices {
+			if kd != nil && kd.Target == target {
+				configured = append(configured, deviceMatch{Resource: name, Name: kd.Name})
+				selectors = append(selectors, kd)
+			}
+		}
+	}
+
+	result := make([]remoteDeviceMatches, 0, len(devices))
+	out := &commandOutput{header: []string{"BUSID", "VENDOR", "PRODUCT", "MATCHES"}}
+	for _, dev := range devices {
+		matches := make([]deviceMatch, 0)
+		matchNames := make([]string, 0)
+		for i, kd := range selectors {
+			if kd.SelectorMatches(dev) {
+				matches = append(matches, configured[i])
+				matchNames = append(matchNames, configured[i].Resource+"/"+configured[i].Name)
+			}
+		}
+		if len(matchNames) == 0 {
+			matchNames = append(matchNames, "-")
+		}
+		result = append(result, remoteDeviceMatches{USBDevice: dev, Matches: matches})
+		out.rows = append(out.rows, []string{dev.BusId, dev.Vendor.String(), dev.Product.String(), strings.Join(matchNames, ",")})
+	}
+	out.value = result
+	return out, nil
+}
+
+func serveCommand(env *commandEnv, args []string) (*commandOutput, error) {
+	d, closeHost, err := env.host()
+	if err != nil {
+		return nil, err
+	}
+	defer closeHost()
+	// only give back the devices that weren't bound before
+	bound := make([]string, 0, len(args))
+	defer func() {
+		for _, busId := range bound {
+			if err := d.Unbind(busId); err != nil {
+				_ = level.Warn(env.logger).Log("msg", "failed to unbind device", "busId", busId, "err", err)
+			}
+		}
+	}()
+	for _, busId := range args {
+		if _, err := d.Describe(busId); err == nil {
+			continue
+		}
+		if err := d.Bind(busId); err != nil {
+			return nil, errors.Wrapf(err, "failed to bind %s", busId)
+		}
+		bound = append(bound, busId)
+		_ = level.Info(env.logger).Log("msg", "bound device to usbip-host", "busId", busId)
+	}
+
+	if err := readConfigFile(env.configFile); err != nil {
+		return nil, err
+	}
+	policy, err := getExportPolicy()
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil {
+		_ = level.Warn(env.logger).Log("msg", "no export policy configured; all clients can list and import all devices")
+	}
+
+	listener, err := net.Listen("tcp", env.listen)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen at %s", env.listen)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	_ = level.Info(env.logger).Log("msg", "serving USB/IP clients", "listen", listener.Addr())
+	return nil, host.NewServer(d, policy, env.logger).Serve(ctx, listener)
+}
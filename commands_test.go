@@ -0,0 +1,193 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+)
+
+type fakeClient struct {
+	// embedded to satisfy the unexported methods of the interface
+	usbip.Client
+	target  usbip.Target
+	devices []driver.USBDevice
+}
+
+func (c *fakeClient) GetTarget() usbip.Target {
+	return c.target
+}
+
+func (c *fakeClient) Close() {}
+
+func (c *fakeClient) ListRequest() ([]driver.USBDevice, error) {
+	return c.devices, nil
+}
+
+type fakeDialer struct {
+	devices map[usbip.Target][]driver.USBDevice
+}
+
+func (d *fakeDialer) Dial(t usbip.Target) (usbip.Client, error) {
+	devices, ok := d.devices[t]
+	if !ok {
+		return nil, errors.Newf("connection to %s refused", t.Host)
+	}
+	return &fakeClient{target: t, devices: devices}, nil
+}
+
+type fakeVHCIDriver struct {
+	slots []driver.VHCISlot
+}
+
+func (f *fakeVHCIDriver) AttachDevice(_ *net.TCPConn, _ uint32, _ driver.USBDeviceSpeed) (driver.VirtualPort, error) {
+	return 0, errors.New("not supported")
+}
+
+func (f *fakeVHCIDriver) DetachDevice(port driver.VirtualPort) error {
+	f.slots[port] = driver.VHCISlot{Port: port, Status: driver.VDevStatusNull}
+	return nil
+}
+
+func (f *fakeVHCIDriver) UpdateAttachedDevices() error {
+	return nil
+}
+
+func (f *fakeVHCIDriver) GetDeviceSlots() []driver.VHCISlot {
+	return f.slots
+}
+
+func (f *fakeVHCIDriver) InterfaceDevNodes(_ driver.VirtualPort) ([]string, error) {
+	return nil, nil
+}
+
+func TestParseTarget(t *testing.T) {
+	cases := map[string]usbip.Target{
+		"usbip.example.com":      {Host: "usbip.example.com", Port: 3240},
+		"usbip.example.com:3241": {Host: "usbip.example.com", Port: 3241},
+		"[fd00::1]:3241":         {Host: "fd00::1", Port: 3241},
+		"fd00::1":                {Host: "fd00::1", Port: 3240},
+	}
+	for input, expected := range cases {
+		target, err := parseTarget(input)
+		if err != nil || target != expected {
+			t.Errorf("parseTarget(%q) = %v, %v; want %v", input, target, err, expected)
+		}
+	}
+	if _, err := parseTarget("usbip.example.com:0"); err == nil {
+		t.Errorf("expected invalid port to be rejected")
+	}
+}
+
+func newTestEnv(vhci *fakeVHCIDriver) *commandEnv {
+	return &commandEnv{
+		dialer: &fakeDialer{devices: map[usbip.Target][]driver.USBDevice{
+			{Host: "usbip.example.com", Port: 3240}: {
+				{Vendor: 0x1050, Product: 0x0407, BusId: "1-1"},
+				{Vendor: 0x20a0, Product: 0x4230, BusId: "1-2"},
+			},
+		}},
+		vhci: func() (driver.VHCIDriver, func(), error) {
+			return vhci, func() {}, nil
+		},
+	}
+}
+
+func TestCommands(t *testing.T) {
+	vhci := &fakeVHCIDriver{slots: []driver.VHCISlot{
+		{Port: 0, Status: driver.VDevStatusUsed, DevMountPath: "/dev/bus/usb/002/003", LocalDeviceInfo: driver.USBDevice{Vendor: 0x1050, Product: 0x0407}},
+		{Port: 1, Status: driver.VDevStatusNull},
+	}}
+	env := newTestEnv(vhci)
+
+	t.Run("list", func(t *testing.T) {
+		out, err := listCommand(env, []string{"usbip.example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := out.render(&buf, outputTable); err != nil {
+			t.Fatal(err)
+		}
+		expected := "BUSID  VENDOR  PRODUCT\n1-1    1050    0407\n1-2    20a0    4230\n"
+		if buf.String() != expected {
+			t.Errorf("unexpected output:\n%s", buf.String())
+		}
+		if _, err := listCommand(env, []string{"other.example.com"}); err == nil {
+			t.Errorf("expected connection failure to be reported")
+		}
+	})
+
+	t.Run("port", func(t *testing.T) {
+		out, err := portCommand(env, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := out.render(&buf, outputJSON); err != nil {
+			t.Fatal(err)
+		}
+		var slots []slotInfo
+		if err := json.Unmarshal(buf.Bytes(), &slots); err != nil {
+			t.Fatal(err)
+		}
+		if len(slots) != 2 || slots[0].Status != "used" || slots[0].Device == nil || slots[1].Status != "free" {
+			t.Errorf("unexpected output %s", buf.String())
+		}
+	})
+
+	t.Run("detach", func(t *testing.T) {
+		if _, err := detachCommand(env, []string{"0"}); err != nil {
+			t.Fatal(err)
+		}
+		if !vhci.slots[0].IsEmpty() {
+			t.Errorf("port should have been detached")
+		}
+		if _, err := detachCommand(env, []string{"5"}); err == nil {
+			t.Errorf("expected unknown port to be rejected")
+		}
+	})
+
+	t.Run("match", func(t *testing.T) {
+		config := `
+resources:
+  security-key:
+    - target:
+        host: usbip.example.com
+        port: 3240
+      selector:
+        vendor: 0x1050
+  other:
+    - target:
+        host: other.example.com
+        port: 3240
+      selector:
+        vendor: 0x20a0
+`
+		env.configFile = filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(env.configFile, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		out, err := matchCommand(env, []string{"usbip.example.com:3240"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := out.render(&buf, outputTable); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 3 || !strings.HasSuffix(lines[1], "security-key/security-key-0") || !strings.HasSuffix(lines[2], "-") {
+			t.Errorf("unexpected output:\n%s", buf.String())
+		}
+	})
+}
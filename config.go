@@ -21,9 +21,14 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/MatthiasValvekens/usbip-device-plugin/deviceplugin"
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip/host"
 	"github.com/mitchellh/mapstructure"
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -35,19 +40,44 @@ const defaultDomain = "usbip.dev.mvalvekens.be"
 // initConfig defines config flags, config file, and envs
 func initConfig() error {
 	cfgFile := flag.String("config", "", "Path to the config file.")
-	flag.String("domain", defaultDomain, "The domain to use when when declaring devices.")
-	flag.String("plugin-directory", v1beta1.DevicePluginPath, "The directory in which to create plugin sockets.")
-	flag.String("pod-resources-socket", "/var/lib/kubelet/pod-resources/kubelet.sock", "The path to the kubelet pod-resources socket")
-	flag.String("log-level", logLevelInfo, fmt.Sprintf("Log level to use. Possible values: %s", availableLogLevels))
-	flag.String("listen", ":8080", "The address at which to listen for health and metrics.")
+	defineFlags(flag.CommandLine)
 
 	flag.Parse()
 	if err := viper.BindPFlags(flag.CommandLine); err != nil {
 		return fmt.Errorf("failed to bind config: %w", err)
 	}
 
-	if *cfgFile != "" {
-		viper.SetConfigFile(*cfgFile)
+	return readConfigFile(*cfgFile)
+}
+
+// defineFlags defines the settings that can be passed as flags as well as
+// through the config file.
+func defineFlags(fs *flag.FlagSet) {
+	fs.String("domain", defaultDomain, "The domain to use when when declaring devices.")
+	fs.String("plugin-directory", v1beta1.DevicePluginPath, "The directory in which to create plugin sockets.")
+	fs.String("pod-resources-socket", "/var/lib/kubelet/pod-resources/kubelet.sock", "The path to the kubelet pod-resources socket")
+	fs.String("log-level", logLevelInfo, fmt.Sprintf("Log level to use. Possible values: %s", availableLogLevels))
+	fs.String("listen", ":8080", "The address at which to listen for health and metrics.")
+	fs.String("admin-token-file", "", "Path to a file containing the bearer token for the mutating endpoints of the admin API. Those endpoints are disabled if unset.")
+	fs.Bool("cdi", false, "Expose attached devices to containers through CDI specs instead of device specs.")
+	fs.String("cdi-spec-directory", "/var/run/cdi", "The directory in which to write CDI specs.")
+	fs.Bool("events", false, "Emit Kubernetes events about devices. Requires in-cluster credentials.")
+	fs.Bool("node-labels", false, "Publish the reachability of USB/IP targets as node labels. Requires in-cluster credentials.")
+	fs.Bool("crds", false, "Register devices declared through USBIPDevice and USBIPTarget custom resources. Requires in-cluster credentials.")
+	fs.String("node-name", "", "The name of the node the plugin runs on. Required for events and node labels.")
+	fs.String("tracing-endpoint", "", "The OTLP gRPC endpoint (host:port) to export traces to. Tracing is disabled if unset.")
+	fs.Bool("tracing-insecure", false, "Connect to the tracing endpoint without TLS.")
+	fs.Float64("tracing-sample-ratio", 1, "The fraction of traces to sample, between 0 and 1.")
+	fs.String("shutdown-policy", string(deviceplugin.ShutdownKeep), "What to do with attached devices on shutdown: keep them attached, detach-unused devices or detach-all devices.")
+	fs.Duration("shutdown-timeout", 10*time.Second, "The maximum time to spend applying the shutdown policy.")
+	fs.String("state-file", "/var/lib/usbip-device-plugin/state.json", "The file in which to record the devices left attached on shutdown. Disabled if empty.")
+	fs.String("device-link-directory", "/var/run/usbip-device-plugin/devices", "The directory in which to maintain stable links to the device nodes of resources that re-attach lost devices, without CDI. Must be mounted at the same path as on the host. Disabled if empty.")
+}
+
+// readConfigFile loads the given config file, or looks for one in the default locations.
+func readConfigFile(cfgFile string) error {
+	if cfgFile != "" {
+		viper.SetConfigFile(cfgFile)
 	} else {
 		viper.SetConfigName("config")
 		viper.SetConfigType("yaml")
@@ -70,31 +100,93 @@ func initConfig() error {
 	return nil
 }
 
-func getConfiguredDevices() (map[string][]*deviceplugin.KnownDevice, error) {
+func getConfiguredDevices() (map[string]*deviceplugin.ResourceConfig, error) {
 	resourceDefs := viper.GetStringMap("resources")
-	result := make(map[string][]*deviceplugin.KnownDevice)
+	result := make(map[string]*deviceplugin.ResourceConfig)
 
 	for resourceName, groupData := range resourceDefs {
+		resource := &deviceplugin.ResourceConfig{}
+		var err error
 		switch raw := groupData.(type) {
 		case []interface{}:
-			deviceSpecs := make([]*deviceplugin.KnownDevice, len(raw))
-			for i, def := range raw {
-				decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
-					Result:  &deviceSpecs[i],
-					TagName: "json",
-				})
-				if err != nil {
-					return nil, err
-				}
-
-				if err := decoder.Decode(def); err != nil {
-					return nil, fmt.Errorf("failed to decode device data %q: %w", def, err)
-				}
-			}
-			result[resourceName] = deviceSpecs
+			// shorthand: a plain list of devices with default options
+			err = decodeConfig(raw, &resource.Devices)
+		case map[string]interface{}:
+			err = decodeConfig(raw, resource)
 		default:
 			return nil, fmt.Errorf("failed to decode devices: unexpected type: %T", groupData)
 		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", resourcePath(resourceName), err)
+		}
+		result[resourceName] = resource
 	}
 	return result, nil
 }
+
+// getExportPolicy returns the policy that the serve command enforces, or nil if none is configured.
+func getExportPolicy() (*host.Policy, error) {
+	if !viper.IsSet("export") {
+		return nil, nil
+	}
+	policy := &host.Policy{}
+	if err := decodeConfig(viper.Get("export"), policy); err != nil {
+		return nil, fmt.Errorf("failed to decode export: %w", err)
+	}
+	return policy, nil
+}
+
+// numericUSBID checks that a USB ID given as a number fits in 16 bits. Left to itself,
+// mapstructure would silently truncate it, possibly turning a selector into a wildcard.
+func numericUSBID(value interface{}) (driver.USBID, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Int() >= 0 && v.Int() <= math.MaxUint16 {
+			return driver.USBID(v.Int()), true
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() <= math.MaxUint16 {
+			return driver.USBID(v.Uint()), true
+		}
+	case reflect.Float32, reflect.Float64:
+		if f := v.Float(); f >= 0 && f <= math.MaxUint16 && f == math.Trunc(f) {
+			return driver.USBID(f), true
+		}
+	}
+	return 0, false
+}
+
+// usbIDHook rejects numeric USB IDs that are out of range.
+func usbIDHook(_ reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(driver.USBID(0)) {
+		return data, nil
+	}
+	switch reflect.ValueOf(data).Kind() {
+	case reflect.String, reflect.Invalid:
+		return data, nil
+	}
+	id, ok := numericUSBID(data)
+	if !ok {
+		return nil, fmt.Errorf("invalid USB ID %v: expected a number between 0 and 0xffff", data)
+	}
+	return id, nil
+}
+
+func decodeConfig(input interface{}, result interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:  result,
+		TagName: "json",
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			usbIDHook,
+			// parses USB IDs in hex and the vvvv:pppp shorthand for selectors
+			mapstructure.TextUnmarshallerHookFunc(),
+		),
+		ErrorUnused: true,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(input)
+}
@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+)
+
+func TestDecodeUSBIDs(t *testing.T) {
+	env := loadTestConfig(t, `
+resources:
+  decimal:
+    - target: {host: usbip.example.com, port: 3240}
+      selector: {vendor: 1027, product: 24577}
+  hex:
+    - target: {host: usbip.example.com, port: 3240}
+      selector: {vendor: 0x0403, product: "6001"}
+  prefixed:
+    - target: {host: usbip.example.com, port: 3240}
+      selector: {vendor: "0x0403", product: "0x6001", bus_id: "1-1"}
+  shorthand:
+    - target: {host: usbip.example.com, port: 3240}
+      selector: "0403:6001"
+`)
+	if err := readConfigFile(env.configFile); err != nil {
+		t.Fatal(err)
+	}
+	resources, err := getConfiguredDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]driver.USBDevice{
+		"decimal":   {Vendor: 0x0403, Product: 0x6001},
+		"hex":       {Vendor: 0x0403, Product: 0x6001},
+		"prefixed":  {Vendor: 0x0403, Product: 0x6001, BusId: "1-1"},
+		"shorthand": {Vendor: 0x0403, Product: 0x6001},
+	} {
+		if selector := resources[name].Devices[0].Selector; selector != expected {
+			t.Errorf("%s: got %v; want %v", name, selector, expected)
+		}
+	}
+}
+
+func TestDecodeInvalidUSBID(t *testing.T) {
+	for _, selector := range []string{`{vendor: "xyz"}`, `{vendor: "10000"}`, `"0403"`, `"0403:"`} {
+		env := loadTestConfig(t, `
+resources:
+  dev:
+    - target: {host: usbip.example.com, port: 3240}
+      selector: `+selector+`
+`)
+		if err := readConfigFile(env.configFile); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := getConfiguredDevices(); err == nil {
+			t.Errorf("%s: expected decoding to fail", selector)
+		}
+	}
+}
+
+func TestDecodeExportPolicy(t *testing.T) {
+	env := loadTestConfig(t, `
+export:
+  rules:
+    - clients: [192.0.2.0/24, "2001:db8::1"]
+      devices: ["10c4:ea60", {bus_id: "1-2"}]
+`)
+	if err := readConfigFile(env.configFile); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := getExportPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Rules) != 1 {
+		t.Fatalf("unexpected policy %+v", policy)
+	}
+	rule := policy.Rules[0]
+	if len(rule.Clients) != 2 || rule.Clients[0].String() != "192.0.2.0/24" || rule.Clients[1].String() != "2001:db8::1" {
+		t.Errorf("unexpected clients %v", rule.Clients)
+	}
+	expected := []driver.USBDevice{{Vendor: 0x10c4, Product: 0xea60}, {BusId: "1-2"}}
+	if len(rule.Devices) != 2 || rule.Devices[0] != expected[0] || rule.Devices[1] != expected[1] {
+		t.Errorf("unexpected devices %v", rule.Devices)
+	}
+
+	env = loadTestConfig(t, `
+export:
+  rules:
+    - clients: [192.0.2.0/33]
+`)
+	if err := readConfigFile(env.configFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getExportPolicy(); err == nil {
+		t.Errorf("expected invalid CIDR range to be rejected")
+	}
+}
@@ -0,0 +1,386 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package crd registers devices declared through USBIPDevice and USBIPTarget
+// custom resources with the device manager, and reports their status.
+package crd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/api/v1alpha1"
+	"github.com/MatthiasValvekens/usbip-device-plugin/deviceplugin"
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	resyncPeriod   = 10 * time.Minute
+	statusInterval = 30 * time.Second
+	// lastSeenResolution is the minimal change in the last seen time of a device
+	// that warrants a status update on its own.
+	lastSeenResolution = time.Minute
+)
+
+// registration is a USBIPDevice registered with the device manager.
+type registration struct {
+	resource string
+	devId    string
+	// fingerprint identifies the configuration the device was registered with.
+	fingerprint string
+}
+
+// Controller watches USBIPDevice and USBIPTarget objects, and registers the devices
+// they describe with the device manager.
+type Controller struct {
+	client   dynamic.Interface
+	dm       *deviceplugin.DeviceManager
+	nodeName string
+	// ensurePlugin is called before devices are registered for a resource,
+	// to make sure a plugin advertising the resource is running.
+	ensurePlugin func(resourceName string)
+	logger       log.Logger
+
+	factory dynamicinformer.DynamicSharedInformerFactory
+	devices cache.GenericLister
+	targets cache.GenericLister
+	trigger chan struct{}
+
+	registered map[string]*registration
+	// invalid maps the names of devices that could not be registered to the reason why.
+	invalid map[string]string
+}
+
+func NewController(client dynamic.Interface, dm *deviceplugin.DeviceManager, nodeName string, ensurePlugin func(resourceName string), logger log.Logger) (*Controller, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, resyncPeriod)
+	c := &Controller{
+		client:       client,
+		dm:           dm,
+		nodeName:     nodeName,
+		ensurePlugin: ensurePlugin,
+		logger:       logger,
+		factory:      factory,
+		trigger:      make(chan struct{}, 1),
+		registered:   make(map[string]*registration),
+		invalid:      make(map[string]string),
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.requestSync() },
+		UpdateFunc: func(interface{}, interface{}) { c.requestSync() },
+		DeleteFunc: func(interface{}) { c.requestSync() },
+	}
+	deviceInformer := factory.ForResource(v1alpha1.USBIPDeviceResource)
+	if _, err := deviceInformer.Informer().AddEventHandler(handler); err != nil {
+		return nil, err
+	}
+	targetInformer := factory.ForResource(v1alpha1.USBIPTargetResource)
+	if _, err := targetInformer.Informer().AddEventHandler(handler); err != nil {
+		return nil, err
+	}
+	c.devices = deviceInformer.Lister()
+	c.targets = targetInformer.Lister()
+	return c, nil
+}
+
+func (c *Controller) requestSync() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts the informers and registers the devices that exist at this point.
+// It should be called before the device manager is started, so devices that are still
+// attached from a previous run can be paired with their configuration.
+func (c *Controller) Start(ctx context.Context) error {
+	c.factory.Start(ctx.Done())
+	for resource, synced := range c.factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return errors.Newf("failed to sync informer for %s", resource.Resource)
+		}
+	}
+	c.sync()
+	return nil
+}
+
+// Run keeps the registered devices in sync with the custom resources, and
+// periodically writes back their status, until the context is cancelled.
+func (c *Controller) Run(ctx context.Context) error {
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.trigger:
+			c.sync()
+		case <-ticker.C:
+			c.writeStatus(ctx)
+		case <-ctx.Done():
+			c.factory.Shutdown()
+			return nil
+		}
+	}
+}
+
+// desiredDevice is a device as described by a USBIPDevice.
+type desiredDevice struct {
+	resource    string
+	device      *deviceplugin.KnownDevice
+	fingerprint string
+}
+
+func parseUSBID(value string) (driver.USBID, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return driver.ParseUSBID(value)
+}
+
+// knownDevice converts a USBIPDevice to the device manager's representation.
+func knownDevice(dev *v1alpha1.USBIPDevice, target *v1alpha1.USBIPTarget) (*deviceplugin.KnownDevice, error) {
+	vendor, err := parseUSBID(dev.Spec.Selector.Vendor)
+	if err != nil {
+		return nil, err
+	}
+	product, err := parseUSBID(dev.Spec.Selector.Product)
+	if err != nil {
+		return nil, err
+	}
+	// the API server fills in the default port, so like in the configuration file, it must be set
+	port := target.Spec.Port
+	switch {
+	case port == 0:
+		return nil, errors.Newf("target %s has no port", target.Name)
+	case port < 0 || port > 65535:
+		return nil, errors.Newf("target %s: port %d out of range", target.Name, port)
+	}
+	kd := &deviceplugin.KnownDevice{
+		Name:   dev.Name,
+		Target: usbip.Target{Host: target.Spec.Host, Port: port},
+		Selector: driver.USBDevice{
+			Vendor:  vendor,
+			Product: product,
+			BusId:   dev.Spec.Selector.BusID,
+		},
+		ContainerPath: dev.Spec.ContainerPath,
+		InterfacePath: dev.Spec.InterfacePath,
+		Replicas:      dev.Spec.Replicas,
+		Permissions:   dev.Spec.Permissions,
+		ReadOnly:      dev.Spec.ReadOnly,
+	}
+	for _, extra := range dev.Spec.Extras {
+		containerPath := extra.ContainerPath
+		if containerPath == "" {
+			containerPath = extra.HostPath
+		}
+		// the device manager fills in the default permissions, which depend on ReadOnly
+		kd.ExtraDevices = append(kd.ExtraDevices, v1beta1.DeviceSpec{
+			HostPath:      extra.HostPath,
+			ContainerPath: containerPath,
+			Permissions:   extra.Permissions,
+		})
+	}
+	return kd, nil
+}
+
+func fromUnstructured(obj runtime.Object, into interface{}) error {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return errors.Newf("unexpected object type %T", obj)
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, into)
+}
+
+// desiredDevices lists the devices described by the custom resources in the informer caches.
+// Devices that can't be registered are recorded in c.invalid.
+func (c *Controller) desiredDevices() (map[string]*desiredDevice, error) {
+	targetObjs, err := c.targets.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string]*v1alpha1.USBIPTarget, len(targetObjs))
+	for _, obj := range targetObjs {
+		target := &v1alpha1.USBIPTarget{}
+		if err := fromUnstructured(obj, target); err != nil {
+			return nil, err
+		}
+		targets[target.Name] = target
+	}
+
+	deviceObjs, err := c.devices.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	c.invalid = make(map[string]string)
+	desired := make(map[string]*desiredDevice, len(deviceObjs))
+	for _, obj := range deviceObjs {
+		dev := &v1alpha1.USBIPDevice{}
+		if err := fromUnstructured(obj, dev); err != nil {
+			return nil, err
+		}
+		target, ok := targets[dev.Spec.Target]
+		if !ok {
+			c.invalid[dev.Name] = fmt.Sprintf("target %q not found", dev.Spec.Target)
+			continue
+		}
+		if dev.Spec.Resource == "" {
+			c.invalid[dev.Name] = "resource must be set"
+			continue
+		}
+		kd, err := knownDevice(dev, target)
+		if err != nil {
+			c.invalid[dev.Name] = err.Error()
+			continue
+		}
+		fingerprint, err := json.Marshal(struct {
+			Resource string
+			Device   *deviceplugin.KnownDevice
+		}{dev.Spec.Resource, kd})
+		if err != nil {
+			return nil, err
+		}
+		desired[dev.Name] = &desiredDevice{resource: dev.Spec.Resource, device: kd, fingerprint: string(fingerprint)}
+	}
+	return desired, nil
+}
+
+// sync registers and unregisters devices to match the custom resources.
+func (c *Controller) sync() {
+	desired, err := c.desiredDevices()
+	if err != nil {
+		_ = level.Warn(c.logger).Log("msg", "failed to list USB/IP custom resources", "err", err)
+		return
+	}
+	changed := make([]string, 0)
+	for name, reg := range c.registered {
+		if d, ok := desired[name]; ok && d.fingerprint == reg.fingerprint {
+			continue
+		}
+		_ = level.Info(c.logger).Log("msg", "unregistering device", "name", name, "devId", reg.devId)
+		c.dm.Unregister(reg.devId)
+		changed = append(changed, reg.devId)
+		delete(c.registered, name)
+	}
+	for name, d := range desired {
+		if _, ok := c.registered[name]; ok {
+			continue
+		}
+		// resources that aren't declared in the configuration file get the default options
+		if _, err := c.dm.Register(d.resource, c.dm.Options(d.resource), []*deviceplugin.KnownDevice{d.device}); err != nil {
+			c.invalid[name] = err.Error()
+			continue
+		}
+		if c.ensurePlugin != nil {
+			c.ensurePlugin(d.resource)
+		}
+		devId := d.device.ID()
+		_ = level.Info(c.logger).Log("msg", "registered device", "name", name, "resource", d.resource, "devId", devId)
+		c.registered[name] = &registration{resource: d.resource, devId: devId, fingerprint: d.fingerprint}
+		changed = append(changed, devId)
+	}
+	for name, reason := range c.invalid {
+		_ = level.Warn(c.logger).Log("msg", "ignoring invalid device", "name", name, "reason", reason)
+	}
+	if len(changed) > 0 {
+		c.dm.Notify(changed)
+	}
+}
+
+// desiredStatus computes the status of a device as observed by this node.
+// Nodes only report on devices that are not attached to another node.
+func (c *Controller) desiredStatus(current v1alpha1.USBIPDeviceStatus, st deviceplugin.DeviceStatus) (v1alpha1.USBIPDeviceStatus, bool) {
+	if !st.Attached && current.Node != "" && current.Node != c.nodeName {
+		return current, false
+	}
+	status := v1alpha1.USBIPDeviceStatus{LastSeen: current.LastSeen}
+	switch {
+	case st.Attached:
+		status.Node = c.nodeName
+		status.Health = v1alpha1.DeviceHealthy
+	case !st.TargetReachable:
+		status.Health = v1alpha1.DeviceUnreachable
+		status.Message = fmt.Sprintf("target unreachable from node %s", c.nodeName)
+	case st.Available:
+		status.Health = v1alpha1.DeviceHealthy
+	default:
+		status.Health = v1alpha1.DeviceMissing
+		status.Message = "device not offered by target"
+	}
+	lastSeenChanged := false
+	if !st.LastSeen.IsZero() {
+		lastSeen := st.LastSeen.Truncate(time.Second)
+		if current.LastSeen == nil || lastSeen.Sub(current.LastSeen.Time) >= lastSeenResolution {
+			status.LastSeen = &metav1.Time{Time: lastSeen}
+			lastSeenChanged = true
+		}
+	}
+	changed := lastSeenChanged || status.Node != current.Node || status.Health != current.Health || status.Message != current.Message
+	return status, changed
+}
+
+// writeStatus writes back the status of all devices as observed by this node, where it changed.
+func (c *Controller) writeStatus(ctx context.Context) {
+	deviceObjs, err := c.devices.List(labels.Everything())
+	if err != nil {
+		_ = level.Warn(c.logger).Log("msg", "failed to list USB/IP devices", "err", err)
+		return
+	}
+	for _, obj := range deviceObjs {
+		dev := &v1alpha1.USBIPDevice{}
+		if err := fromUnstructured(obj, dev); err != nil {
+			_ = level.Warn(c.logger).Log("msg", "failed to decode USB/IP device", "err", err)
+			continue
+		}
+		var status v1alpha1.USBIPDeviceStatus
+		var changed bool
+		if reason, invalid := c.invalid[dev.Name]; invalid {
+			status = v1alpha1.USBIPDeviceStatus{Health: v1alpha1.DeviceInvalid, Message: reason}
+			changed = dev.Status.Health != status.Health || dev.Status.Message != status.Message
+		} else if reg, ok := c.registered[dev.Name]; ok {
+			st, ok := c.dm.DeviceStatus(reg.devId)
+			if !ok {
+				continue
+			}
+			status, changed = c.desiredStatus(dev.Status, st)
+		}
+		if !changed {
+			continue
+		}
+		if err := c.patchStatus(ctx, dev.Name, status); err != nil {
+			_ = level.Warn(c.logger).Log("msg", "failed to update device status", "name", dev.Name, "err", err)
+		}
+	}
+}
+
+func (c *Controller) patchStatus(ctx context.Context, name string, status v1alpha1.USBIPDeviceStatus) error {
+	// all fields are listed explicitly, so the merge patch also clears fields that became empty
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"node":     status.Node,
+			"lastSeen": status.LastSeen,
+			"health":   status.Health,
+			"message":  status.Message,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.client.Resource(v1alpha1.USBIPDeviceResource).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	return err
+}
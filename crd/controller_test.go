@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package crd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/api/v1alpha1"
+	"github.com/MatthiasValvekens/usbip-device-plugin/deviceplugin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func toUnstructured(t *testing.T, obj runtime.Object) *unstructured.Unstructured {
+	t.Helper()
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &unstructured.Unstructured{Object: content}
+}
+
+func TestController(t *testing.T) {
+	target := &v1alpha1.USBIPTarget{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1.GroupVersion.String(), Kind: "USBIPTarget"},
+		ObjectMeta: metav1.ObjectMeta{Name: "server"},
+		// the fake client doesn't apply the defaults from the schema
+		Spec: v1alpha1.USBIPTargetSpec{Host: "usbip.example.com", Port: 3240},
+	}
+	device := &v1alpha1.USBIPDevice{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1.GroupVersion.String(), Kind: "USBIPDevice"},
+		ObjectMeta: metav1.ObjectMeta{Name: "key"},
+		Spec: v1alpha1.USBIPDeviceSpec{
+			Resource: "security-key",
+			Target:   "server",
+			Selector: v1alpha1.USBSelector{Vendor: "1050", Product: "0407"},
+		},
+	}
+	orphan := &v1alpha1.USBIPDevice{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1.GroupVersion.String(), Kind: "USBIPDevice"},
+		ObjectMeta: metav1.ObjectMeta{Name: "orphan"},
+		Spec:       v1alpha1.USBIPDeviceSpec{Resource: "security-key", Target: "missing"},
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		v1alpha1.USBIPDeviceResource: "USBIPDeviceList",
+		v1alpha1.USBIPTargetResource: "USBIPTargetList",
+	}, toUnstructured(t, target), toUnstructured(t, device), toUnstructured(t, orphan))
+
+	dm := deviceplugin.NewDeviceManager("", nil, nil, nil)
+	plugins := make(map[string]bool)
+	c, err := NewController(client, dm, "node", func(resourceName string) { plugins[resourceName] = true }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, ok := c.registered["key"]
+	if !ok {
+		t.Fatalf("device should have been registered")
+	}
+	if !plugins["security-key"] {
+		t.Errorf("plugin should have been started for the resource")
+	}
+	if _, ok := dm.DeviceStatus(reg.devId); !ok {
+		t.Errorf("device manager should know about the device")
+	}
+	if _, ok := c.invalid["orphan"]; !ok {
+		t.Errorf("device without target should be invalid")
+	}
+
+	// the target was never refreshed, so it's considered unreachable
+	c.writeStatus(ctx)
+	obj, err := client.Resource(v1alpha1.USBIPDeviceResource).Get(ctx, "key", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := &v1alpha1.USBIPDevice{}
+	if err := fromUnstructured(obj, written); err != nil {
+		t.Fatal(err)
+	}
+	if written.Status.Health != v1alpha1.DeviceUnreachable {
+		t.Errorf("unexpected status %+v", written.Status)
+	}
+	obj, err = client.Resource(v1alpha1.USBIPDeviceResource).Get(ctx, "orphan", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fromUnstructured(obj, written); err != nil {
+		t.Fatal(err)
+	}
+	if written.Status.Health != v1alpha1.DeviceInvalid {
+		t.Errorf("unexpected status %+v", written.Status)
+	}
+
+	if err := client.Resource(v1alpha1.USBIPDeviceResource).Delete(ctx, "key", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		objs, err := c.devices.List(labels.Everything())
+		return err == nil && len(objs) == 1, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.sync()
+	if _, ok := c.registered["key"]; ok {
+		t.Errorf("device should have been unregistered")
+	}
+	if _, ok := dm.DeviceStatus(reg.devId); ok {
+		t.Errorf("device manager should have forgotten the device")
+	}
+}
+
+func TestTargetPort(t *testing.T) {
+	device := &v1alpha1.USBIPDevice{
+		ObjectMeta: metav1.ObjectMeta{Name: "key"},
+		Spec:       v1alpha1.USBIPDeviceSpec{Resource: "security-key", Target: "server"},
+	}
+	for _, tc := range []struct {
+		port  int
+		valid bool
+	}{
+		{port: 3240, valid: true},
+		{port: 0},
+		{port: 70000},
+	} {
+		target := &v1alpha1.USBIPTarget{
+			ObjectMeta: metav1.ObjectMeta{Name: "server"},
+			Spec:       v1alpha1.USBIPTargetSpec{Host: "usbip.example.com", Port: tc.port},
+		}
+		kd, err := knownDevice(device, target)
+		if (err == nil) != tc.valid {
+			t.Errorf("port %d: unexpected error %v", tc.port, err)
+		}
+		if err == nil && kd.Target.Port != tc.port {
+			t.Errorf("port %d: got target %v", tc.port, kd.Target)
+		}
+	}
+}
+
+func TestDesiredStatus(t *testing.T) {
+	c := &Controller{nodeName: "node"}
+	now := time.Now()
+
+	status, changed := c.desiredStatus(v1alpha1.USBIPDeviceStatus{}, deviceplugin.DeviceStatus{Attached: true, LastSeen: now})
+	if !changed || status.Node != "node" || status.Health != v1alpha1.DeviceHealthy || status.LastSeen == nil {
+		t.Errorf("unexpected status %+v", status)
+	}
+	status, changed = c.desiredStatus(status, deviceplugin.DeviceStatus{Attached: true, LastSeen: now.Add(time.Second)})
+	if changed {
+		t.Errorf("small changes in last seen time should not trigger an update")
+	}
+	_, changed = c.desiredStatus(v1alpha1.USBIPDeviceStatus{Node: "other"}, deviceplugin.DeviceStatus{TargetReachable: true})
+	if changed {
+		t.Errorf("devices attached to other nodes should not be reported on")
+	}
+	status, changed = c.desiredStatus(v1alpha1.USBIPDeviceStatus{Node: "node"}, deviceplugin.DeviceStatus{TargetReachable: true})
+	if !changed || status.Node != "" || status.Health != v1alpha1.DeviceMissing {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
@@ -0,0 +1,122 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	baseerrors "errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+)
+
+const (
+	cdiSpecFilePrefix = "usbip-device-plugin"
+)
+
+// cdiConfig describes where and how CDI specs for attached devices are written.
+type cdiConfig struct {
+	specDir string
+	domain  string
+}
+
+func (c *cdiConfig) kind(kd *KnownDevice) string {
+	return c.domain + "/" + kd.resource
+}
+
+func (c *cdiConfig) specPath(devId string) string {
+	return filepath.Join(c.specDir, fmt.Sprintf("%s-%s.json", cdiSpecFilePrefix, devId))
+}
+
+func (c *cdiConfig) qualifiedName(kd *KnownDevice, devId string) string {
+	return c.kind(kd) + "=" + devId
+}
+
+func cdiDeviceNode(spec *v1beta1.DeviceSpec) *cdispec.DeviceNode {
+	return &cdispec.DeviceNode{
+		Path:        spec.ContainerPath,
+		HostPath:    spec.HostPath,
+		Permissions: spec.Permissions,
+	}
+}
+
+// buildSpec assembles a CDI spec for a single attached device, exposing the same nodes
+// that would otherwise be passed to the kubelet as DeviceSpecs, together with any
+// extra container edits from the device configuration.
+func (c *cdiConfig) buildSpec(devId string, kd *KnownDevice, dev *usbip.AttachedDevice) (*cdispec.Spec, error) {
+	edits := cdispec.ContainerEdits{}
+	if kd.CDI != nil {
+		edits.Env = append(edits.Env, kd.CDI.Env...)
+		edits.Mounts = append(edits.Mounts, kd.CDI.Mounts...)
+		edits.Hooks = append(edits.Hooks, kd.CDI.Hooks...)
+		edits.DeviceNodes = append(edits.DeviceNodes, kd.cdiDeviceNodes()...)
+	}
+	specs, err := deviceSpecs(kd, dev)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		edits.DeviceNodes = append(edits.DeviceNodes, cdiDeviceNode(spec))
+	}
+
+	spec := &cdispec.Spec{
+		Kind: c.kind(kd),
+		Devices: []cdispec.Device{
+			{
+				Name:           devId,
+				ContainerEdits: edits,
+			},
+		},
+	}
+	version, err := cdispec.MinimumRequiredVersion(spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to determine CDI spec version")
+	}
+	spec.Version = version
+	return spec, nil
+}
+
+// writeSpec (re)writes the CDI spec for an attached device. The file is written
+// to a temporary location first, so runtimes never observe a partially written spec.
+func (c *cdiConfig) writeSpec(devId string, kd *KnownDevice, dev *usbip.AttachedDevice) error {
+	spec, err := c.buildSpec(devId, kd, dev)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal CDI spec for %s", devId)
+	}
+	if err = os.MkdirAll(c.specDir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create CDI spec directory %s", c.specDir)
+	}
+	tmp, err := os.CreateTemp(c.specDir, ".tmp-"+cdiSpecFilePrefix+"-*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary CDI spec file")
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	_, err = tmp.Write(data)
+	closeErr := tmp.Close()
+	if err != nil || closeErr != nil {
+		return errors.Wrapf(baseerrors.Join(err, closeErr), "failed to write CDI spec for %s", devId)
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return errors.Wrapf(err, "failed to set permissions on CDI spec for %s", devId)
+	}
+	if err = os.Rename(tmp.Name(), c.specPath(devId)); err != nil {
+		return errors.Wrapf(err, "failed to install CDI spec for %s", devId)
+	}
+	return nil
+}
+
+func (c *cdiConfig) removeSpec(devId string) error {
+	if err := os.Remove(c.specPath(devId)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove CDI spec for %s", devId)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+)
+
+func TestCDISpecLifecycle(t *testing.T) {
+	c := &cdiConfig{specDir: t.TempDir(), domain: "usbip.example.com"}
+	kd := &KnownDevice{
+		ExtraDevices: []v1beta1.DeviceSpec{
+			{ContainerPath: "/dev/extra", HostPath: "/dev/extra", Permissions: "r"},
+		},
+		CDI: &cdispec.ContainerEdits{
+			Env: []string{"FOO=bar"},
+		},
+		resource: "some-device",
+	}
+	dev := &usbip.AttachedDevice{
+		DevMountPath:      "/dev/bus/usb/002/033",
+		InterfaceDevNodes: []string{"/dev/ttyACM0"},
+	}
+
+	if err := c.writeSpec("some-device_abc", kd, dev); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(c.specPath("some-device_abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := cdispec.Spec{}
+	if err = json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if spec.Kind != "usbip.example.com/some-device" {
+		t.Errorf("unexpected kind %s", spec.Kind)
+	}
+	if c.qualifiedName(kd, "some-device_abc") != "usbip.example.com/some-device=some-device_abc" {
+		t.Errorf("unexpected qualified name %s", c.qualifiedName(kd, "some-device_abc"))
+	}
+	if len(spec.Devices) != 1 || spec.Devices[0].Name != "some-device_abc" {
+		t.Fatalf("unexpected devices %v", spec.Devices)
+	}
+	edits := spec.Devices[0].ContainerEdits
+	if len(edits.Env) != 1 || edits.Env[0] != "FOO=bar" {
+		t.Errorf("unexpected env %v", edits.Env)
+	}
+	expectedNodes := []string{"/dev/bus/usb/002/033", "/dev/ttyACM0", "/dev/extra"}
+	if len(edits.DeviceNodes) != len(expectedNodes) {
+		t.Fatalf("got %d device nodes; want %d", len(edits.DeviceNodes), len(expectedNodes))
+	}
+	for i, node := range expectedNodes {
+		if edits.DeviceNodes[i].Path != node || edits.DeviceNodes[i].HostPath != node {
+			t.Errorf("device node %d: got %v; want %s", i, edits.DeviceNodes[i], node)
+		}
+	}
+
+	if err = c.removeSpec("some-device_abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(c.specPath("some-device_abc")); !os.IsNotExist(err) {
+		t.Errorf("expected spec to be removed, got %v", err)
+	}
+	// removing twice is fine
+	if err = c.removeSpec("some-device_abc"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCDIReadOnlyDeviceNodes(t *testing.T) {
+	c := &cdiConfig{specDir: t.TempDir(), domain: "usbip.example.com"}
+	kd := &KnownDevice{
+		ReadOnly: true,
+		CDI: &cdispec.ContainerEdits{
+			DeviceNodes: []*cdispec.DeviceNode{{Path: "/dev/gpiochip0"}},
+		},
+		resource: "some-device",
+	}
+	spec, err := c.buildSpec("some-device_abc", kd, &usbip.AttachedDevice{DevMountPath: "/dev/bus/usb/002/033"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range spec.Devices[0].ContainerEdits.DeviceNodes {
+		if node.Permissions != "r" {
+			t.Errorf("device node %s of a read-only device has permissions %q", node.Path, node.Permissions)
+		}
+	}
+	if kd.CDI.DeviceNodes[0].Permissions != "" {
+		t.Errorf("the configured device node should not be modified")
+	}
+}
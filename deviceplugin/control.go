@@ -0,0 +1,158 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log/level"
+)
+
+// ErrUnknownDevice is returned when an operation refers to a device that isn't registered.
+var ErrUnknownDevice = errors.New("unknown device")
+
+// ErrUnknownPort is returned when an operation refers to a VHCI port that doesn't exist.
+var ErrUnknownPort = errors.New("unknown port")
+
+// AttachmentInfo describes a device attached to this node.
+type AttachmentInfo struct {
+	// Port is the VHCI port the device is attached to. Local devices don't have one.
+	Port              *driver.VirtualPort `json:"port,omitempty"`
+	DevMountPath      string              `json:"dev_mount_path"`
+	InterfaceDevNodes []string            `json:"interface_dev_nodes,omitempty"`
+	// Holders are the advertised IDs of the device currently allocated to containers.
+	Holders       []string   `json:"holders"`
+	ReleasedSince *time.Time `json:"released_since,omitempty"`
+	// LostSince is set if the device was disconnected from its port.
+	LostSince *time.Time `json:"lost_since,omitempty"`
+}
+
+// DeviceInfo describes a registered device.
+type DeviceInfo struct {
+	ID             string           `json:"id"`
+	Name           string           `json:"name"`
+	Resource       string           `json:"resource"`
+	Target         usbip.Target     `json:"target"`
+	Selector       driver.USBDevice `json:"selector"`
+	Available      bool             `json:"available"`
+	Cordoned       bool             `json:"cordoned"`
+	Retired        bool             `json:"retired,omitempty"`
+	ReadProperties driver.USBDevice `json:"read_properties"`
+	LastSeen       *time.Time       `json:"last_seen,omitempty"`
+	Attachment     *AttachmentInfo  `json:"attachment,omitempty"`
+}
+
+// Devices describes all registered devices, ordered by ID.
+func (dm *DeviceManager) Devices() []DeviceInfo {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	result := make([]DeviceInfo, 0, len(dm.knownDevices))
+	for devId, kd := range dm.knownDevices {
+		info := DeviceInfo{
+			ID:             devId,
+			Name:           kd.Name,
+			Resource:       kd.resource,
+			Target:         kd.Target,
+			Selector:       kd.Selector,
+			Available:      kd.available,
+			Cordoned:       kd.cordoned,
+			Retired:        kd.retired,
+			ReadProperties: kd.readProperties,
+		}
+		if !kd.lastSeen.IsZero() {
+			lastSeen := kd.lastSeen
+			info.LastSeen = &lastSeen
+		}
+		if att, ok := dm.attachedDevices[devId]; ok {
+			holders := make([]string, 0, len(att.holders))
+			for advertisedId := range att.holders {
+				holders = append(holders, advertisedId)
+			}
+			sort.Strings(holders)
+			info.Attachment = &AttachmentInfo{
+				DevMountPath:      att.DevMountPath,
+				InterfaceDevNodes: att.InterfaceDevNodes,
+				Holders:           holders,
+			}
+			if !att.Target.Local {
+				port := att.Port
+				info.Attachment.Port = &port
+			}
+			if !att.releasedSince.IsZero() {
+				releasedSince := att.releasedSince
+				info.Attachment.ReleasedSince = &releasedSince
+			}
+			if !att.lostSince.IsZero() {
+				lostSince := att.lostSince
+				info.Attachment.LostSince = &lostSince
+			}
+		}
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// Refresh releases unused devices and refreshes all targets right away,
+// instead of waiting for the next scheduled refresh.
+func (dm *DeviceManager) Refresh(ctx context.Context) error {
+	changed, err := dm.refreshDevices(ctx)
+	dm.nodeStatus.publish(dm.TargetStates())
+	dm.Notify(changed)
+	return err
+}
+
+// ForceDetach detaches whatever is attached to the given VHCI port, regardless of whether
+// it's still in use. This is meant to recover from stuck ports.
+func (dm *DeviceManager) ForceDetach(ctx context.Context, port driver.VirtualPort) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if int(port) >= len(dm.vhciDriver.GetDeviceSlots()) {
+		return errors.Wrapf(ErrUnknownPort, "port %d", port)
+	}
+	// the target is only known if the device on the port is one of ours;
+	// local devices aren't attached to a port, even though their Port is 0
+	var target usbip.Target
+	for _, att := range dm.attachedDevices {
+		if att.Port == port && !att.Target.Local {
+			target = att.Target
+		}
+	}
+	if err := dm.detach(ctx, port, target); err != nil {
+		return errors.Wrapf(err, "failed to detach port %d", port)
+	}
+	for devId, att := range dm.attachedDevices {
+		if att.Port != port || att.Target.Local {
+			continue
+		}
+		_ = level.Warn(dm.logger).Log("msg", "forcibly detached device", "devId", devId, "port", port, "holders", len(att.holders))
+		dm.forgetAttached(devId)
+		if dm.knownDevices[devId].retired {
+			dm.forgetDevice(devId)
+		}
+		dm.notify([]string{devId})
+	}
+	return nil
+}
+
+// Cordon stops (or resumes) advertising the given device to the kubelet.
+// Containers that already hold the device keep it, and the device is released once they are gone.
+func (dm *DeviceManager) Cordon(devId string, cordoned bool) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	kd, ok := dm.knownDevices[devId]
+	if !ok {
+		return errors.Wrapf(ErrUnknownDevice, "device %s", devId)
+	}
+	if kd.cordoned != cordoned {
+		_ = level.Info(dm.logger).Log("msg", "changing device cordon", "devId", devId, "cordoned", cordoned)
+		kd.cordoned = cordoned
+		dm.notify([]string{devId})
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+)
+
+func TestCordonReleasesDevice(t *testing.T) {
+	dev := &KnownDevice{
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1234, Product: 0x5678},
+	}
+	dm, vhci, devId := newTestDeviceManager(t, dev)
+	dm.recordAdvertised(nil, map[string]bool{devId: true})
+	pods := &fakePodResources{snapshot: &podResourcesSnapshot{
+		witnesses:   map[string]podRef{devId: {Namespace: "default", Name: "pod"}},
+		allocatable: map[string]bool{devId: true},
+	}}
+	dm.podResources = pods
+
+	if err := dm.Cordon(devId, true); err != nil {
+		t.Fatal(err)
+	}
+	// the kubelet stops listing the device once the plugin withdraws it
+	dm.recordAdvertised(map[string]bool{devId: true}, map[string]bool{})
+	pods.snapshot = &podResourcesSnapshot{
+		witnesses:   map[string]podRef{devId: {Namespace: "default", Name: "pod"}},
+		allocatable: map[string]bool{},
+	}
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dm.attachedDevices[devId]; !ok {
+		t.Fatalf("cordoned device should stay attached while a pod holds it")
+	}
+
+	pods.snapshot = &podResourcesSnapshot{witnesses: map[string]podRef{}, allocatable: map[string]bool{}}
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	dm.attachedDevices[devId].releasedSince = time.Now().Add(-defaultReleaseGracePeriod)
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !vhci.slots[0].IsEmpty() {
+		t.Errorf("port should have been freed")
+	}
+	devices := dm.Devices()
+	if len(devices) != 1 || devices[0].Attachment != nil || !devices[0].Cordoned {
+		t.Errorf("expected a cordoned, detached device, got %+v", devices)
+	}
+}
@@ -0,0 +1,83 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"fmt"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons for the events emitted by the device manager.
+const (
+	EventReasonDeviceAttached     = "DeviceAttached"
+	EventReasonImportFailed       = "ImportFailed"
+	EventReasonDeviceDetached     = "DeviceDetached"
+	EventReasonTargetUnreachable  = "TargetUnreachable"
+	EventReasonDeviceLost         = "DeviceLost"
+	EventReasonDeviceDisconnected = "DeviceDisconnected"
+	EventReasonDeviceReattached   = "DeviceReattached"
+)
+
+// PodResolver looks up the object reference of a pod, so events can be attached to it.
+// It is called with dm.mu held, so it must not block, e.g. by querying the API server.
+type PodResolver func(namespace string, name string) (*corev1.ObjectReference, error)
+
+// deviceEvents emits Kubernetes events about devices, against the node and,
+// where known, against the pods holding the device.
+// A nil *deviceEvents silently discards all events.
+type deviceEvents struct {
+	recorder   record.EventRecorder
+	node       *corev1.ObjectReference
+	resolvePod PodResolver
+	logger     log.Logger
+}
+
+func newDeviceEvents(recorder record.EventRecorder, nodeName string, resolvePod PodResolver, logger log.Logger) *deviceEvents {
+	return &deviceEvents{
+		recorder: recorder,
+		node: &corev1.ObjectReference{
+			Kind: "Node",
+			Name: nodeName,
+			// the kubelet uses the node name as the UID for events about the node
+			UID: types.UID(nodeName),
+		},
+		resolvePod: resolvePod,
+		logger:     logger,
+	}
+}
+
+func (e *deviceEvents) podReference(pod podRef) *corev1.ObjectReference {
+	if e.resolvePod != nil {
+		ref, err := e.resolvePod(pod.Namespace, pod.Name)
+		if err == nil {
+			return ref
+		}
+		_ = level.Debug(e.logger).Log("msg", "failed to resolve pod for event", "pod", pod, "err", err)
+	}
+	return &corev1.ObjectReference{Kind: "Pod", Namespace: pod.Namespace, Name: pod.Name}
+}
+
+// emit records an event against the node and the given pods.
+func (e *deviceEvents) emit(pods []podRef, eventType string, reason string, messageFmt string, args ...interface{}) {
+	if e == nil {
+		return
+	}
+	message := fmt.Sprintf(messageFmt, args...)
+	e.recorder.Event(e.node, eventType, reason, message)
+	for _, pod := range pods {
+		e.recorder.Event(e.podReference(pod), eventType, reason, message)
+	}
+}
+
+func (e *deviceEvents) normal(pods []podRef, reason string, messageFmt string, args ...interface{}) {
+	e.emit(pods, corev1.EventTypeNormal, reason, messageFmt, args...)
+}
+
+func (e *deviceEvents) warning(pods []podRef, reason string, messageFmt string, args ...interface{}) {
+	e.emit(pods, corev1.EventTypeWarning, reason, messageFmt, args...)
+}
@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+	"k8s.io/client-go/tools/record"
+)
+
+func expectEvents(t *testing.T, recorder *record.FakeRecorder, expected ...string) {
+	t.Helper()
+	for _, prefix := range expected {
+		select {
+		case event := <-recorder.Events:
+			if !strings.HasPrefix(event, prefix) {
+				t.Errorf("expected event starting with %q, got %q", prefix, event)
+			}
+		default:
+			t.Errorf("expected event starting with %q, got none", prefix)
+		}
+	}
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("unexpected event %q", event)
+	default:
+	}
+}
+
+func TestEvents(t *testing.T) {
+	dev := &KnownDevice{
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1234, Product: 0x5678},
+	}
+	dm, _, devId := newTestDeviceManager(t, dev)
+	recorder := record.NewFakeRecorder(10)
+	dm.EnableEvents(recorder, "node", nil)
+
+	t.Run("target", func(t *testing.T) {
+		dm.updateTargetState(dev.Target, errors.New("connection refused"))
+		expectEvents(t, recorder, "Warning TargetUnreachable")
+		// no repeated events while the target stays unreachable
+		dm.updateTargetState(dev.Target, errors.New("connection refused"))
+		expectEvents(t, recorder)
+		dm.updateTargetState(dev.Target, nil)
+		dm.updateTargetState(dev.Target, errors.New("connection refused"))
+		expectEvents(t, recorder, "Warning TargetUnreachable")
+	})
+
+	t.Run("detach", func(t *testing.T) {
+		dm.podResources = &fakePodResources{snapshot: &podResourcesSnapshot{
+			witnesses: map[string]podRef{devId: {Namespace: "default", Name: "pod"}},
+		}}
+		if err := dm.releaseDevices(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		expectEvents(t, recorder)
+
+		dm.podResources = &fakePodResources{snapshot: &podResourcesSnapshot{witnesses: map[string]podRef{}}}
+		if err := dm.releaseDevices(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		dm.attachedDevices[devId].releasedSince = time.Now().Add(-defaultReleaseGracePeriod)
+		if err := dm.releaseDevices(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		// one event for the node, one for the pod that last held the device
+		expectEvents(t, recorder, "Normal DeviceDetached", "Normal DeviceDetached")
+	})
+
+	t.Run("lost", func(t *testing.T) {
+		local := &fakeLocalDriver{devices: map[string]driver.LocalDevice{
+			"1-1": {USBDevice: driver.USBDevice{Vendor: 0x10c4, Product: 0xea60, BusId: "1-1"}},
+		}}
+		dm.EnableLocalDevices(local)
+		localDev := &KnownDevice{Target: usbip.Target{Local: true}, Selector: driver.USBDevice{Vendor: 0x10c4, Product: 0xea60}}
+		if _, err := dm.Register("serial", ResourceOptions{}, []*KnownDevice{localDev}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dm.refreshTarget(context.Background(), localDev.Target); err != nil {
+			t.Fatal(err)
+		}
+		expectEvents(t, recorder)
+		// devices going away while unused are routine, e.g. when shared with other nodes
+		delete(local.devices, "1-1")
+		if _, err := dm.refreshTarget(context.Background(), localDev.Target); err != nil {
+			t.Fatal(err)
+		}
+		expectEvents(t, recorder, "Normal DeviceLost")
+	})
+}
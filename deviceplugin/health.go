@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// refreshStallTimeout is how long a refresh may take before the refresh job is considered stuck.
+const refreshStallTimeout = 2 * time.Minute
+
+// PluginStatus describes the state of the device plugin serving a resource.
+type PluginStatus struct {
+	// Serving is set while the gRPC server of the plugin accepts connections.
+	Serving bool `json:"serving"`
+	// Registered is set once the plugin registered with the kubelet, until its server stops.
+	Registered bool `json:"registered"`
+	// LastListAndWatch is the last time a device list was sent to the kubelet.
+	LastListAndWatch *time.Time `json:"last_list_and_watch,omitempty"`
+	LastError        string     `json:"last_error,omitempty"`
+}
+
+// RefreshStatus describes the state of the device refresh loop.
+type RefreshStatus struct {
+	JobRunning bool `json:"job_running"`
+	// LastTick is the last time the refresh job started a refresh.
+	LastTick *time.Time `json:"last_tick,omitempty"`
+	// LastSuccess is the last time a refresh reached at least one target.
+	LastSuccess        *time.Time `json:"last_success,omitempty"`
+	UnreachableTargets int        `json:"unreachable_targets"`
+	LastError          string     `json:"last_error,omitempty"`
+}
+
+// VHCIStatus describes whether the VHCI driver could be read during the last refresh.
+type VHCIStatus struct {
+	Available   bool       `json:"available"`
+	LastChecked *time.Time `json:"last_checked,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// HealthReport is the outcome of a readiness or liveness check, along with the state it is based on.
+type HealthReport struct {
+	Healthy  bool                    `json:"healthy"`
+	Problems []string                `json:"problems,omitempty"`
+	Plugins  map[string]PluginStatus `json:"plugins"`
+	Refresh  RefreshStatus           `json:"refresh"`
+	VHCI     VHCIStatus              `json:"vhci"`
+	// LostDevices lists the attached devices that were disconnected. They don't affect the outcome of the checks.
+	LostDevices []string `json:"lost_devices,omitempty"`
+}
+
+// healthState collects the state reported by the health checks. It has its own lock,
+// so probes aren't held up by slow imports or refreshes.
+type healthState struct {
+	mu      sync.Mutex
+	plugins map[string]*PluginStatus
+	refresh RefreshStatus
+	vhci    VHCIStatus
+	lost    []string
+}
+
+func newHealthState() *healthState {
+	return &healthState{plugins: make(map[string]*PluginStatus)}
+}
+
+// pluginHealth reports the state of a single plugin. A nil pluginHealth ignores all updates.
+type pluginHealth struct {
+	state    *healthState
+	resource string
+}
+
+func (h *healthState) plugin(resource string) *pluginHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.plugins[resource]; !ok {
+		h.plugins[resource] = &PluginStatus{}
+	}
+	return &pluginHealth{state: h, resource: resource}
+}
+
+func (ph *pluginHealth) update(f func(status *PluginStatus)) {
+	if ph == nil {
+		return
+	}
+	ph.state.mu.Lock()
+	defer ph.state.mu.Unlock()
+	f(ph.state.plugins[ph.resource])
+}
+
+func (ph *pluginHealth) setServing(serving bool) {
+	ph.update(func(status *PluginStatus) {
+		status.Serving = serving
+		if !serving {
+			status.Registered = false
+		}
+	})
+}
+
+func (ph *pluginHealth) setRegistered(err error) {
+	ph.update(func(status *PluginStatus) {
+		status.Registered = err == nil
+		if err != nil {
+			status.LastError = err.Error()
+		} else {
+			status.LastError = ""
+		}
+	})
+}
+
+func (ph *pluginHealth) listAndWatchSent() {
+	now := time.Now()
+	ph.update(func(status *PluginStatus) {
+		status.LastListAndWatch = &now
+	})
+}
+
+func (h *healthState) refreshJobRunning(running bool) {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.refresh.JobRunning = running
+	if running {
+		// the first tick is only due after deviceCheckInterval
+		h.refresh.LastTick = &now
+	}
+}
+
+func (h *healthState) refreshTick() {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.refresh.LastTick = &now
+}
+
+// refreshed records the outcome of a refresh of the given number of targets.
+func (h *healthState) refreshed(targets int, unreachable int, err error) {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.refresh.UnreachableTargets = unreachable
+	if err != nil {
+		h.refresh.LastError = err.Error()
+	} else {
+		h.refresh.LastError = ""
+	}
+	if targets == 0 || unreachable < targets {
+		h.refresh.LastSuccess = &now
+	}
+}
+
+func (h *healthState) vhciChecked(err error) {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.vhci = VHCIStatus{Available: err == nil, LastChecked: &now}
+	if err != nil {
+		h.vhci.Error = err.Error()
+	}
+}
+
+func (h *healthState) setLostDevices(devIds []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lost = devIds
+}
+
+func (h *healthState) report() HealthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	plugins := make(map[string]PluginStatus, len(h.plugins))
+	for resource, status := range h.plugins {
+		plugins[resource] = *status
+	}
+	return HealthReport{Plugins: plugins, Refresh: h.refresh, VHCI: h.vhci, LostDevices: h.lost}
+}
+
+func (r *HealthReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// Readiness reports whether the plugin can serve allocations: all plugins are registered with the kubelet,
+// devices were refreshed successfully at least once, and the VHCI driver is available.
+func (dm *DeviceManager) Readiness() HealthReport {
+	report := dm.health.report()
+	resources := make([]string, 0, len(report.Plugins))
+	for resource := range report.Plugins {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+	for _, resource := range resources {
+		status := report.Plugins[resource]
+		if !status.Serving {
+			report.problem("plugin for %s is not serving", resource)
+		} else if !status.Registered {
+			report.problem("plugin for %s is not registered with the kubelet", resource)
+		}
+	}
+	if report.Refresh.LastSuccess == nil {
+		report.problem("devices have not been refreshed successfully yet")
+	}
+	if !report.VHCI.Available {
+		report.problem("VHCI driver is not available")
+	}
+	report.Healthy = len(report.Problems) == 0
+	return report
+}
+
+// Liveness reports whether the refresh job is still making progress. It is always healthy
+// until the refresh job starts.
+func (dm *DeviceManager) Liveness() HealthReport {
+	report := dm.health.report()
+	if report.Refresh.JobRunning && report.Refresh.LastTick != nil {
+		if stalled := time.Since(*report.Refresh.LastTick); stalled > deviceCheckInterval+refreshStallTimeout {
+			report.problem("refresh job has not ticked for %s", stalled.Round(time.Second))
+		}
+	}
+	report.Healthy = len(report.Problems) == 0
+	return report
+}
@@ -0,0 +1,96 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+)
+
+func TestReadiness(t *testing.T) {
+	dm := NewDeviceManager("", nil, &fakeVHCIDriver{}, unreachableDialer{})
+	if report := dm.Readiness(); report.Healthy || len(report.Problems) != 2 {
+		t.Fatalf("should not be ready before the first refresh, got %+v", report)
+	}
+	if _, err := dm.refreshDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if report := dm.Readiness(); !report.Healthy {
+		t.Fatalf("should be ready after refresh, got %+v", report)
+	}
+
+	ph := dm.health.plugin("usbip.example.com/device")
+	if report := dm.Readiness(); report.Healthy {
+		t.Errorf("should not be ready while a plugin isn't serving")
+	}
+	ph.setServing(true)
+	ph.setRegistered(errors.New("kubelet unavailable"))
+	report := dm.Readiness()
+	if report.Healthy || report.Plugins["usbip.example.com/device"].LastError != "kubelet unavailable" {
+		t.Errorf("should not be ready while a plugin isn't registered, got %+v", report)
+	}
+	ph.setRegistered(nil)
+	ph.listAndWatchSent()
+	report = dm.Readiness()
+	if !report.Healthy || report.Plugins["usbip.example.com/device"].LastListAndWatch == nil {
+		t.Errorf("should be ready once all plugins are registered, got %+v", report)
+	}
+	ph.setServing(false)
+	if report := dm.Readiness(); report.Healthy || report.Plugins["usbip.example.com/device"].Registered {
+		t.Errorf("stopped plugin should no longer count as registered, got %+v", report)
+	}
+	ph.setServing(true)
+	ph.setRegistered(nil)
+
+	// an unreachable target doesn't undo the earlier successful refresh
+	_, err := dm.Register("device", ResourceOptions{}, []*KnownDevice{
+		{Target: usbip.Target{Host: "usbip.example.com", Port: 3240}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dm.refreshDevices(context.Background()); err == nil {
+		t.Fatalf("expected refresh to fail")
+	}
+	report = dm.Readiness()
+	if !report.Healthy || report.Refresh.UnreachableTargets != 1 || report.Refresh.LastError == "" {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	dm = NewDeviceManager("", nil, &fakeVHCIDriver{}, unreachableDialer{})
+	if _, err := dm.Register("device", ResourceOptions{}, []*KnownDevice{
+		{Target: usbip.Target{Host: "usbip.example.com", Port: 3240}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dm.refreshDevices(context.Background()); err == nil {
+		t.Fatalf("expected refresh to fail")
+	}
+	if report := dm.Readiness(); report.Healthy {
+		t.Errorf("should not be ready if no target was ever reached")
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	dm := NewDeviceManager("", nil, &fakeVHCIDriver{}, nil)
+	if report := dm.Liveness(); !report.Healthy {
+		t.Errorf("should be live before the refresh job starts, got %+v", report)
+	}
+	dm.health.refreshJobRunning(true)
+	if report := dm.Liveness(); !report.Healthy {
+		t.Errorf("should be live right after the refresh job starts, got %+v", report)
+	}
+	stale := time.Now().Add(-deviceCheckInterval - refreshStallTimeout - time.Second)
+	dm.health.refresh.LastTick = &stale
+	if report := dm.Liveness(); report.Healthy || len(report.Problems) != 1 {
+		t.Errorf("stalled refresh job should be reported, got %+v", report)
+	}
+	dm.health.refreshTick()
+	if report := dm.Liveness(); !report.Healthy {
+		t.Errorf("should be live after a tick, got %+v", report)
+	}
+}
@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+)
+
+const (
+	defaultHookTimeout = 10 * time.Second
+)
+
+// HTTPHook describes an HTTP request to make.
+type HTTPHook struct {
+	// URL is the URL to send the request to.
+	URL string `json:"url"`
+	// Method is the HTTP method to use, POST by default.
+	Method string `json:"method"`
+	// Headers are additional headers to include in the request.
+	Headers map[string]string `json:"headers"`
+}
+
+// PreDetachHook is run before a released device is detached, e.g. to reset the device
+// before it goes back to the pool. Either Exec or HTTP must be set.
+type PreDetachHook struct {
+	// Exec is a command (and its arguments) to execute in the plugin's container.
+	// The device is described through USBIP_DEVICE_* environment variables.
+	Exec []string `json:"exec"`
+	// HTTP is a request to make. The device is described in a JSON request body.
+	HTTP *HTTPHook `json:"http"`
+	// Timeout bounds the execution time of the hook. Defaults to 10 seconds.
+	Timeout time.Duration `json:"timeout"`
+}
+
+// hookPayload describes a device to a hook. Unlike the metadata passed to containers,
+// all paths refer to the host.
+type hookPayload struct {
+	ID                string   `json:"id"`
+	Name              string   `json:"name"`
+	Resource          string   `json:"resource"`
+	Path              string   `json:"path"`
+	InterfaceDevNodes []string `json:"interface_dev_nodes,omitempty"`
+	Port              int      `json:"port"`
+	Vendor            string   `json:"vendor"`
+	Product           string   `json:"product"`
+	BusId             string   `json:"bus_id"`
+	Target            string   `json:"target"`
+}
+
+func newHookPayload(kd *KnownDevice, att *attachment) hookPayload {
+	return hookPayload{
+		ID:                kd.id,
+		Name:              kd.Name,
+		Resource:          kd.resource,
+		Path:              att.DevMountPath,
+		InterfaceDevNodes: att.InterfaceDevNodes,
+		Port:              int(att.Port),
+		Vendor:            att.Vendor.String(),
+		Product:           att.Product.String(),
+		BusId:             att.BusId,
+		Target:            describeTarget(kd.Target),
+	}
+}
+
+func (p *hookPayload) env() []string {
+	return []string{
+		"USBIP_DEVICE_ID=" + p.ID,
+		"USBIP_DEVICE_NAME=" + p.Name,
+		"USBIP_DEVICE_RESOURCE=" + p.Resource,
+		"USBIP_DEVICE_PATH=" + p.Path,
+		"USBIP_DEVICE_INTERFACE_NODES=" + strings.Join(p.InterfaceDevNodes, ":"),
+		"USBIP_DEVICE_PORT=" + strconv.Itoa(p.Port),
+		"USBIP_DEVICE_VENDOR=" + p.Vendor,
+		"USBIP_DEVICE_PRODUCT=" + p.Product,
+		"USBIP_DEVICE_BUSID=" + p.BusId,
+		"USBIP_DEVICE_TARGET=" + p.Target,
+	}
+}
+
+// Validate checks that the hook is well-formed.
+func (h *PreDetachHook) Validate() error {
+	if (len(h.Exec) == 0) == (h.HTTP == nil) {
+		return errors.New("exactly one of exec and http must be set")
+	}
+	if h.HTTP != nil && h.HTTP.URL == "" {
+		return errors.New("http hook requires a URL")
+	}
+	if h.Timeout < 0 {
+		return errors.New("hook timeout must not be negative")
+	}
+	return nil
+}
+
+// run executes the hook for the device described by the given payload.
+func (h *PreDetachHook) run(ctx context.Context, payload hookPayload) error {
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if len(h.Exec) > 0 {
+		cmd := exec.CommandContext(ctx, h.Exec[0], h.Exec[1:]...)
+		cmd.Env = append(os.Environ(), payload.env()...)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return errors.Wrapf(err, "pre-detach command failed: %s", strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	method := h.HTTP.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, h.HTTP.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create pre-detach request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.HTTP.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "pre-detach request failed")
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Newf("pre-detach request returned status %d", resp.StatusCode)
+	}
+	return nil
+}
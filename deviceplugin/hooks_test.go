@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestPreDetachHooks(t *testing.T) {
+	kd := &KnownDevice{
+		Name:     "key",
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		id:       "device_abc",
+		resource: "device",
+	}
+	att := newAttachment(&usbip.AttachedDevice{
+		USBDevice:    driver.USBDevice{Vendor: 0x1050, Product: 0x407, BusId: "1-1"},
+		Port:         3,
+		DevMountPath: "/dev/bus/usb/002/033",
+	})
+	payload := newHookPayload(kd, att)
+
+	t.Run("exec", func(t *testing.T) {
+		hook := &PreDetachHook{Exec: []string{
+			"/bin/sh", "-c", `test "$USBIP_DEVICE_PORT" = 3 && test "$USBIP_DEVICE_PATH" = /dev/bus/usb/002/033`,
+		}}
+		if err := hook.run(context.Background(), payload); err != nil {
+			t.Error(err)
+		}
+		hook = &PreDetachHook{Exec: []string{"/bin/sh", "-c", "exit 1"}}
+		if err := hook.run(context.Background(), payload); err == nil {
+			t.Error("expected failing command to be reported")
+		}
+	})
+
+	t.Run("http", func(t *testing.T) {
+		var received hookPayload
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.Header.Get("X-Token") != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}))
+		defer srv.Close()
+
+		hook := &PreDetachHook{HTTP: &HTTPHook{URL: srv.URL, Headers: map[string]string{"X-Token": "secret"}}}
+		if err := hook.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := hook.run(context.Background(), payload); err != nil {
+			t.Fatal(err)
+		}
+		if received.ID != "device_abc" || received.Vendor != "1050" || received.Target != "usbip.example.com:3240" {
+			t.Errorf("unexpected payload %+v", received)
+		}
+
+		hook = &PreDetachHook{HTTP: &HTTPHook{URL: srv.URL}}
+		if err := hook.run(context.Background(), payload); err == nil {
+			t.Error("expected error status to be reported")
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		if err := (&PreDetachHook{}).Validate(); err == nil {
+			t.Error("hook without action should be rejected")
+		}
+		hook := &PreDetachHook{Exec: []string{"true"}, HTTP: &HTTPHook{URL: "http://localhost"}}
+		if err := hook.Validate(); err == nil {
+			t.Error("hook with multiple actions should be rejected")
+		}
+	})
+}
+
+func TestPreDetachHookDoesNotBlockAllocate(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-unblock
+	}))
+	defer srv.Close()
+
+	dev := &KnownDevice{
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1234, Product: 0x5678},
+	}
+	dm, vhci, devId := newTestDeviceManager(t, dev)
+	dm.resourceOptions["device"] = ResourceOptions{PreDetachHook: &PreDetachHook{HTTP: &HTTPHook{URL: srv.URL}}}
+	dm.podResources = &fakePodResources{snapshot: &podResourcesSnapshot{witnesses: map[string]podRef{}}}
+	dm.attachedDevices[devId].releasedSince = time.Now().Add(-defaultReleaseGracePeriod)
+
+	released := make(chan error, 1)
+	go func() { released <- dm.releaseDevices(context.Background()) }()
+	<-started
+
+	allocated := make(chan error, 1)
+	go func() {
+		_, err := newTestPlugin(dm).Allocate(context.Background(), &v1beta1.AllocateRequest{
+			ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIds: []string{devId}}},
+		})
+		allocated <- err
+	}()
+	select {
+	case err := <-allocated:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		close(unblock)
+		t.Fatal("allocation blocked on the pre-detach hook")
+	}
+
+	close(unblock)
+	if err := <-released; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dm.attachedDevices[devId]; !ok {
+		t.Errorf("device allocated during the hook should stay attached")
+	}
+	if vhci.slots[0].IsEmpty() {
+		t.Errorf("port should not have been freed")
+	}
+}
@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	deviceLinkName = "device"
+)
+
+// deviceLinks maintains stable symlinks to the device nodes of attached devices. Containers get the links
+// instead of the device nodes themselves, so a restarted container picks up the node of a device that was
+// re-attached in the meantime, even though the kubelet hands out the DeviceSpecs it cached at allocation time.
+type deviceLinks struct {
+	dir string
+}
+
+// EnableDeviceLinks makes the device manager expose the device nodes of resources that re-attach lost devices
+// through symlinks in dir, instead of directly. The directory must be visible at the same path on the host.
+// Links aren't needed when CDI is enabled, since CDI specs are rewritten when a device is re-attached.
+func (dm *DeviceManager) EnableDeviceLinks(dir string) {
+	dm.links = &deviceLinks{dir: dir}
+}
+
+func (l *deviceLinks) deviceDir(devId string) string {
+	return filepath.Join(l.dir, devId)
+}
+
+func interfaceLinkName(index int) string {
+	return fmt.Sprintf("interface-%d", index)
+}
+
+// linksFor returns the symlinks to create for the given device, keyed by the node they point to.
+func (l *deviceLinks) linksFor(devId string, dev *usbip.AttachedDevice) map[string]string {
+	result := make(map[string]string, 1+len(dev.InterfaceDevNodes))
+	result[dev.DevMountPath] = filepath.Join(l.deviceDir(devId), deviceLinkName)
+	for i, node := range dev.InterfaceDevNodes {
+		result[node] = filepath.Join(l.deviceDir(devId), interfaceLinkName(i))
+	}
+	return result
+}
+
+// update points the links of the given device to its current device nodes.
+// Links are replaced atomically, so containers never see a missing link.
+func (l *deviceLinks) update(devId string, dev *usbip.AttachedDevice) error {
+	if err := os.MkdirAll(l.deviceDir(devId), 0o755); err != nil {
+		return errors.Wrap(err, "failed to create device link directory")
+	}
+	for node, link := range l.linksFor(devId, dev) {
+		tmp := link + ".tmp"
+		_ = os.Remove(tmp)
+		if err := os.Symlink(node, tmp); err != nil {
+			return errors.Wrapf(err, "failed to link %s", node)
+		}
+		if err := os.Rename(tmp, link); err != nil {
+			return errors.Wrapf(err, "failed to link %s", node)
+		}
+	}
+	return nil
+}
+
+func (l *deviceLinks) remove(devId string) error {
+	return os.RemoveAll(l.deviceDir(devId))
+}
+
+// substitute makes the given DeviceSpecs refer to the links of the device instead of its device nodes.
+// Extra devices are left alone.
+func (l *deviceLinks) substitute(devId string, dev *usbip.AttachedDevice, specs []*v1beta1.DeviceSpec) []*v1beta1.DeviceSpec {
+	links := l.linksFor(devId, dev)
+	result := make([]*v1beta1.DeviceSpec, 0, len(specs))
+	for _, spec := range specs {
+		if link, ok := links[spec.HostPath]; ok {
+			spec = &v1beta1.DeviceSpec{
+				ContainerPath: spec.ContainerPath,
+				HostPath:      link,
+				Permissions:   spec.Permissions,
+			}
+		}
+		result = append(result, spec)
+	}
+	return result
+}
+
+// usesLinks reports whether the device nodes of the given device are exposed through links.
+func (dm *DeviceManager) usesLinks(devId string) bool {
+	if dm.links == nil || dm.cdi != nil {
+		return false
+	}
+	kd, ok := dm.knownDevices[devId]
+	return ok && dm.resourceOptions[kd.resource].ReattachLost
+}
@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestDeviceLinks(t *testing.T) {
+	links := &deviceLinks{dir: t.TempDir()}
+	dev := &usbip.AttachedDevice{DevMountPath: "/dev/bus/usb/002/033", InterfaceDevNodes: []string{"/dev/ttyACM0"}}
+	if err := links.update("device_0", dev); err != nil {
+		t.Fatal(err)
+	}
+	deviceLink := filepath.Join(links.dir, "device_0", "device")
+	if dest, err := os.Readlink(deviceLink); err != nil || dest != "/dev/bus/usb/002/033" {
+		t.Errorf("unexpected device link %q (%v)", dest, err)
+	}
+
+	// after a re-attach, the same links point to the new nodes
+	dev = &usbip.AttachedDevice{DevMountPath: "/dev/bus/usb/002/034", InterfaceDevNodes: []string{"/dev/ttyACM1"}}
+	if err := links.update("device_0", dev); err != nil {
+		t.Fatal(err)
+	}
+	if dest, err := os.Readlink(deviceLink); err != nil || dest != "/dev/bus/usb/002/034" {
+		t.Errorf("unexpected device link %q (%v)", dest, err)
+	}
+	interfaceLink := filepath.Join(links.dir, "device_0", "interface-0")
+	if dest, err := os.Readlink(interfaceLink); err != nil || dest != "/dev/ttyACM1" {
+		t.Errorf("unexpected interface link %q (%v)", dest, err)
+	}
+
+	extra := &v1beta1.DeviceSpec{HostPath: "/dev/null", ContainerPath: "/dev/null"}
+	specs := links.substitute("device_0", dev, []*v1beta1.DeviceSpec{
+		{HostPath: "/dev/bus/usb/002/034", ContainerPath: "/dev/zigbee"},
+		{HostPath: "/dev/ttyACM1", ContainerPath: "/dev/ttyACM1"},
+		extra,
+	})
+	if specs[0].HostPath != deviceLink || specs[0].ContainerPath != "/dev/zigbee" {
+		t.Errorf("unexpected device spec %+v", specs[0])
+	}
+	if specs[1].HostPath != interfaceLink {
+		t.Errorf("unexpected interface spec %+v", specs[1])
+	}
+	if specs[2] != extra {
+		t.Errorf("extra devices should be left alone")
+	}
+
+	if err := links.remove("device_0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(deviceLink); !os.IsNotExist(err) {
+		t.Errorf("links should have been removed")
+	}
+}
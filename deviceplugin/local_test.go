@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+)
+
+type fakeLocalDriver struct {
+	devices map[string]driver.LocalDevice
+	nodes   map[string][]string
+}
+
+func (f *fakeLocalDriver) ListDevices() ([]driver.LocalDevice, error) {
+	result := make([]driver.LocalDevice, 0, len(f.devices))
+	for _, dev := range f.devices {
+		result = append(result, dev)
+	}
+	return result, nil
+}
+
+func (f *fakeLocalDriver) Describe(busId string) (*driver.LocalDevice, error) {
+	dev, ok := f.devices[busId]
+	if !ok {
+		return nil, errors.Newf("device %s not found", busId)
+	}
+	return &dev, nil
+}
+
+func (f *fakeLocalDriver) InterfaceDevNodes(busId string) ([]string, error) {
+	return f.nodes[busId], nil
+}
+
+func TestLocalDevices(t *testing.T) {
+	// stand-in for the device node, which must exist before the device is handed out
+	devNode := filepath.Join(t.TempDir(), "004")
+	if err := os.WriteFile(devNode, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	local := &fakeLocalDriver{
+		devices: map[string]driver.LocalDevice{
+			"1-1": {USBDevice: driver.USBDevice{Vendor: 0x10c4, Product: 0xea60, BusId: "1-1"}, DevMountPath: devNode},
+			"1-2": {USBDevice: driver.USBDevice{Vendor: 0x1050, Product: 0x0407, BusId: "1-2"}, DevMountPath: "/dev/bus/usb/001/005"},
+		},
+		nodes: map[string][]string{"1-1": {"/dev/ttyUSB0"}},
+	}
+	vhci := &fakeVHCIDriver{slots: []driver.VHCISlot{{Port: 0, Status: driver.VDevStatusNull}}}
+	dm := NewDeviceManager("", nil, vhci, unreachableDialer{})
+	dm.EnableLocalDevices(local)
+	dm.podResources = &fakePodResources{snapshot: &podResourcesSnapshot{witnesses: map[string]podRef{}}}
+	dev := &KnownDevice{Target: usbip.Target{Local: true}, Selector: driver.USBDevice{Vendor: 0x10c4, Product: 0xea60}}
+	if _, err := dm.Register("serial", ResourceOptions{}, []*KnownDevice{dev}); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := dm.refreshDevices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || !dev.available || dev.readProperties.BusId != "1-1" {
+		t.Fatalf("local device should have been found, got %v (%+v)", changed, dev.readProperties)
+	}
+	if state := dm.TargetStates()[dev.Target]; !state.Reachable {
+		t.Errorf("local target should be reachable")
+	}
+
+	att, err := dm.attachDevice(context.Background(), dev.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if att.DevMountPath != devNode || !reflect.DeepEqual(att.InterfaceDevNodes, []string{"/dev/ttyUSB0"}) {
+		t.Errorf("unexpected attachment %+v", att.AttachedDevice)
+	}
+	att.holders["serial"] = true
+
+	// unplugging the device is noticed without consulting the VHCI ports
+	delete(local.devices, "1-1")
+	dm.reconcileAttached(context.Background())
+	if att.lostSince.IsZero() {
+		t.Errorf("unplugged device should have been flagged as lost")
+	}
+	if err := dm.detachReleased(context.Background(), dev.id, att); err != nil {
+		t.Errorf("releasing a local device should not detach anything: %v", err)
+	}
+	if vhci.slots[0].Status != driver.VDevStatusNull {
+		t.Errorf("VHCI ports should not be touched")
+	}
+
+	dm.EnableLocalDevices(nil)
+	if _, err := dm.refreshTarget(context.Background(), dev.Target); err == nil {
+		t.Errorf("local targets should be unreachable without local device support")
+	}
+}
+
+func TestForceDetachSkipsLocalDevices(t *testing.T) {
+	remote := &KnownDevice{
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1234, Product: 0x5678},
+	}
+	dm, vhci, remoteId := newTestDeviceManager(t, remote)
+	local := &KnownDevice{Target: usbip.Target{Local: true}, Selector: driver.USBDevice{Vendor: 0x10c4, Product: 0xea60}}
+	if _, err := dm.Register("serial", ResourceOptions{}, []*KnownDevice{local}); err != nil {
+		t.Fatal(err)
+	}
+	// local attachments have the zero port, just like the remote device on port 0
+	dm.attachedDevices[local.id] = newAttachment(&usbip.AttachedDevice{
+		USBDevice:    driver.USBDevice{Vendor: 0x10c4, Product: 0xea60, BusId: "1-1"},
+		Target:       local.Target,
+		DevMountPath: "/dev/bus/usb/001/004",
+	})
+
+	for _, info := range dm.Devices() {
+		switch {
+		case info.ID == local.id && info.Attachment.Port != nil:
+			t.Errorf("local device should not report a port, got %d", *info.Attachment.Port)
+		case info.ID == remoteId && (info.Attachment.Port == nil || *info.Attachment.Port != 0):
+			t.Errorf("remote device should report port 0, got %v", info.Attachment.Port)
+		}
+	}
+
+	if err := dm.ForceDetach(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if vhci.slots[0].Status != driver.VDevStatusNull {
+		t.Errorf("the device on port 0 should have been detached")
+	}
+	if _, attached := dm.attachedDevices[remoteId]; attached {
+		t.Errorf("the remote device should have been forgotten")
+	}
+	if _, attached := dm.attachedDevices[local.id]; !attached {
+		t.Errorf("the local device should not be affected by detaching port 0")
+	}
+}
@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	defaultEnvPrefix = "USBIP_DEVICE"
+)
+
+// deviceMetadata describes a device handed to a container, for the container's
+// environment and the annotations passed to the container runtime.
+type deviceMetadata struct {
+	ID      string   `json:"id"`
+	Path    string   `json:"path,omitempty"`
+	Vendor  string   `json:"vendor"`
+	Product string   `json:"product"`
+	BusId   string   `json:"bus_id"`
+	Target  string   `json:"target"`
+	TTYs    []string `json:"ttys,omitempty"`
+}
+
+// newDeviceMetadata collects the metadata of a device. The attached device may be nil
+// if the device is not attached yet, in which case the /dev paths may not be known yet.
+// All paths are as seen from inside the container.
+func newDeviceMetadata(devId string, kd *KnownDevice, attachedDevice *usbip.AttachedDevice) (deviceMetadata, error) {
+	props := kd.readProperties
+	meta := deviceMetadata{
+		ID:     devId,
+		Target: describeTarget(kd.Target),
+	}
+	paths, err := kd.containerPaths(attachedDevice)
+	if err != nil {
+		return meta, err
+	}
+	meta.Path = paths.Device
+	for _, node := range paths.Interfaces {
+		if strings.HasPrefix(path.Base(node.HostPath), "tty") {
+			meta.TTYs = append(meta.TTYs, node.ContainerPath)
+		}
+	}
+	if attachedDevice != nil {
+		props = attachedDevice.USBDevice
+	}
+	meta.Vendor = props.Vendor.String()
+	meta.Product = props.Product.String()
+	meta.BusId = props.BusId
+	return meta, nil
+}
+
+func (meta *deviceMetadata) addEnvs(envs map[string]string, prefix string, index int) {
+	varPrefix := fmt.Sprintf("%s_%d_", prefix, index)
+	envs[varPrefix+"ID"] = meta.ID
+	envs[varPrefix+"VENDOR"] = meta.Vendor
+	envs[varPrefix+"PRODUCT"] = meta.Product
+	envs[varPrefix+"BUSID"] = meta.BusId
+	envs[varPrefix+"TARGET"] = meta.Target
+	if meta.Path != "" {
+		envs[varPrefix+"PATH"] = meta.Path
+	}
+	if len(meta.TTYs) > 0 {
+		envs[varPrefix+"TTY"] = strings.Join(meta.TTYs, ":")
+	}
+}
+
+func (meta *deviceMetadata) addAnnotation(annotations map[string]string, resource string, index int) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	annotations[fmt.Sprintf("%s.%d", resource, index)] = string(value)
+	return nil
+}
+
+// addDeviceMetadata exports the metadata of the devices allocated to a container
+// as environment variables and annotations on the container allocation response.
+func (up *USBIPPlugin) addDeviceMetadata(resp *v1beta1.ContainerAllocateResponse, metadata []deviceMetadata) error {
+	prefix := up.options.EnvPrefix
+	if prefix == "" {
+		prefix = defaultEnvPrefix
+	}
+	resp.Envs = make(map[string]string, 1+6*len(metadata))
+	resp.Annotations = make(map[string]string, len(metadata))
+	resp.Envs[prefix+"_COUNT"] = strconv.Itoa(len(metadata))
+	for i := range metadata {
+		metadata[i].addEnvs(resp.Envs, prefix, i)
+		if err := metadata[i].addAnnotation(resp.Annotations, up.resource, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
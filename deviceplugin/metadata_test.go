@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestDeviceMetadata(t *testing.T) {
+	kd := &KnownDevice{
+		Target:         usbip.Target{Host: "usbip.example.com", Port: 3240},
+		readProperties: driver.USBDevice{Vendor: 0x1050, Product: 0x407, BusId: "1-1"},
+	}
+	attached := &usbip.AttachedDevice{
+		USBDevice:         driver.USBDevice{Vendor: 0x1050, Product: 0x407, BusId: "1-1"},
+		DevMountPath:      "/dev/bus/usb/002/033",
+		InterfaceDevNodes: []string{"/dev/ttyACM0", "/dev/hidraw0", "/dev/ttyACM1"},
+	}
+	up := &USBIPPlugin{resource: "usbip.example.com/some-device", options: ResourceOptions{EnvPrefix: "YUBIKEY"}}
+
+	resp := &v1beta1.ContainerAllocateResponse{}
+	metaA, err := newDeviceMetadata("dev-a", kd, attached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaB, err := newDeviceMetadata("dev-b", kd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = up.addDeviceMetadata(resp, []deviceMetadata{metaA, metaB}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedEnvs := map[string]string{
+		"YUBIKEY_COUNT":     "2",
+		"YUBIKEY_0_ID":      "dev-a",
+		"YUBIKEY_0_PATH":    "/dev/bus/usb/002/033",
+		"YUBIKEY_0_VENDOR":  "1050",
+		"YUBIKEY_0_PRODUCT": "0407",
+		"YUBIKEY_0_BUSID":   "1-1",
+		"YUBIKEY_0_TARGET":  "usbip.example.com:3240",
+		"YUBIKEY_0_TTY":     "/dev/ttyACM0:/dev/ttyACM1",
+		"YUBIKEY_1_ID":      "dev-b",
+		"YUBIKEY_1_VENDOR":  "1050",
+		"YUBIKEY_1_PRODUCT": "0407",
+		"YUBIKEY_1_BUSID":   "1-1",
+		"YUBIKEY_1_TARGET":  "usbip.example.com:3240",
+	}
+	if len(resp.Envs) != len(expectedEnvs) {
+		t.Errorf("got %v; want %v", resp.Envs, expectedEnvs)
+	}
+	for k, v := range expectedEnvs {
+		if resp.Envs[k] != v {
+			t.Errorf("%s: got %q; want %q", k, resp.Envs[k], v)
+		}
+	}
+
+	annotation, ok := resp.Annotations["usbip.example.com/some-device.0"]
+	if !ok {
+		t.Fatalf("annotation missing: %v", resp.Annotations)
+	}
+	meta := deviceMetadata{}
+	if err = json.Unmarshal([]byte(annotation), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.ID != "dev-a" || meta.Target != "usbip.example.com:3240" || meta.Path != "/dev/bus/usb/002/033" {
+		t.Errorf("unexpected annotation %s", annotation)
+	}
+	if _, ok = resp.Annotations["usbip.example.com/some-device.1"]; !ok {
+		t.Errorf("annotation for second device missing: %v", resp.Annotations)
+	}
+}
@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// importFailureDevNodes is used when the /dev nodes of an imported device never appear.
+	importFailureDevNodes usbip.ImportFailureReason = "dev_nodes"
+	// importFailurePrepare is used when an imported device could not be prepared for containers.
+	importFailurePrepare usbip.ImportFailureReason = "prepare"
+)
+
+// durationBuckets cover everything from a quick LAN round trip to the retry loops
+// that wait for devices to show up.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// recoveryBuckets cover the time a device can be gone, from a brief network blip to a target that's down for an hour.
+var recoveryBuckets = []float64{1, 5, 10, 30, 60, 300, 900, 3600}
+
+// deviceMetrics holds the metrics maintained by the device manager. They're always
+// recorded, but only exposed once registered through EnableMetrics.
+type deviceMetrics struct {
+	importDuration  *prometheus.HistogramVec
+	devNodeWait     *prometheus.HistogramVec
+	detachDuration  *prometheus.HistogramVec
+	refreshDuration *prometheus.HistogramVec
+	importFailures  *prometheus.CounterVec
+	disconnects     *prometheus.CounterVec
+	reattaches      *prometheus.CounterVec
+	recoveryTime    *prometheus.HistogramVec
+}
+
+func newDeviceMetrics() *deviceMetrics {
+	return &deviceMetrics{
+		importDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "usbip_device_plugin_import_duration_seconds",
+			Help:    "The time taken to import a device from a USB/IP target, including failed imports.",
+			Buckets: durationBuckets,
+		}, []string{"target"}),
+		devNodeWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "usbip_device_plugin_dev_node_wait_duration_seconds",
+			Help:    "The time spent waiting for the /dev nodes of an imported device to appear.",
+			Buckets: durationBuckets,
+		}, []string{"target"}),
+		detachDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "usbip_device_plugin_detach_duration_seconds",
+			Help:    "The time taken to detach a device.",
+			Buckets: durationBuckets,
+		}, []string{"target"}),
+		refreshDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "usbip_device_plugin_refresh_duration_seconds",
+			Help:    "The time taken to list the devices exported by a USB/IP target.",
+			Buckets: durationBuckets,
+		}, []string{"target"}),
+		importFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "usbip_device_plugin_import_failures_total",
+			Help: "The number of failed device imports, by reason.",
+		}, []string{"target", "reason"}),
+		disconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "usbip_device_plugin_disconnects_total",
+			Help: "The number of attached devices that were found disconnected from their VHCI port.",
+		}, []string{"target"}),
+		reattaches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "usbip_device_plugin_reattaches_total",
+			Help: "The number of attempts to re-attach disconnected devices, by result.",
+		}, []string{"target", "result"}),
+		recoveryTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "usbip_device_plugin_recovery_duration_seconds",
+			Help:    "The time between the disconnection of a device and its successful re-attachment.",
+			Buckets: recoveryBuckets,
+		}, []string{"target"}),
+	}
+}
+
+func (m *deviceMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.importDuration, m.devNodeWait, m.detachDuration, m.refreshDuration,
+		m.importFailures, m.disconnects, m.reattaches, m.recoveryTime,
+	}
+}
+
+// observeSince records the time elapsed since start in the given histogram.
+func observeSince(histogram *prometheus.HistogramVec, target usbip.Target, start time.Time) {
+	histogram.WithLabelValues(describeTarget(target)).Observe(time.Since(start).Seconds())
+}
+
+func (m *deviceMetrics) importFailed(target usbip.Target, reason usbip.ImportFailureReason) {
+	m.importFailures.WithLabelValues(describeTarget(target), string(reason)).Inc()
+}
+
+var deviceInfoDesc = prometheus.NewDesc(
+	"usbip_device_plugin_device_info",
+	"Information about the devices attached to a node. Always 1.",
+	[]string{"resource", "device", "id", "vendor", "product", "target", "node", "port"},
+	nil,
+)
+
+// deviceInfoCollector exposes an info metric for each attached device, so the node
+// holding a device can be looked up.
+type deviceInfoCollector struct {
+	dm       *DeviceManager
+	nodeName string
+}
+
+func (c *deviceInfoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- deviceInfoDesc
+}
+
+func (c *deviceInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	c.dm.mu.Lock()
+	defer c.dm.mu.Unlock()
+	for devId, att := range c.dm.attachedDevices {
+		kd, ok := c.dm.knownDevices[devId]
+		if !ok {
+			continue
+		}
+		// local devices aren't attached to a VHCI port
+		port := ""
+		if !att.Target.Local {
+			port = strconv.Itoa(int(att.Port))
+		}
+		ch <- prometheus.MustNewConstMetric(
+			deviceInfoDesc, prometheus.GaugeValue, 1,
+			kd.resource, kd.Name, devId, att.Vendor.String(), att.Product.String(),
+			describeTarget(att.Target), c.nodeName, port,
+		)
+	}
+}
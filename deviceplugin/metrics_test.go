@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type unreachableDialer struct{}
+
+func (unreachableDialer) Dial(_ usbip.Target) (usbip.Client, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestImportFailureMetrics(t *testing.T) {
+	dev := &KnownDevice{
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1234, Product: 0x5678},
+	}
+	dm := NewDeviceManager("", nil, &fakeVHCIDriver{}, unreachableDialer{})
+	ids, err := dm.Register("device", ResourceOptions{}, []*KnownDevice{dev})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dm.attachDevice(context.Background(), ids[0]); err == nil {
+		t.Fatalf("expected import to fail")
+	}
+	if failures := testutil.ToFloat64(dm.metrics.importFailures.WithLabelValues("usbip.example.com:3240", "connect")); failures != 1 {
+		t.Errorf("expected 1 import failure, got %v", failures)
+	}
+	if count := testutil.CollectAndCount(dm.metrics.importDuration); count != 1 {
+		t.Errorf("expected import duration to be observed for 1 target, got %d", count)
+	}
+}
+
+func TestDeviceInfoMetric(t *testing.T) {
+	dev := &KnownDevice{
+		Name:     "scanner",
+		StableID: "scanner",
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1234, Product: 0x5678},
+	}
+	dm, _, _ := newTestDeviceManager(t, dev)
+	reg := prometheus.NewPedanticRegistry()
+	dm.EnableMetrics(reg, "node-1")
+
+	expected := `
+# HELP usbip_device_plugin_device_info Information about the devices attached to a node. Always 1.
+# TYPE usbip_device_plugin_device_info gauge
+usbip_device_plugin_device_info{device="scanner",id="device_scanner",node="node-1",port="0",product="5678",resource="device",target="usbip.example.com:3240",vendor="1234"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "usbip_device_plugin_device_info"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,176 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	nodeStatusTimeout = 5 * time.Second
+
+	targetReachable   = "reachable"
+	targetUnreachable = "unreachable"
+)
+
+// targetStatus is the extended status of a target, published as a node annotation.
+type targetStatus struct {
+	Host      string    `json:"host"`
+	Port      int       `json:"port"`
+	Local     bool      `json:"local,omitempty"`
+	Reachable bool      `json:"reachable"`
+	Since     time.Time `json:"since"`
+}
+
+// nodeStatusPublisher maintains labels and annotations describing the reachability
+// of USB/IP targets on the node object.
+// A nil *nodeStatusPublisher doesn't publish anything.
+type nodeStatusPublisher struct {
+	client   kubernetes.Interface
+	nodeName string
+	domain   string
+	logger   log.Logger
+	// publishedLabels and publishedAnnotations hold the labels and annotations
+	// that were last applied successfully, or nil if they haven't been read from the node yet
+	publishedLabels      map[string]string
+	publishedAnnotations map[string]string
+}
+
+func newNodeStatusPublisher(client kubernetes.Interface, nodeName string, domain string, logger log.Logger) *nodeStatusPublisher {
+	return &nodeStatusPublisher{
+		client:   client,
+		nodeName: nodeName,
+		domain:   domain,
+		logger:   logger,
+	}
+}
+
+// targetKey returns the label key for the given target, e.g. usbip.dev.mvalvekens.be/target.0123456789.
+// Host names can't be used in label keys directly, so the key is based on a hash of the target.
+func (p *nodeStatusPublisher) targetKey(target usbip.Target) string {
+	hash := sha256.Sum256([]byte(describeTarget(target)))
+	return p.domain + "/target." + hex.EncodeToString(hash[:5])
+}
+
+// desired computes the labels and annotations describing the given target states.
+func (p *nodeStatusPublisher) desired(states map[usbip.Target]TargetState) (map[string]string, map[string]string, error) {
+	labels := make(map[string]string, len(states))
+	annotations := make(map[string]string, len(states))
+	for target, state := range states {
+		key := p.targetKey(target)
+		labels[key] = targetUnreachable
+		if state.Reachable {
+			labels[key] = targetReachable
+		}
+		status, err := json.Marshal(targetStatus{
+			Host:      target.Host,
+			Port:      target.Port,
+			Local:     target.Local,
+			Reachable: state.Reachable,
+			Since:     state.Since.UTC().Truncate(time.Second),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		annotations[key] = string(status)
+	}
+	return labels, annotations, nil
+}
+
+// patchFor computes a merge patch that brings our own labels (or annotations) from
+// the published state to the desired state, leaving all other keys alone.
+func patchFor(published map[string]string, desired map[string]string) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for key, value := range desired {
+		if current, ok := published[key]; !ok || current != value {
+			patch[key] = value
+		}
+	}
+	for key := range published {
+		if _, ok := desired[key]; !ok {
+			// null removes the key
+			patch[key] = nil
+		}
+	}
+	return patch
+}
+
+// publish updates the node object to reflect the given target states, if anything changed.
+func (p *nodeStatusPublisher) publish(states map[usbip.Target]TargetState) {
+	if p == nil {
+		return
+	}
+	if err := p.apply(states); err != nil {
+		_ = level.Warn(p.logger).Log("msg", "failed to publish target status on node", "node", p.nodeName, "err", err)
+	}
+}
+
+// ownKeys returns the entries in the given labels (or annotations) that were set by the plugin.
+func (p *nodeStatusPublisher) ownKeys(values map[string]string) map[string]string {
+	prefix := p.domain + "/target."
+	result := make(map[string]string)
+	for key, value := range values {
+		if strings.HasPrefix(key, prefix) {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+func (p *nodeStatusPublisher) apply(states map[usbip.Target]TargetState) error {
+	labels, annotations, err := p.desired(states)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), nodeStatusTimeout)
+	defer cancel()
+	if p.publishedLabels == nil {
+		// pick up the state published by a previous instance, so labels for targets
+		// that are no longer configured get cleaned up
+		node, err := p.client.CoreV1().Nodes().Get(ctx, p.nodeName, metav1.GetOptions{})
+		if err != nil {
+			return errors.Wrap(err, "failed to get node")
+		}
+		p.publishedLabels = p.ownKeys(node.Labels)
+		p.publishedAnnotations = p.ownKeys(node.Annotations)
+	}
+	labelPatch := patchFor(p.publishedLabels, labels)
+	annotationPatch := patchFor(p.publishedAnnotations, annotations)
+	if len(labelPatch) == 0 && len(annotationPatch) == 0 {
+		return nil
+	}
+
+	// A merge patch only touches the keys it mentions, so it doesn't conflict with
+	// concurrent updates to other labels and annotations on the node.
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      labelPatch,
+			"annotations": annotationPatch,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = p.client.CoreV1().Nodes().Patch(ctx, p.nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return errors.Wrap(err, "failed to patch node")
+	}
+
+	p.publishedLabels = labels
+	p.publishedAnnotations = annotations
+	_ = level.Debug(p.logger).Log("msg", "published target status on node", "node", p.nodeName, "patch", string(patch))
+	return nil
+}
@@ -0,0 +1,69 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/go-kit/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNodeStatus(t *testing.T) {
+	client := fake.NewClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name: "node",
+		Labels: map[string]string{
+			"kubernetes.io/hostname":              "node",
+			"usbip.example.com/target.0000000000": "reachable",
+		},
+	}})
+	publisher := newNodeStatusPublisher(client, "node", "usbip.example.com", log.NewNopLogger())
+	up := usbip.Target{Host: "usbip.example.com", Port: 3240}
+	down := usbip.Target{Host: "10.0.0.1", Port: 3240}
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if err := publisher.apply(map[usbip.Target]TargetState{
+		up:   {Reachable: true, Since: since},
+		down: {Reachable: false, Since: since},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Labels["kubernetes.io/hostname"] != "node" {
+		t.Errorf("unrelated labels should be preserved")
+	}
+	if _, ok := node.Labels["usbip.example.com/target.0000000000"]; ok {
+		t.Errorf("stale target label should have been removed")
+	}
+	if node.Labels[publisher.targetKey(up)] != "reachable" || node.Labels[publisher.targetKey(down)] != "unreachable" {
+		t.Errorf("unexpected labels %v", node.Labels)
+	}
+	var status targetStatus
+	if err := json.Unmarshal([]byte(node.Annotations[publisher.targetKey(down)]), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Host != "10.0.0.1" || status.Reachable || !status.Since.Equal(since) {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// nothing changed, so the node shouldn't be patched again
+	actions := len(client.Actions())
+	if err := publisher.apply(map[usbip.Target]TargetState{
+		up:   {Reachable: true, Since: since},
+		down: {Reachable: false, Since: since},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.Actions()) != actions {
+		t.Errorf("unexpected requests %v", client.Actions()[actions:])
+	}
+}
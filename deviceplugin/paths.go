@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+)
+
+// pathTemplateData is the data available to container path templates.
+type pathTemplateData struct {
+	// Name is the name of the device in the configuration.
+	Name string
+	// Resource is the resource name the device is exposed under (without the domain).
+	Resource string
+	// ID is the device ID as known to the kubelet.
+	ID string
+	// Vendor and Product are the USB vendor and product ID, as 4-digit hex strings.
+	Vendor  string
+	Product string
+	// BusId is the bus ID of the device on the USB/IP host.
+	BusId string
+	// Node is the base name of the host device node, e.g. ttyACM0 (interface nodes only).
+	Node string
+	// Index is the index of the interface node among the device's interface nodes (interface nodes only).
+	Index int
+}
+
+// nodeMapping maps a host device node to a path in the container.
+type nodeMapping struct {
+	HostPath      string
+	ContainerPath string
+}
+
+// containerPaths describes where the nodes of a device end up inside a container.
+type containerPaths struct {
+	// Device is the container path of the USB device node, empty if not known yet.
+	Device     string
+	Interfaces []nodeMapping
+}
+
+func parsePathTemplate(name string, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s template %q", name, text)
+	}
+	return tmpl, nil
+}
+
+func renderPath(tmpl *template.Template, data *pathTemplateData) (string, error) {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", errors.Wrapf(err, "failed to render %s template", tmpl.Name())
+	}
+	result := sb.String()
+	if !path.IsAbs(result) {
+		return "", errors.Newf("%s template rendered to %q, which is not an absolute path", tmpl.Name(), result)
+	}
+	return path.Clean(result), nil
+}
+
+// parsePathTemplates parses the path templates in the device configuration.
+func (kd *KnownDevice) parsePathTemplates() error {
+	var err error
+	if kd.containerPathTmpl, err = parsePathTemplate("container_path", kd.ContainerPath); err != nil {
+		return err
+	}
+	if kd.interfacePathTmpl, err = parsePathTemplate("interface_path", kd.InterfacePath); err != nil {
+		return err
+	}
+	if kd.interfacePathTmpl != nil {
+		// devices commonly have several interface nodes, which must not end up on the same path
+		first, firstErr := renderPath(kd.interfacePathTmpl, &pathTemplateData{Name: kd.Name, Node: "ttyACM0", Index: 0})
+		second, secondErr := renderPath(kd.interfacePathTmpl, &pathTemplateData{Name: kd.Name, Node: "hidraw0", Index: 1})
+		if firstErr == nil && secondErr == nil && first == second {
+			return errors.Newf("interface_path template %q renders the same path for every interface node; use {{.Node}} or {{.Index}}", kd.InterfacePath)
+		}
+	}
+	return nil
+}
+
+// containerPaths determines the container paths for the nodes of a device.
+// If the device is not attached yet, only the path of the USB device node can be determined,
+// and only if a container path template was configured.
+func (kd *KnownDevice) containerPaths(dev *usbip.AttachedDevice) (containerPaths, error) {
+	props := kd.readProperties
+	if dev != nil {
+		props = dev.USBDevice
+	}
+	data := pathTemplateData{
+		Name:     kd.Name,
+		Resource: kd.resource,
+		ID:       kd.id,
+		Vendor:   props.Vendor.String(),
+		Product:  props.Product.String(),
+		BusId:    props.BusId,
+	}
+	result := containerPaths{}
+	var err error
+	if kd.containerPathTmpl != nil {
+		if result.Device, err = renderPath(kd.containerPathTmpl, &data); err != nil {
+			return result, err
+		}
+	} else if dev != nil {
+		result.Device = dev.DevMountPath
+	}
+	if dev == nil {
+		return result, nil
+	}
+	seen := map[string]string{result.Device: dev.DevMountPath}
+	for i, node := range dev.InterfaceDevNodes {
+		mapping := nodeMapping{HostPath: node, ContainerPath: node}
+		if kd.interfacePathTmpl != nil {
+			data.Node = path.Base(node)
+			data.Index = i
+			if mapping.ContainerPath, err = renderPath(kd.interfacePathTmpl, &data); err != nil {
+				return result, err
+			}
+		}
+		if other, taken := seen[mapping.ContainerPath]; taken {
+			return result, errors.Newf("%s and %s would both be mounted at %s in the container", other, node, mapping.ContainerPath)
+		}
+		seen[mapping.ContainerPath] = node
+		result.Interfaces = append(result.Interfaces, mapping)
+	}
+	return result, nil
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"testing"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+)
+
+func TestContainerPaths(t *testing.T) {
+	attached := &usbip.AttachedDevice{
+		USBDevice:         driver.USBDevice{Vendor: 0x1050, Product: 0x407, BusId: "1-1"},
+		DevMountPath:      "/dev/bus/usb/003/017",
+		InterfaceDevNodes: []string{"/dev/ttyACM3", "/dev/hidraw2"},
+	}
+
+	for _, tc := range []struct {
+		name          string
+		device        KnownDevice
+		attached      *usbip.AttachedDevice
+		devicePath    string
+		interfaces    []nodeMapping
+		expectFailure bool
+	}{
+		{
+			name:       "defaults",
+			device:     KnownDevice{Name: "key"},
+			attached:   attached,
+			devicePath: "/dev/bus/usb/003/017",
+			interfaces: []nodeMapping{
+				{HostPath: "/dev/ttyACM3", ContainerPath: "/dev/ttyACM3"},
+				{HostPath: "/dev/hidraw2", ContainerPath: "/dev/hidraw2"},
+			},
+		},
+		{
+			name: "templates",
+			device: KnownDevice{
+				Name:          "key",
+				ContainerPath: "/dev/usbip/{{.Name}}",
+				InterfacePath: "/dev/usbip/{{.Name}}-{{.Index}}-{{.Node}}",
+			},
+			attached:   attached,
+			devicePath: "/dev/usbip/key",
+			interfaces: []nodeMapping{
+				{HostPath: "/dev/ttyACM3", ContainerPath: "/dev/usbip/key-0-ttyACM3"},
+				{HostPath: "/dev/hidraw2", ContainerPath: "/dev/usbip/key-1-hidraw2"},
+			},
+		},
+		{
+			name:       "not attached",
+			device:     KnownDevice{Name: "key", ContainerPath: "/dev/usbip/{{.Vendor}}-{{.Product}}"},
+			devicePath: "/dev/usbip/1050-0407",
+		},
+		{
+			name:          "interface path on device path",
+			device:        KnownDevice{Name: "key", ContainerPath: "/dev/usbip/{{.Name}}-0", InterfacePath: "/dev/usbip/{{.Name}}-{{.Index}}"},
+			attached:      attached,
+			expectFailure: true,
+		},
+		{
+			name:          "relative path",
+			device:        KnownDevice{Name: "key", ContainerPath: "usbip/{{.Name}}"},
+			attached:      attached,
+			expectFailure: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kd := tc.device
+			kd.readProperties = attached.USBDevice
+			if err := kd.parsePathTemplates(); err != nil {
+				t.Fatal(err)
+			}
+			paths, err := kd.containerPaths(tc.attached)
+			if (err != nil) != tc.expectFailure {
+				t.Fatalf("unexpected error state: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if paths.Device != tc.devicePath {
+				t.Errorf("got device path %s; want %s", paths.Device, tc.devicePath)
+			}
+			if len(paths.Interfaces) != len(tc.interfaces) {
+				t.Fatalf("got interfaces %v; want %v", paths.Interfaces, tc.interfaces)
+			}
+			for i, mapping := range tc.interfaces {
+				if paths.Interfaces[i] != mapping {
+					t.Errorf("interface %d: got %v; want %v", i, paths.Interfaces[i], mapping)
+				}
+			}
+		})
+	}
+}
+
+func TestCollidingInterfacePaths(t *testing.T) {
+	kd := KnownDevice{Name: "key", InterfacePath: "/dev/usbip/{{.Name}}-{{.Vendor}}"}
+	if err := kd.parsePathTemplates(); err == nil {
+		t.Errorf("template that ignores the interface node should be rejected")
+	}
+	dm := NewDeviceManager("", nil, nil, nil)
+	_, err := dm.Register("device", ResourceOptions{}, []*KnownDevice{{
+		Target:        usbip.Target{Host: "usbip.example.com", Port: 3240},
+		InterfacePath: "/dev/serial",
+	}})
+	if err == nil {
+		t.Errorf("device with a fixed interface path should be rejected")
+	}
+}
@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"os"
+	"strings"
+
+	"github.com/efficientgo/core/errors"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+)
+
+const (
+	// defaultPermissions are the cgroup permissions of device nodes unless configured otherwise.
+	defaultPermissions = "mrw"
+	// readOnlyPermissions are the default cgroup permissions of the device nodes of read-only devices.
+	readOnlyPermissions = "r"
+)
+
+// validatePermissions checks that permissions is a combination of the cgroup device permissions
+// r (read), w (write) and m (mknod), each listed at most once.
+func validatePermissions(permissions string) error {
+	if permissions == "" {
+		return errors.New("permissions must not be empty")
+	}
+	for i, c := range permissions {
+		if !strings.ContainsRune("rwm", c) {
+			return errors.Newf("invalid permissions %q: %q is not one of r, w or m", permissions, c)
+		}
+		if strings.ContainsRune(permissions[:i], c) {
+			return errors.Newf("invalid permissions %q: %q is listed twice", permissions, c)
+		}
+	}
+	return nil
+}
+
+// defaultNodePermissions returns the permissions of device nodes for which no permissions were configured.
+func (kd *KnownDevice) defaultNodePermissions() string {
+	if kd.ReadOnly {
+		return readOnlyPermissions
+	}
+	return defaultPermissions
+}
+
+// nodePermissions returns the permissions of the USB device node and the interface nodes of the device.
+func (kd *KnownDevice) nodePermissions() string {
+	if kd.Permissions != "" {
+		return kd.Permissions
+	}
+	return kd.defaultNodePermissions()
+}
+
+// validatePermissions checks the permissions of the device, its extras and the device nodes
+// in its CDI container edits.
+func (kd *KnownDevice) validatePermissions() error {
+	check := func(what string, permissions string) error {
+		if permissions == "" {
+			return nil
+		}
+		if err := validatePermissions(permissions); err != nil {
+			return errors.Wrapf(err, "invalid permissions for %s", what)
+		}
+		if kd.ReadOnly && strings.ContainsAny(permissions, "wm") {
+			return errors.Newf("%s of a read-only device can't be given permissions %q", what, permissions)
+		}
+		return nil
+	}
+	if err := check("the device", kd.Permissions); err != nil {
+		return err
+	}
+	for i := range kd.ExtraDevices {
+		if err := check("extra device "+kd.ExtraDevices[i].HostPath, kd.ExtraDevices[i].Permissions); err != nil {
+			return err
+		}
+	}
+	if kd.CDI != nil {
+		for _, node := range kd.CDI.DeviceNodes {
+			if node == nil {
+				continue
+			}
+			if err := check("CDI device node "+node.Path, node.Permissions); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cdiDeviceNodes returns copies of the device nodes in the CDI container edits of the device.
+// Like other nodes, those of read-only devices are read-only unless configured otherwise.
+func (kd *KnownDevice) cdiDeviceNodes() []*cdispec.DeviceNode {
+	nodes := make([]*cdispec.DeviceNode, 0, len(kd.CDI.DeviceNodes))
+	for _, node := range kd.CDI.DeviceNodes {
+		if node == nil {
+			continue
+		}
+		clone := *node
+		if clone.Permissions == "" && kd.ReadOnly {
+			clone.Permissions = readOnlyPermissions
+		}
+		nodes = append(nodes, &clone)
+	}
+	return nodes
+}
+
+// extraDeviceSpecs returns fresh copies of the configured extras, with their defaults filled in,
+// so the device specs handed out can't alias the configuration.
+func (kd *KnownDevice) extraDeviceSpecs() []*v1beta1.DeviceSpec {
+	specs := make([]*v1beta1.DeviceSpec, 0, len(kd.ExtraDevices))
+	for i := range kd.ExtraDevices {
+		extra := &kd.ExtraDevices[i]
+		spec := &v1beta1.DeviceSpec{
+			ContainerPath: extra.ContainerPath,
+			HostPath:      extra.HostPath,
+			Permissions:   extra.Permissions,
+		}
+		if spec.ContainerPath == "" {
+			spec.ContainerPath = spec.HostPath
+		}
+		if spec.Permissions == "" {
+			spec.Permissions = kd.defaultNodePermissions()
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// checkExtraDevices checks that the configured extras exist on the host.
+func (kd *KnownDevice) checkExtraDevices() error {
+	for i := range kd.ExtraDevices {
+		hostPath := kd.ExtraDevices[i].HostPath
+		if _, err := os.Stat(hostPath); err != nil {
+			return errors.Wrapf(err, "Extra device at %s not found", hostPath)
+		}
+	}
+	return nil
+}
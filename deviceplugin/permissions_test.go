@@ -0,0 +1,169 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+)
+
+func TestValidatePermissions(t *testing.T) {
+	for permissions, valid := range map[string]bool{
+		"mrw": true,
+		"r":   true,
+		"rw":  true,
+		"":    false,
+		"rx":  false,
+		"rr":  false,
+	} {
+		if err := validatePermissions(permissions); (err == nil) != valid {
+			t.Errorf("%q: got %v, expected valid=%t", permissions, err, valid)
+		}
+	}
+
+	dm := NewDeviceManager("", nil, nil, nil)
+	for _, dev := range []*KnownDevice{
+		{Permissions: "rx"},
+		{ExtraDevices: []v1beta1.DeviceSpec{{HostPath: "/dev/null", Permissions: "write"}}},
+		{ReadOnly: true, Permissions: "rw"},
+		{ReadOnly: true, ExtraDevices: []v1beta1.DeviceSpec{{HostPath: "/dev/null", Permissions: "mr"}}},
+		{CDI: &cdispec.ContainerEdits{DeviceNodes: []*cdispec.DeviceNode{{Path: "/dev/null", Permissions: "rx"}}}},
+		{ReadOnly: true, CDI: &cdispec.ContainerEdits{DeviceNodes: []*cdispec.DeviceNode{{Path: "/dev/null", Permissions: "rw"}}}},
+	} {
+		dev.Target = usbip.Target{Host: "usbip.example.com", Port: 3240}
+		if _, err := dm.Register("device", ResourceOptions{}, []*KnownDevice{dev}); err == nil {
+			t.Errorf("expected %+v to be rejected", dev)
+		}
+	}
+}
+
+// newTestPlugin sets up a plugin that can complete allocations for the devices of the "device" resource.
+func newTestPlugin(dm *DeviceManager) *USBIPPlugin {
+	return &USBIPPlugin{
+		resource:           "usbip.example.com/device",
+		deviceGroup:        "device",
+		manager:            dm,
+		logger:             dm.logger,
+		allocationsCounter: prometheus.NewCounter(prometheus.CounterOpts{Name: "allocations"}),
+	}
+}
+
+// deviceSpec is a comparable copy of a v1beta1.DeviceSpec.
+type deviceSpec struct {
+	containerPath string
+	hostPath      string
+	permissions   string
+}
+
+func allocateSpecs(t *testing.T, dev *KnownDevice) []deviceSpec {
+	t.Helper()
+	dm, _, devId := newTestDeviceManager(t, dev)
+	dm.attachedDevices[devId].InterfaceDevNodes = []string{"/dev/ttyACM0"}
+	up := newTestPlugin(dm)
+	res, err := up.Allocate(context.Background(), &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIds: []string{devId}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.ContainerResponses) != 1 {
+		t.Fatalf("expected a single container response, got %d", len(res.ContainerResponses))
+	}
+	result := make([]deviceSpec, 0)
+	for _, spec := range res.ContainerResponses[0].Devices {
+		result = append(result, deviceSpec{spec.ContainerPath, spec.HostPath, spec.Permissions})
+		// the response must not alias the configuration
+		spec.HostPath = "/dev/changed"
+	}
+	for i := range dev.ExtraDevices {
+		if dev.ExtraDevices[i].HostPath == "/dev/changed" {
+			t.Errorf("extra %d shares its spec with the response", i)
+		}
+	}
+	return result
+}
+
+func TestAllocatePermissions(t *testing.T) {
+	dir := t.TempDir()
+	extras := []string{filepath.Join(dir, "gpio"), filepath.Join(dir, "i2c")}
+	for _, extra := range extras {
+		if err := os.WriteFile(extra, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newDevice := func() *KnownDevice {
+		return &KnownDevice{
+			Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+			Selector: driver.USBDevice{Vendor: 0x1234, Product: 0x5678},
+			ExtraDevices: []v1beta1.DeviceSpec{
+				{HostPath: extras[0]},
+				{HostPath: extras[1], ContainerPath: "/dev/i2c-1", Permissions: "r"},
+			},
+		}
+	}
+
+	specs := allocateSpecs(t, newDevice())
+	expected := []deviceSpec{
+		{"/dev/bus/usb/002/033", "/dev/bus/usb/002/033", "mrw"},
+		{"/dev/ttyACM0", "/dev/ttyACM0", "mrw"},
+		{extras[0], extras[0], "mrw"},
+		{"/dev/i2c-1", extras[1], "r"},
+	}
+	if !reflect.DeepEqual(specs, expected) {
+		t.Errorf("got %v; want %v", specs, expected)
+	}
+
+	dev := newDevice()
+	dev.Permissions = "rw"
+	specs = allocateSpecs(t, dev)
+	expected = []deviceSpec{
+		{"/dev/bus/usb/002/033", "/dev/bus/usb/002/033", "rw"},
+		{"/dev/ttyACM0", "/dev/ttyACM0", "rw"},
+		{extras[0], extras[0], "mrw"},
+		{"/dev/i2c-1", extras[1], "r"},
+	}
+	if !reflect.DeepEqual(specs, expected) {
+		t.Errorf("got %v; want %v", specs, expected)
+	}
+
+	dev = newDevice()
+	dev.ReadOnly = true
+	specs = allocateSpecs(t, dev)
+	expected = []deviceSpec{
+		{"/dev/bus/usb/002/033", "/dev/bus/usb/002/033", "r"},
+		{"/dev/ttyACM0", "/dev/ttyACM0", "r"},
+		{extras[0], extras[0], "r"},
+		{"/dev/i2c-1", extras[1], "r"},
+	}
+	if !reflect.DeepEqual(specs, expected) {
+		t.Errorf("got %v; want %v", specs, expected)
+	}
+}
+
+func TestAllocateMissingExtra(t *testing.T) {
+	dev := &KnownDevice{
+		Target:       usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector:     driver.USBDevice{Vendor: 0x1234, Product: 0x5678},
+		ExtraDevices: []v1beta1.DeviceSpec{{HostPath: filepath.Join(t.TempDir(), "missing")}},
+	}
+	dm, _, devId := newTestDeviceManager(t, dev)
+	up := newTestPlugin(dm)
+	_, err := up.Allocate(context.Background(), &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIds: []string{devId}}},
+	})
+	if err == nil {
+		t.Errorf("expected allocation to fail when an extra is missing")
+	}
+	if holders := dm.attachedDevices[devId].holders; len(holders) != 0 {
+		t.Errorf("failed allocation should not hold the device, got %v", holders)
+	}
+}
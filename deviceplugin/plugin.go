@@ -59,6 +59,7 @@ type plugin struct {
 	pluginSocket string
 	grpcServer   *grpc.Server
 	logger       log.Logger
+	health       *pluginHealth
 
 	// metrics
 	restartsTotal prometheus.Counter
@@ -66,6 +67,11 @@ type plugin struct {
 
 // NewPlugin creates a new instance of a device plugin.
 func NewPlugin(resource string, pluginDir string, dps v1beta1.DevicePluginServer, logger log.Logger, reg prometheus.Registerer) Plugin {
+	return newPlugin(resource, pluginDir, dps, logger, reg, nil)
+}
+
+// newPlugin creates a device plugin that reports its state to the given health tracker, if any.
+func newPlugin(resource string, pluginDir string, dps v1beta1.DevicePluginServer, logger log.Logger, reg prometheus.Registerer, health *pluginHealth) Plugin {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
@@ -75,6 +81,7 @@ func NewPlugin(resource string, pluginDir string, dps v1beta1.DevicePluginServer
 		pluginDir:          pluginDir,
 		pluginSocket:       filepath.Join(pluginDir, fmt.Sprintf("%s-%s-%d.sock", socketPrefix, base64.StdEncoding.EncodeToString([]byte(resource)), time.Now().Unix())),
 		logger:             logger,
+		health:             health,
 		restartsTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "device_plugin_restarts_total",
 			Help: "The number of times that the device plugin has restarted.",
@@ -179,7 +186,11 @@ func (p *plugin) runOnce(ctx context.Context) error {
 		if err != nil {
 			return fmt.Errorf("failed to start gRPC server: %v", err)
 		}
-		g.Add(execute, interrupt)
+		p.health.setServing(true)
+		g.Add(execute, func(err error) {
+			p.health.setServing(false)
+			interrupt(err)
+		})
 	}
 
 	{
@@ -189,7 +200,9 @@ func (p *plugin) runOnce(ctx context.Context) error {
 			defer cancel()
 			var err error
 			for _, backoff := range registerBackoffSchedule {
-				if err = p.registerWithKubelet(); err == nil {
+				err = p.registerWithKubelet()
+				p.health.setRegistered(err)
+				if err == nil {
 					break
 				}
 				time.Sleep(backoff)
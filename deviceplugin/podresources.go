@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const (
+	podResourcesTimeout = 5 * time.Second
+)
+
+// podRef identifies a pod.
+type podRef struct {
+	Namespace string
+	Name      string
+}
+
+func (p podRef) String() string {
+	return fmt.Sprintf("%s/%s", p.Namespace, p.Name)
+}
+
+// podResourcesSnapshot describes the kubelet's view on device usage at a point in time.
+type podResourcesSnapshot struct {
+	// witnesses maps (advertised) device IDs to the pod that holds them.
+	witnesses map[string]podRef
+	// allocatable contains the device IDs the kubelet knows about, or nil if the kubelet
+	// doesn't support reporting allocatable resources.
+	allocatable map[string]bool
+}
+
+// knowsAbout checks whether the kubelet is aware of the given device ID. If the kubelet
+// can't report allocatable resources, it is assumed to know about all devices.
+func (s *podResourcesSnapshot) knowsAbout(devId string) bool {
+	return s.allocatable == nil || s.allocatable[devId]
+}
+
+// podResourcesSource provides snapshots of device usage on the node.
+//
+// The v1 pod resources API doesn't offer a way to watch for changes, so the device manager
+// polls it every deviceCheckInterval.
+type podResourcesSource interface {
+	Snapshot(ctx context.Context) (*podResourcesSnapshot, error)
+}
+
+type kubeletPodResources struct {
+	socket string
+}
+
+func (k *kubeletPodResources) Snapshot(ctx context.Context) (*podResourcesSnapshot, error) {
+	conn, err := kubeletClient(k.socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to kubelet: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	ctx, cancel := context.WithTimeout(ctx, podResourcesTimeout)
+	defer cancel()
+
+	client := v1.NewPodResourcesListerClient(conn)
+	usage, err := client.List(ctx, &v1.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to interrogate kubelet about resource usage: %v", err)
+	}
+	snapshot := &podResourcesSnapshot{witnesses: make(map[string]podRef)}
+	for _, podResources := range usage.GetPodResources() {
+		for _, containerResources := range podResources.GetContainers() {
+			for _, containerDevices := range containerResources.GetDevices() {
+				for _, devId := range containerDevices.DeviceIds {
+					// record the pod of which the container that holds the device is part
+					// so we can log it later if it's one of ours
+					snapshot.witnesses[devId] = podRef{Namespace: podResources.Namespace, Name: podResources.Name}
+				}
+			}
+		}
+	}
+
+	allocatable, err := client.GetAllocatableResources(ctx, &v1.AllocatableResourcesRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		// older kubelet, or the feature gate is disabled
+		return snapshot, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to interrogate kubelet about allocatable resources")
+	}
+	snapshot.allocatable = make(map[string]bool)
+	for _, containerDevices := range allocatable.GetDevices() {
+		for _, devId := range containerDevices.DeviceIds {
+			snapshot.allocatable[devId] = true
+		}
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,198 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/go-kit/log/level"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// disconnectReason checks whether the device recorded in att is still attached to its VHCI port,
+// and explains why not otherwise.
+func disconnectReason(att *attachment, slots []driver.VHCISlot) string {
+	if int(att.Port) >= len(slots) {
+		return "the port no longer exists"
+	}
+	slot := &slots[att.Port]
+	switch {
+	case slot.Status == driver.VDevStatusError:
+		return "the port is in an error state"
+	case !slot.IsDeviceConnected():
+		return "the port is empty"
+	case slot.LocalDeviceInfo.Vendor != att.Vendor || slot.LocalDeviceInfo.Product != att.Product:
+		return "the port holds a different device"
+	}
+	return ""
+}
+
+// localDisconnectReason checks whether a local device is still plugged in under the same device node,
+// and explains why not otherwise.
+func (dm *DeviceManager) localDisconnectReason(att *attachment) string {
+	if dm.local == nil {
+		return "local devices are not enabled"
+	}
+	dev, err := dm.local.Describe(att.BusId)
+	switch {
+	case err != nil:
+		return "the device was unplugged"
+	case dev.Vendor != att.Vendor || dev.Product != att.Product:
+		return "a different device was plugged in"
+	case dev.DevMountPath != att.DevMountPath:
+		return "the device was plugged in again"
+	}
+	return ""
+}
+
+// reconcileAttached checks the attached devices against the VHCI ports, and flags the devices that were
+// disconnected, e.g. because their target rebooted or the network dropped. Ports in an error state are freed.
+// The caller must hold dm.mu, and must have updated the VHCI driver's view of the ports.
+func (dm *DeviceManager) reconcileAttached(ctx context.Context) {
+	slots := dm.vhciDriver.GetDeviceSlots()
+	for devId, att := range dm.attachedDevices {
+		if !att.lostSince.IsZero() {
+			dm.startReattach(devId, att)
+			continue
+		}
+		var reason string
+		if att.Target.Local {
+			reason = dm.localDisconnectReason(att)
+		} else {
+			reason = disconnectReason(att, slots)
+		}
+		if reason == "" {
+			continue
+		}
+		att.lostSince = time.Now()
+		dm.metrics.disconnects.WithLabelValues(describeTarget(att.Target)).Inc()
+		kd := dm.knownDevices[devId]
+		_ = level.Warn(dm.logger).Log("msg", "attached device was disconnected", "devId", devId, "port", att.Port, "reason", reason)
+		dm.events.warning(att.pods, EventReasonDeviceDisconnected, "Device %s on %s was disconnected: %s", kd.Name, attachedAt(att.AttachedDevice), reason)
+		if !att.Target.Local && int(att.Port) < len(slots) && slots[att.Port].Status == driver.VDevStatusError {
+			if err := dm.detach(ctx, att.Port, att.Target); err != nil {
+				_ = level.Warn(dm.logger).Log("msg", "failed to free port of disconnected device", "port", att.Port, "err", err)
+			}
+		}
+		dm.startReattach(devId, att)
+	}
+}
+
+// startReattach starts re-attaching a disconnected device in the background, if its resource asks for it,
+// a pod still holds it and its target offers it. The caller must hold dm.mu.
+func (dm *DeviceManager) startReattach(devId string, lost *attachment) {
+	kd := dm.knownDevices[devId]
+	if lost.reattaching || len(lost.holders) == 0 || kd == nil || !kd.available {
+		return
+	}
+	options := dm.resourceOptions[kd.resource]
+	if !options.ReattachLost {
+		return
+	}
+	lost.reattaching = true
+	go dm.reattachLoop(devId, lost, options.reattachBackoff())
+}
+
+// reattachLoop tries to import a disconnected device again, backing off exponentially between attempts,
+// until it succeeds, the device is released or no longer offered, or the device manager shuts down.
+// Once the target offers the device again, the next reconciliation starts a new loop.
+func (dm *DeviceManager) reattachLoop(devId string, lost *attachment, backoff time.Duration) {
+	for attempt := 1; ; attempt++ {
+		time.Sleep(backoff)
+		if dm.tryReattach(devId, lost, attempt) {
+			return
+		}
+		backoff = min(2*backoff, maxReattachBackoff)
+	}
+}
+
+// reattachCancelled reports whether a disconnected device no longer needs to be re-attached, because
+// the device manager is shutting down, or the device was released or replaced in the meantime.
+// The caller must hold dm.mu.
+func (dm *DeviceManager) reattachCancelled(devId string, lost *attachment) bool {
+	if dm.stopped || dm.attachedDevices[devId] != lost || len(lost.holders) == 0 {
+		lost.reattaching = false
+		return true
+	}
+	return false
+}
+
+// tryReattach makes a single attempt to re-attach a disconnected device, and reports whether
+// the re-attach loop should stop. The device is imported without holding dm.mu, so that a slow
+// target doesn't hold up allocations and refreshes; the caller must not hold it.
+func (dm *DeviceManager) tryReattach(devId string, lost *attachment, attempt int) bool {
+	dm.mu.Lock()
+	if dm.reattachCancelled(devId, lost) {
+		dm.mu.Unlock()
+		return true
+	}
+	kd := dm.knownDevices[devId]
+	if !kd.available {
+		// the target no longer offers the device; don't bother importing it until it does again
+		_ = level.Info(dm.logger).Log("msg", "disconnected device is no longer offered; pausing re-attach", "devId", devId)
+		lost.reattaching = false
+		dm.mu.Unlock()
+		return true
+	}
+	// refreshes update the known device while the import runs
+	offered := *kd
+	dm.mu.Unlock()
+
+	ctx, span := tracer.Start(context.Background(), "DeviceManager.reattach", trace.WithAttributes(
+		usbip.TargetAttribute(offered.Target),
+		attribute.String("usbip.device_id", devId),
+		attribute.Int("usbip.attempts", attempt),
+	))
+	_ = level.Info(dm.logger).Log("msg", "re-attaching disconnected device", "devId", devId, "lostSince", lost.lostSince, "attempt", attempt)
+	attachedDevice, err := dm.importDevice(ctx, &offered)
+
+	dm.mu.Lock()
+	if err == nil && dm.reattachCancelled(devId, lost) {
+		dm.mu.Unlock()
+		_ = level.Info(dm.logger).Log("msg", "disconnected device was released while re-attaching; detaching it again", "devId", devId)
+		dm.rollbackAttach(ctx, devId, attachedDevice)
+		endSpan(span, nil)
+		return true
+	}
+	defer dm.mu.Unlock()
+	var att *attachment
+	if err == nil {
+		att, err = dm.installAttached(ctx, devId, attachedDevice)
+	}
+	endSpan(span, err)
+	if err != nil {
+		dm.metrics.reattaches.WithLabelValues(describeTarget(offered.Target), "failure").Inc()
+		// a failed import doesn't touch the attachment
+		return false
+	}
+	downtime := time.Since(lost.lostSince)
+	dm.metrics.reattaches.WithLabelValues(describeTarget(offered.Target), "success").Inc()
+	dm.metrics.recoveryTime.WithLabelValues(describeTarget(offered.Target)).Observe(downtime.Seconds())
+	att.holders = lost.holders
+	att.pods = lost.pods
+	lost.reattaching = false
+	dm.events.normal(
+		att.pods, EventReasonDeviceReattached, "Re-attached %s to %s (%s) after it was disconnected for %s",
+		kd.Name, attachedAt(att.AttachedDevice), att.DevMountPath, downtime.Round(time.Second),
+	)
+	dm.health.setLostDevices(dm.lostDevices())
+	dm.notify([]string{devId})
+	return true
+}
+
+// lostDevices lists the attached devices that were disconnected. The caller must hold dm.mu.
+func (dm *DeviceManager) lostDevices() []string {
+	result := make([]string, 0)
+	for devId, att := range dm.attachedDevices {
+		if !att.lostSince.IsZero() {
+			result = append(result, devId)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
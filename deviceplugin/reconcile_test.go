@@ -0,0 +1,280 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestDisconnectedDevices(t *testing.T) {
+	target := usbip.Target{Host: "usbip.example.com", Port: 3240}
+	dev := &KnownDevice{
+		Target:   target,
+		Selector: driver.USBDevice{Vendor: 0x1050, Product: 0x0407},
+		Replicas: 2,
+	}
+	dm, vhci, devId := newTestDeviceManager(t, dev)
+	dm.dialer = unreachableDialer{}
+	vhci.slots[0].LocalDeviceInfo = dev.Selector
+	advertisedIds := dev.advertisedIds()
+	dm.attachedDevices[devId].holders[advertisedIds[0]] = true
+
+	dm.reconcileAttached(context.Background())
+	if len(dm.lostDevices()) != 0 {
+		t.Fatalf("connected device should not be flagged")
+	}
+
+	vhci.slots[0].Status = driver.VDevStatusError
+	dm.reconcileAttached(context.Background())
+	if lost := dm.lostDevices(); len(lost) != 1 || lost[0] != devId {
+		t.Fatalf("disconnected device should be flagged, got %v", lost)
+	}
+	if !vhci.slots[0].IsEmpty() {
+		t.Errorf("port in error state should have been freed")
+	}
+	if count := testutil.ToFloat64(dm.metrics.disconnects.WithLabelValues("usbip.example.com:3240")); count != 1 {
+		t.Errorf("expected 1 disconnect, got %v", count)
+	}
+
+	// the other replica can't be handed the stale device node
+	up := &USBIPPlugin{resource: "usbip.example.com/device", deviceGroup: "device", manager: dm, logger: dm.logger}
+	_, err := up.Allocate(context.Background(), &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIds: advertisedIds[1:]}},
+	})
+	if err == nil {
+		t.Errorf("expected allocation of disconnected device to fail")
+	}
+
+	// re-attaching is opt-in
+	if dm.attachedDevices[devId].reattaching {
+		t.Errorf("device should not be re-attached by default")
+	}
+	dm.resourceOptions["device"] = ResourceOptions{ReattachLost: true}
+	lost := dm.attachedDevices[devId]
+	if done := dm.tryReattach(devId, lost, 1); done {
+		t.Errorf("re-attaching should be retried with an unreachable target")
+	}
+	if count := testutil.ToFloat64(dm.metrics.reattaches.WithLabelValues("usbip.example.com:3240", "failure")); count != 1 {
+		t.Errorf("expected 1 failed re-attach, got %v", count)
+	}
+	if att, ok := dm.attachedDevices[devId]; !ok || att.lostSince.IsZero() {
+		t.Fatalf("device should still be flagged after a failed re-attach")
+	}
+
+	// once released, the device is forgotten without touching the port, which now holds another device
+	vhci.slots[0] = driver.VHCISlot{Port: 0, Status: driver.VDevStatusUsed, LocalDeviceInfo: driver.USBDevice{Vendor: 0x20a0, Product: 0x4230}}
+	dm.podResources = &fakePodResources{snapshot: &podResourcesSnapshot{witnesses: map[string]podRef{}}}
+	dm.attachedDevices[devId].releasedSince = time.Now().Add(-defaultReleaseGracePeriod)
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dm.attachedDevices[devId]; ok {
+		t.Errorf("released device should have been forgotten")
+	}
+	if !vhci.slots[0].IsDeviceConnected() {
+		t.Errorf("port should not have been detached")
+	}
+}
+
+func TestReattachLoopStops(t *testing.T) {
+	dev := &KnownDevice{
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1050, Product: 0x0407},
+	}
+	dm, vhci, devId := newTestDeviceManager(t, dev)
+	dm.dialer = unreachableDialer{}
+	backoff := time.Millisecond
+	dm.resourceOptions["device"] = ResourceOptions{ReattachLost: true, ReattachBackoff: &backoff}
+	dm.attachedDevices[devId].holders[dev.advertisedIds()[0]] = true
+	vhci.slots[0].Status = driver.VDevStatusNotAssigned
+
+	dm.mu.Lock()
+	dm.reconcileAttached(context.Background())
+	lost := dm.attachedDevices[devId]
+	if !lost.reattaching {
+		t.Fatalf("re-attach loop should have started")
+	}
+	dm.mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dm.mu.Lock()
+		failures := testutil.ToFloat64(dm.metrics.reattaches.WithLabelValues("usbip.example.com:3240", "failure"))
+		if failures >= 2 {
+			// the loop gives up once the device is released
+			dm.forgetAttached(devId)
+			dm.mu.Unlock()
+			break
+		}
+		dm.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("re-attach loop should keep retrying, got %v attempts", failures)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for {
+		dm.mu.Lock()
+		reattaching := lost.reattaching
+		dm.mu.Unlock()
+		if !reattaching {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("re-attach loop should stop once the device is forgotten")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLostDeviceNoLongerOffered(t *testing.T) {
+	dev := &KnownDevice{
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1050, Product: 0x0407},
+	}
+	dm, vhci, devId := newTestDeviceManager(t, dev)
+	dm.dialer = unreachableDialer{}
+	backoff := time.Millisecond
+	dm.resourceOptions["device"] = ResourceOptions{ReattachLost: true, ReattachBackoff: &backoff}
+	lost := dm.attachedDevices[devId]
+	lost.holders[devId] = true
+	vhci.slots[0].Status = driver.VDevStatusNotAssigned
+
+	// the target went away along with the device
+	dev.available = false
+	dm.mu.Lock()
+	dm.reconcileAttached(context.Background())
+	reattaching := lost.reattaching
+	dm.mu.Unlock()
+	if reattaching {
+		t.Fatalf("re-attach loop should not start for a device that isn't offered")
+	}
+
+	// the target is back, but the device disappears again while re-attaching
+	dm.mu.Lock()
+	dev.available = true
+	dm.reconcileAttached(context.Background())
+	if !lost.reattaching {
+		t.Fatalf("re-attach loop should have started")
+	}
+	dev.available = false
+	dm.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dm.mu.Lock()
+		reattaching = lost.reattaching
+		dm.mu.Unlock()
+		if !reattaching {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("re-attach loop should stop once the device is no longer offered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// once the pod is gone, the device is released
+	dm.podResources = &fakePodResources{snapshot: &podResourcesSnapshot{
+		witnesses:   map[string]podRef{},
+		allocatable: map[string]bool{},
+	}}
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(lost.holders) != 0 {
+		t.Errorf("released device should have no holders, got %v", lost.holders)
+	}
+	lost.releasedSince = time.Now().Add(-defaultReleaseGracePeriod)
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dm.attachedDevices[devId]; ok {
+		t.Errorf("lost device should have been released")
+	}
+}
+
+// newLostLocalDevice sets up a device manager with a disconnected local device that is being
+// re-attached. The device node at the returned path only shows up once the test creates it.
+func newLostLocalDevice(t *testing.T) (*DeviceManager, *KnownDevice, *attachment, string) {
+	devNode := filepath.Join(t.TempDir(), "004")
+	local := &fakeLocalDriver{devices: map[string]driver.LocalDevice{
+		"1-1": {USBDevice: driver.USBDevice{Vendor: 0x10c4, Product: 0xea60, BusId: "1-1"}, DevMountPath: devNode},
+	}}
+	dm := NewDeviceManager("", nil, &fakeVHCIDriver{}, unreachableDialer{})
+	dm.EnableLocalDevices(local)
+	dev := &KnownDevice{Target: usbip.Target{Local: true}, Selector: driver.USBDevice{Vendor: 0x10c4, Product: 0xea60}}
+	if _, err := dm.Register("serial", ResourceOptions{ReattachLost: true}, []*KnownDevice{dev}); err != nil {
+		t.Fatal(err)
+	}
+	dev.available = true
+	dev.readProperties = local.devices["1-1"].USBDevice
+	lost := newAttachment(&usbip.AttachedDevice{USBDevice: dev.readProperties, Target: dev.Target, DevMountPath: "/dev/bus/usb/001/003"})
+	lost.lostSince = time.Now()
+	lost.holders[dev.id] = true
+	lost.reattaching = true
+	dm.attachedDevices[dev.id] = lost
+	return dm, dev, lost, devNode
+}
+
+func TestReattachWithoutLock(t *testing.T) {
+	dm, dev, lost, devNode := newLostLocalDevice(t)
+
+	done := make(chan bool)
+	go func() {
+		done <- dm.tryReattach(dev.id, lost, 1)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if !dm.mu.TryLock() {
+		t.Fatalf("device manager should not be locked while waiting for the device nodes")
+	}
+	dm.mu.Unlock()
+
+	if err := os.WriteFile(devNode, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !<-done {
+		t.Fatalf("re-attach should have succeeded")
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	att := dm.attachedDevices[dev.id]
+	if att == lost || !att.lostSince.IsZero() || att.DevMountPath != devNode {
+		t.Fatalf("device should have been re-attached, got %+v", att.AttachedDevice)
+	}
+	if !att.holders[dev.id] || lost.reattaching {
+		t.Errorf("re-attached device should keep its holders")
+	}
+}
+
+func TestReattachCancelledWhileImporting(t *testing.T) {
+	dm, dev, lost, devNode := newLostLocalDevice(t)
+
+	done := make(chan bool)
+	go func() {
+		done <- dm.tryReattach(dev.id, lost, 1)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	// the pod goes away while the device is being imported
+	dm.mu.Lock()
+	dm.forgetAttached(dev.id)
+	dm.mu.Unlock()
+	if err := os.WriteFile(devNode, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !<-done {
+		t.Fatalf("re-attach loop should stop once the device is released")
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if _, ok := dm.attachedDevices[dev.id]; ok || lost.reattaching {
+		t.Errorf("released device should not have been re-attached")
+	}
+}
@@ -22,6 +22,7 @@ package deviceplugin
 import (
 	"context"
 	"fmt"
+	"maps"
 	"os"
 	"time"
 
@@ -30,6 +31,8 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
@@ -40,11 +43,13 @@ const (
 
 type USBIPPlugin struct {
 	v1beta1.UnimplementedDevicePluginServer
-	resource          string
-	selectableDevices map[string]*KnownDevice
-	manager           *DeviceManager
-	logger            log.Logger
-	refreshChan       chan []string
+	resource    string
+	deviceGroup string
+	options     ResourceOptions
+	manager     *DeviceManager
+	logger      log.Logger
+	refreshChan chan []string
+	health      *pluginHealth
 
 	// metrics
 	availableDeviceGauge prometheus.Gauge
@@ -52,27 +57,21 @@ type USBIPPlugin struct {
 	allocationsCounter   prometheus.Counter
 }
 
-func NewPluginForDeviceGroup(deviceIds []string, dm *DeviceManager, resourceName string, pluginDir string, logger log.Logger, reg prometheus.Registerer) Plugin {
+// NewPluginForDeviceGroup creates a plugin advertising the devices registered under deviceGroup
+// as resourceName. Devices can be registered and unregistered while the plugin runs.
+func NewPluginForDeviceGroup(dm *DeviceManager, deviceGroup string, resourceName string, options ResourceOptions, pluginDir string, logger log.Logger, reg prometheus.Registerer) Plugin {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 
-	selectableDevices := make(map[string]*KnownDevice, len(deviceIds))
-	for _, id := range deviceIds {
-		devPtr, ok := dm.knownDevices[id]
-		if !ok {
-			// should never happen
-			panic(fmt.Errorf("device %s not found in known devices", id))
-		}
-		selectableDevices[id] = devPtr
-	}
-
 	p := &USBIPPlugin{
-		resource:          resourceName,
-		selectableDevices: selectableDevices,
-		manager:           dm,
-		logger:            logger,
-		refreshChan:       make(chan []string),
+		resource:    resourceName,
+		deviceGroup: deviceGroup,
+		options:     options,
+		manager:     dm,
+		logger:      logger,
+		refreshChan: dm.subscribe(),
+		health:      dm.health.plugin(resourceName),
 		availableDeviceGauge: prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "usbip_device_plugin_available_devices",
 			Help: "The number of devices managed by this device plugin.",
@@ -86,14 +85,13 @@ func NewPluginForDeviceGroup(deviceIds []string, dm *DeviceManager, resourceName
 			Help: "The total number of device allocations made by this device plugin.",
 		}),
 	}
-	dm.subscribers = append(dm.subscribers, p.refreshChan)
 
 	_ = logger.Log("msg", "Preparing device plugin...")
 	if reg != nil {
 		reg.MustRegister(p.availableDeviceGauge, p.allocationsCounter, p.attachedDeviceGauge)
 	}
 
-	return NewPlugin(resourceName, pluginDir, p, logger, prometheus.WrapRegistererWithPrefix("usbip_", reg))
+	return newPlugin(resourceName, pluginDir, p, logger, prometheus.WrapRegistererWithPrefix("usbip_", reg), p.health)
 }
 
 // GetDeviceState always returns healthy.
@@ -102,61 +100,100 @@ func (up *USBIPPlugin) GetDeviceState(_ string) string {
 }
 
 // Allocate assigns USB/IP devices to a Pod.
-func (up *USBIPPlugin) Allocate(_ context.Context, req *v1beta1.AllocateRequest) (*v1beta1.AllocateResponse, error) {
+// In lazy attach mode, the devices are only reserved here, and imported in PreStartContainer.
+// Since the /dev nodes aren't known at this point, this mode requires CDI.
+func (up *USBIPPlugin) Allocate(ctx context.Context, req *v1beta1.AllocateRequest) (_ *v1beta1.AllocateResponse, err error) {
+	ctx, span := tracer.Start(ctx, "USBIPPlugin.Allocate", trace.WithAttributes(
+		attribute.String("usbip.resource", up.resource),
+		attribute.Int("usbip.container_requests", len(req.ContainerRequests)),
+	))
+	defer func() { endSpan(span, err) }()
 	up.manager.mu.Lock()
 	defer up.manager.mu.Unlock()
-	var err error
 	res := &v1beta1.AllocateResponse{
 		ContainerResponses: make([]*v1beta1.ContainerAllocateResponse, 0, len(req.ContainerRequests)),
 	}
+	selectableDevices := up.manager.selectableDevices(up.deviceGroup)
 	for containerRequestIndex, r := range req.ContainerRequests {
 		resp := new(v1beta1.ContainerAllocateResponse)
 		_ = level.Info(up.logger).Log("msg", "Received request for devices", "devices", r.DevicesIds, "index", containerRequestIndex)
 		for _, id := range r.DevicesIds {
-			dev, ok := up.selectableDevices[id]
+			dev, ok := selectableDevices[id]
 			if !ok {
 				_ = level.Warn(up.logger).Log("msg", "Requested device does not exist", "id", id)
 				return nil, fmt.Errorf("requested device does not exist %s", id)
 			}
-			if !dev.available {
+			if !dev.allocatable() {
 				_ = level.Warn(up.logger).Log("msg", "Requested device is not available", "id", id)
 				return nil, fmt.Errorf("requested device %s is not available", id)
 			}
 		}
+		metadata := make([]deviceMetadata, 0, len(r.DevicesIds))
+		seen := make(map[string]bool, len(r.DevicesIds))
+		attached := make(map[string]*attachment, len(r.DevicesIds))
 		for _, id := range r.DevicesIds {
-			dev, _ := up.selectableDevices[id]
-			attachedDevice, alreadyAttached := up.manager.attachedDevices[id]
-			if !alreadyAttached {
-				attachedDevice, err = usbip.Import(
-					dev.readProperties.BusId,
-					dev.Target,
-					up.manager.vhciDriver,
-					up.manager.dialer,
+			dev := selectableDevices[id]
+			// multiple replicas of the same device only need to be exposed once
+			if seen[dev.id] {
+				// but the container holds all of them
+				if att := attached[dev.id]; att != nil {
+					att.holders[id] = true
+				}
+				continue
+			}
+			seen[dev.id] = true
+			if up.options.LazyAttach {
+				up.manager.reserveDevice(dev.id)
+				resp.CdiDevices = append(
+					resp.CdiDevices,
+					&v1beta1.CDIDevice{Name: up.manager.cdi.qualifiedName(dev, dev.id)},
 				)
+				meta, err := newDeviceMetadata(id, dev, nil)
+				if err != nil {
+					return nil, err
+				}
+				metadata = append(metadata, meta)
+				continue
+			}
+			att, alreadyAttached, err := up.manager.usableAttachment(dev.id)
+			if err != nil {
+				return nil, err
+			}
+			if !alreadyAttached {
+				att, err = up.manager.attachDevice(ctx, dev.id)
 				if err != nil {
-					_ = level.Info(up.logger).Log("msg", "USB/IP import failed", "device", dev)
 					return nil, err
 				}
-				_ = level.Info(up.logger).Log("msg", "Waiting for /dev nodes for device...", "details", attachedDevice)
-				err = waitForDevNodes(dev, attachedDevice)
+			}
+			// extras aren't managed by us, so they may have disappeared since the device was attached
+			if err = dev.checkExtraDevices(); err != nil {
+				return nil, err
+			}
+			att.holders[id] = true
+			attached[dev.id] = att
+			if up.manager.cdi != nil {
+				resp.CdiDevices = append(
+					resp.CdiDevices,
+					&v1beta1.CDIDevice{Name: up.manager.cdi.qualifiedName(dev, dev.id)},
+				)
+			} else {
+				specs, err := deviceSpecs(dev, att.AttachedDevice)
 				if err != nil {
-					_ = level.Warn(up.logger).Log("msg", "/dev nodes for device never appeared", "details", attachedDevice, "err", err)
 					return nil, err
 				}
-				up.manager.attachedDevices[id] = attachedDevice
-				_ = level.Warn(up.logger).Log("msg", "Attached device", "details", attachedDevice)
+				if up.manager.usesLinks(dev.id) {
+					specs = up.manager.links.substitute(dev.id, att.AttachedDevice, specs)
+				}
+				resp.Devices = append(resp.Devices, specs...)
 			}
-			resp.Devices = append(
-				resp.Devices,
-				&v1beta1.DeviceSpec{
-					ContainerPath: attachedDevice.DevMountPath,
-					HostPath:      attachedDevice.DevMountPath,
-					Permissions:   "mrw",
-				},
-			)
-			for _, extraDev := range dev.ExtraDevices {
-				resp.Devices = append(resp.Devices, &extraDev)
+			meta, err := newDeviceMetadata(id, dev, att.AttachedDevice)
+			if err != nil {
+				return nil, err
 			}
+			metadata = append(metadata, meta)
+		}
+		if err = up.addDeviceMetadata(resp, metadata); err != nil {
+			return nil, errors.Wrap(err, "failed to add device metadata")
 		}
 		res.ContainerResponses = append(res.ContainerResponses, resp)
 	}
@@ -164,22 +201,44 @@ func (up *USBIPPlugin) Allocate(_ context.Context, req *v1beta1.AllocateRequest)
 	return res, nil
 }
 
+// deviceSpecs lists the device nodes to expose to a container for an attached device:
+// the USB device node itself, the nodes of its interfaces and any configured extras.
+func deviceSpecs(devConfig *KnownDevice, device *usbip.AttachedDevice) ([]*v1beta1.DeviceSpec, error) {
+	paths, err := devConfig.containerPaths(device)
+	if err != nil {
+		return nil, err
+	}
+	specs := make([]*v1beta1.DeviceSpec, 0, 1+len(paths.Interfaces)+len(devConfig.ExtraDevices))
+	permissions := devConfig.nodePermissions()
+	specs = append(specs, &v1beta1.DeviceSpec{
+		ContainerPath: paths.Device,
+		HostPath:      device.DevMountPath,
+		Permissions:   permissions,
+	})
+	for _, node := range paths.Interfaces {
+		specs = append(specs, &v1beta1.DeviceSpec{
+			ContainerPath: node.ContainerPath,
+			HostPath:      node.HostPath,
+			Permissions:   permissions,
+		})
+	}
+	specs = append(specs, devConfig.extraDeviceSpecs()...)
+	return specs, nil
+}
+
 func checkDevNodeAvailability(devConfig *KnownDevice, device *usbip.AttachedDevice) error {
 
 	if _, err := os.Stat(device.DevMountPath); err != nil {
 		return errors.Wrapf(err, "Main device node at %s not found", err)
 	}
-	for _, extraDev := range devConfig.ExtraDevices {
-		if _, err := os.Stat(extraDev.HostPath); err != nil {
-			return errors.Wrapf(err, "Extra device at %s not found", extraDev.HostPath)
-		}
-	}
-	return nil
+	return devConfig.checkExtraDevices()
 }
 
-func waitForDevNodes(devConfig *KnownDevice, device *usbip.AttachedDevice) error {
-	var latestErr error
+func waitForDevNodes(ctx context.Context, devConfig *KnownDevice, device *usbip.AttachedDevice) (latestErr error) {
+	_, span := tracer.Start(ctx, "waitForDevNodes", trace.WithAttributes(attribute.String("usbip.dev_mount_path", device.DevMountPath)))
+	defer func() { endSpan(span, latestErr) }()
 	for i := 0; i < waitForDevNodesAttempts; i++ {
+		span.SetAttributes(attribute.Int("usbip.attempts", i+1))
 		if latestErr = checkDevNodeAvailability(devConfig, device); latestErr == nil {
 			break
 		}
@@ -189,62 +248,113 @@ func waitForDevNodes(devConfig *KnownDevice, device *usbip.AttachedDevice) error
 	return latestErr
 }
 
-// GetDevicePluginOptions always returns an empty response.
+// GetDevicePluginOptions requests PreStartContainer calls if lazy attach is enabled.
 func (up *USBIPPlugin) GetDevicePluginOptions(_ context.Context, _ *v1beta1.Empty) (*v1beta1.DevicePluginOptions, error) {
-	return &v1beta1.DevicePluginOptions{}, nil
+	return &v1beta1.DevicePluginOptions{PreStartRequired: up.options.LazyAttach}, nil
 }
 
-func (up *USBIPPlugin) updateCounters() {
+// updateCounters updates the device gauges. The caller must hold up.manager.mu.
+func (up *USBIPPlugin) updateCounters(selectableDevices map[string]*KnownDevice) {
 	availableCount := 0
-	attachedCount := 0
-	for devId, dev := range up.selectableDevices {
-		if dev.available {
+	attached := make(map[string]bool)
+	for _, dev := range selectableDevices {
+		if dev.allocatable() {
 			availableCount += 1
 		}
-		_, attached := up.manager.attachedDevices[devId]
-		if attached {
-			attachedCount += 1
+		if _, ok := up.manager.attachedDevices[dev.id]; ok {
+			attached[dev.id] = true
 		}
 	}
 
 	up.availableDeviceGauge.Set(float64(availableCount))
-	up.attachedDeviceGauge.Set(float64(attachedCount))
+	up.attachedDeviceGauge.Set(float64(len(attached)))
+
+}
 
+// isRelevant checks whether any of the given (underlying) device IDs are exposed by this plugin.
+func isRelevant(selectableDevices map[string]*KnownDevice, changedDevices []string) bool {
+	for _, devId := range changedDevices {
+		for _, dev := range selectableDevices {
+			if dev.id == devId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// availableDevices lists the IDs of the devices that can currently be allocated.
+func availableDevices(selectableDevices map[string]*KnownDevice) map[string]bool {
+	result := make(map[string]bool, len(selectableDevices))
+	for devId, dev := range selectableDevices {
+		if dev.allocatable() {
+			result[devId] = true
+		}
+	}
+	return result
 }
 
-// ListAndWatch lists all devices and then refreshes every deviceCheckInterval.
+// ListAndWatch lists all devices, and sends an update whenever devices change,
+// are registered or are unregistered.
 func (up *USBIPPlugin) ListAndWatch(_ *v1beta1.Empty, stream v1beta1.DevicePlugin_ListAndWatchServer) error {
 	_ = level.Info(up.logger).Log("msg", "starting listwatch")
 	var changedDevices []string
-	changeRelevant := true
+	var sent map[string]bool
 	for {
+		up.manager.mu.Lock()
+		selectableDevices := up.manager.selectableDevices(up.deviceGroup)
+		up.updateCounters(selectableDevices)
+		available := availableDevices(selectableDevices)
+		changeRelevant := sent == nil || isRelevant(selectableDevices, changedDevices) || !maps.Equal(sent, available)
+		up.manager.mu.Unlock()
+
 		if changeRelevant {
-			up.updateCounters()
 			res := new(v1beta1.ListAndWatchResponse)
-			for devId, dev := range up.selectableDevices {
-				if dev.available {
-					res.Devices = append(res.Devices, &v1beta1.Device{ID: devId, Health: v1beta1.Healthy})
-				}
+			for devId := range available {
+				res.Devices = append(res.Devices, &v1beta1.Device{ID: devId, Health: v1beta1.Healthy})
 			}
 			_ = level.Info(up.logger).Log("msg", "emitting device status update")
 			if err := stream.Send(res); err != nil {
 				return err
 			}
+			up.health.listAndWatchSent()
+			up.manager.mu.Lock()
+			up.manager.recordAdvertised(sent, available)
+			up.manager.mu.Unlock()
+			sent = available
 		}
-		changedDevices = <-up.refreshChan
-		changeRelevant = false
-		for _, devId := range changedDevices {
-			_, ok := up.selectableDevices[devId]
-			if ok {
-				changeRelevant = true
-				break
-			}
+		var ok bool
+		changedDevices, ok = <-up.refreshChan
+		if !ok {
+			return nil
 		}
 	}
 }
 
-// PreStartContainer always returns an empty response.
-func (up *USBIPPlugin) PreStartContainer(_ context.Context, _ *v1beta1.PreStartContainerRequest) (*v1beta1.PreStartContainerResponse, error) {
+// PreStartContainer attaches devices that were reserved in Allocate when lazy attach is enabled.
+func (up *USBIPPlugin) PreStartContainer(ctx context.Context, req *v1beta1.PreStartContainerRequest) (_ *v1beta1.PreStartContainerResponse, err error) {
+	if !up.options.LazyAttach {
+		return &v1beta1.PreStartContainerResponse{}, nil
+	}
+	ctx, span := tracer.Start(ctx, "USBIPPlugin.PreStartContainer", trace.WithAttributes(
+		attribute.String("usbip.resource", up.resource),
+		attribute.StringSlice("usbip.device_ids", req.DevicesIds),
+	))
+	defer func() { endSpan(span, err) }()
+	up.manager.mu.Lock()
+	defer up.manager.mu.Unlock()
+	selectableDevices := up.manager.selectableDevices(up.deviceGroup)
+	for _, id := range req.DevicesIds {
+		if _, ok := selectableDevices[id]; !ok {
+			_ = level.Warn(up.logger).Log("msg", "Requested device does not exist", "id", id)
+			return nil, fmt.Errorf("requested device does not exist %s", id)
+		}
+	}
+	_ = level.Info(up.logger).Log("msg", "Attaching devices before container start", "devices", req.DevicesIds)
+	if err = up.manager.attachReserved(ctx, req.DevicesIds); err != nil {
+		_ = level.Warn(up.logger).Log("msg", "Failed to attach devices before container start", "devices", req.DevicesIds, "err", err)
+		return nil, err
+	}
 	return &v1beta1.PreStartContainerResponse{}, nil
 }
 
@@ -0,0 +1,254 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// newLazyTestPlugin sets up a plugin that attaches the given number of local devices lazily.
+// All devices are plugged in and available at first.
+func newLazyTestPlugin(t *testing.T, count int) (*USBIPPlugin, *fakeLocalDriver, []string) {
+	t.Helper()
+	local := &fakeLocalDriver{devices: make(map[string]driver.LocalDevice)}
+	devices := make([]*KnownDevice, 0, count)
+	for i := 0; i < count; i++ {
+		busId := fmt.Sprintf("1-%d", i+1)
+		// stand-in for the device node, which must exist before the device is handed out
+		devNode := filepath.Join(t.TempDir(), busId)
+		if err := os.WriteFile(devNode, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		selector := driver.USBDevice{Vendor: 0x10c4, Product: driver.USBID(0xea60 + i)}
+		local.devices[busId] = driver.LocalDevice{
+			USBDevice:    driver.USBDevice{Vendor: selector.Vendor, Product: selector.Product, BusId: busId},
+			DevMountPath: devNode,
+		}
+		devices = append(devices, &KnownDevice{Target: usbip.Target{Local: true}, Selector: selector})
+	}
+	vhci := &fakeVHCIDriver{slots: []driver.VHCISlot{{Port: 0, Status: driver.VDevStatusNull}}}
+	dm := NewDeviceManager("", nil, vhci, unreachableDialer{})
+	dm.EnableLocalDevices(local)
+	dm.EnableCDI(t.TempDir(), "usbip.example.com")
+	options := ResourceOptions{LazyAttach: true}
+	ids, err := dm.Register("device", options, devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dm.refreshTarget(context.Background(), usbip.Target{Local: true}); err != nil {
+		t.Fatal(err)
+	}
+	up := newTestPlugin(dm)
+	up.options = options
+	return up, local, ids
+}
+
+func TestAllocateReplicas(t *testing.T) {
+	dev := &KnownDevice{
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1050, Product: 0x0407},
+		Replicas: 3,
+	}
+	dm, _, devId := newTestDeviceManager(t, dev)
+	up := newTestPlugin(dm)
+	replicaIds := dev.advertisedIds()
+
+	resp, err := up.Allocate(context.Background(), &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIds: replicaIds[:2]}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if specs := resp.ContainerResponses[0].Devices; len(specs) != 1 {
+		t.Errorf("device should only be exposed once, got %v", specs)
+	}
+	holders := dm.attachedDevices[devId].holders
+	if len(holders) != 2 || !holders[replicaIds[0]] || !holders[replicaIds[1]] {
+		t.Errorf("all requested replicas should be held, got %v", holders)
+	}
+}
+
+func TestPreStartContainerLostDevice(t *testing.T) {
+	up, local, ids := newLazyTestPlugin(t, 1)
+	dm := up.manager
+	devId := ids[0]
+	lost := newAttachment(&usbip.AttachedDevice{
+		USBDevice:    local.devices["1-1"].USBDevice,
+		Target:       usbip.Target{Local: true},
+		DevMountPath: "/dev/bus/usb/001/002",
+	})
+	lost.lostSince = time.Now()
+	dm.attachedDevices[devId] = lost
+
+	// a disconnected device that another container holds can't be handed out
+	lost.holders["other"] = true
+	req := &v1beta1.PreStartContainerRequest{DevicesIds: []string{devId}}
+	if _, err := up.PreStartContainer(context.Background(), req); err == nil {
+		t.Errorf("expected disconnected device held by another container to be refused")
+	}
+
+	// otherwise, it's attached again
+	lost.holders = make(map[string]bool)
+	if _, err := up.PreStartContainer(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	att := dm.attachedDevices[devId]
+	if att == lost || !att.lostSince.IsZero() || att.DevMountPath != local.devices["1-1"].DevMountPath {
+		t.Errorf("expected device to be attached again, got %+v", att.AttachedDevice)
+	}
+	if !att.holders[devId] {
+		t.Errorf("container should hold the device")
+	}
+}
+
+func TestReservationsKeepDevicesAttached(t *testing.T) {
+	up, _, ids := newLazyTestPlugin(t, 1)
+	dm := up.manager
+	devId := ids[0]
+	dm.podResources = &fakePodResources{snapshot: &podResourcesSnapshot{witnesses: map[string]podRef{}}}
+	if _, err := up.PreStartContainer(context.Background(), &v1beta1.PreStartContainerRequest{DevicesIds: []string{devId}}); err != nil {
+		t.Fatal(err)
+	}
+	// the container is gone, and the device has been unused for longer than the grace period
+	dm.attachedDevices[devId].releasedSince = time.Now().Add(-defaultReleaseGracePeriod)
+
+	// another container gets the device, but hasn't started yet
+	if _, err := up.Allocate(context.Background(), &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIds: []string{devId}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dm.attachedDevices[devId]; !ok {
+		t.Fatalf("reserved device should stay attached")
+	}
+
+	// the container never shows up
+	dm.reservations[devId] = time.Now().Add(-reservationTimeout)
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, reserved := dm.reservations[devId]; reserved {
+		t.Errorf("reservation should have expired")
+	}
+	dm.attachedDevices[devId].releasedSince = time.Now().Add(-defaultReleaseGracePeriod)
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dm.attachedDevices[devId]; ok {
+		t.Errorf("device should be released once its reservation expired")
+	}
+}
+
+func TestLazyAttach(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// prepare runs between Allocate and PreStartContainer
+		prepare       func(t *testing.T, up *USBIPPlugin, local *fakeLocalDriver, ids []string)
+		expectFailure bool
+		// attached lists the indices of the devices expected to be attached afterwards
+		attached []int
+	}{
+		{
+			name:     "attach",
+			attached: []int{0, 1},
+		},
+		{
+			name: "partial failure",
+			prepare: func(t *testing.T, up *USBIPPlugin, local *fakeLocalDriver, ids []string) {
+				delete(local.devices, "1-2")
+			},
+			expectFailure: true,
+		},
+		{
+			name: "partial failure with device attached before",
+			prepare: func(t *testing.T, up *USBIPPlugin, local *fakeLocalDriver, ids []string) {
+				if _, err := up.manager.attachDevice(context.Background(), ids[0]); err != nil {
+					t.Fatal(err)
+				}
+				delete(local.devices, "1-2")
+			},
+			expectFailure: true,
+			attached:      []int{0},
+		},
+		{
+			name: "expired reservation",
+			prepare: func(t *testing.T, up *USBIPPlugin, local *fakeLocalDriver, ids []string) {
+				for _, id := range ids {
+					up.manager.reservations[id] = time.Now().Add(-reservationTimeout)
+				}
+				up.manager.podResources = &fakePodResources{snapshot: &podResourcesSnapshot{witnesses: map[string]podRef{}}}
+				if err := up.manager.releaseDevices(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				if len(up.manager.reservations) != 0 {
+					t.Fatalf("reservations should have expired")
+				}
+			},
+			attached: []int{0, 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			up, local, ids := newLazyTestPlugin(t, 2)
+			dm := up.manager
+			res, err := up.Allocate(context.Background(), &v1beta1.AllocateRequest{
+				ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIds: ids}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cdiDevices := res.ContainerResponses[0].CdiDevices; len(cdiDevices) != len(ids) {
+				t.Errorf("expected a CDI device per requested device, got %v", cdiDevices)
+			}
+			if len(dm.attachedDevices) != 0 || len(dm.reservations) != len(ids) {
+				t.Fatalf("devices should only be reserved during allocation")
+			}
+			if tc.prepare != nil {
+				tc.prepare(t, up, local, ids)
+			}
+
+			_, err = up.PreStartContainer(context.Background(), &v1beta1.PreStartContainerRequest{DevicesIds: ids})
+			if (err != nil) != tc.expectFailure {
+				t.Fatalf("unexpected error state: %v", err)
+			}
+			if len(dm.attachedDevices) != len(tc.attached) {
+				t.Errorf("expected %d attached devices, got %d", len(tc.attached), len(dm.attachedDevices))
+			}
+			for _, ix := range tc.attached {
+				att, ok := dm.attachedDevices[ids[ix]]
+				if !ok {
+					t.Errorf("device %d should be attached", ix)
+					continue
+				}
+				if !tc.expectFailure && !att.holders[ids[ix]] {
+					t.Errorf("container should hold device %d", ix)
+				}
+				if _, err := os.Stat(dm.cdi.specPath(ids[ix])); err != nil {
+					t.Errorf("device %d should have a CDI spec: %v", ix, err)
+				}
+			}
+			for ix, id := range ids {
+				if _, ok := dm.attachedDevices[id]; ok {
+					continue
+				}
+				if _, err := os.Stat(dm.cdi.specPath(id)); !os.IsNotExist(err) {
+					t.Errorf("rolled back device %d should not have a CDI spec", ix)
+				}
+			}
+			if len(dm.reservations) != 0 {
+				t.Errorf("reservations should be cleared after the container start, got %v", dm.reservations)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log/level"
+)
+
+// ShutdownPolicy determines what happens to attached devices when the plugin stops.
+type ShutdownPolicy string
+
+const (
+	// ShutdownKeep leaves all devices attached, to be picked up again on the next start.
+	ShutdownKeep ShutdownPolicy = "keep"
+	// ShutdownDetachUnused detaches the devices that no pod holds, and leaves the others attached.
+	ShutdownDetachUnused ShutdownPolicy = "detach-unused"
+	// ShutdownDetachAll detaches all devices, even if containers are still using them.
+	ShutdownDetachAll ShutdownPolicy = "detach-all"
+)
+
+// ShutdownPolicies lists the valid shutdown policies.
+var ShutdownPolicies = []ShutdownPolicy{ShutdownKeep, ShutdownDetachUnused, ShutdownDetachAll}
+
+// ParseShutdownPolicy checks that the given string names a shutdown policy.
+func ParseShutdownPolicy(s string) (ShutdownPolicy, error) {
+	names := make([]string, 0, len(ShutdownPolicies))
+	for _, policy := range ShutdownPolicies {
+		if string(policy) == s {
+			return policy, nil
+		}
+		names = append(names, string(policy))
+	}
+	return "", errors.Newf("unknown shutdown policy %q; possible values are: %s", s, strings.Join(names, ", "))
+}
+
+// stateRecord describes a device that was left attached when the plugin stopped.
+type stateRecord struct {
+	DeviceID string             `json:"device_id"`
+	Port     driver.VirtualPort `json:"port"`
+	Target   usbip.Target       `json:"target"`
+	// Device holds the properties of the device as read from the target, including its bus ID.
+	Device driver.USBDevice `json:"device"`
+}
+
+type persistedState struct {
+	Attachments []stateRecord `json:"attachments"`
+}
+
+// EnableStateFile makes the device manager record the devices it leaves attached on shutdown in the given file,
+// so they are paired with the same device on the next start, even if several devices match the same selector.
+func (dm *DeviceManager) EnableStateFile(path string) {
+	dm.stateFile = path
+}
+
+// loadState reads the devices left attached by the previous run, indexed by port, and removes the state file.
+// The file only describes the VHCI ports right after a clean shutdown, so it's not kept around.
+func (dm *DeviceManager) loadState() map[int]stateRecord {
+	result := make(map[int]stateRecord)
+	if dm.stateFile == "" {
+		return result
+	}
+	content, err := os.ReadFile(dm.stateFile)
+	if os.IsNotExist(err) {
+		return result
+	}
+	if err != nil {
+		_ = level.Warn(dm.logger).Log("msg", "failed to read state file", "path", dm.stateFile, "err", err)
+		return result
+	}
+	var state persistedState
+	if err := json.Unmarshal(content, &state); err != nil {
+		_ = level.Warn(dm.logger).Log("msg", "ignoring malformed state file", "path", dm.stateFile, "err", err)
+		state = persistedState{}
+	}
+	for _, record := range state.Attachments {
+		result[int(record.Port)] = record
+	}
+	if err := os.Remove(dm.stateFile); err != nil {
+		_ = level.Warn(dm.logger).Log("msg", "failed to remove state file", "path", dm.stateFile, "err", err)
+	}
+	return result
+}
+
+// saveState records the attached devices in the state file. The caller must hold dm.mu.
+func (dm *DeviceManager) saveState() error {
+	if dm.stateFile == "" {
+		return nil
+	}
+	state := persistedState{Attachments: make([]stateRecord, 0, len(dm.attachedDevices))}
+	for devId, att := range dm.attachedDevices {
+		// local devices aren't attached to a VHCI port, so there is nothing to pair them with
+		if !att.lostSince.IsZero() || att.Target.Local {
+			continue
+		}
+		state.Attachments = append(state.Attachments, stateRecord{
+			DeviceID: devId,
+			Port:     att.Port,
+			Target:   att.Target,
+			Device:   att.USBDevice,
+		})
+	}
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dm.stateFile), 0o755); err != nil {
+		return errors.Wrap(err, "failed to create state directory")
+	}
+	tmp := dm.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return errors.Wrap(err, "failed to write state file")
+	}
+	return os.Rename(tmp, dm.stateFile)
+}
+
+// Shutdown applies the given policy to the attached devices, and records the devices that remain attached
+// in the state file. From then on, the device manager no longer attaches devices. Shutdown gives up when ctx expires.
+func (dm *DeviceManager) Shutdown(ctx context.Context, policy ShutdownPolicy) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- dm.shutdown(ctx, policy)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if dm.stateFile != "" {
+			_ = level.Warn(dm.logger).Log("msg", "shutdown did not complete in time; devices left attached may not be recorded in the state file", "path", dm.stateFile)
+		}
+		return errors.Wrap(ctx.Err(), "shutdown policy did not complete in time")
+	}
+}
+
+// lockWithin acquires dm.mu, unless ctx expires first. It reports whether the lock was acquired.
+func (dm *DeviceManager) lockWithin(ctx context.Context) bool {
+	locked := make(chan struct{})
+	go func() {
+		dm.mu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return true
+	case <-ctx.Done():
+		// hand the lock back as soon as it's acquired
+		go func() {
+			<-locked
+			dm.mu.Unlock()
+		}()
+		return false
+	}
+}
+
+func (dm *DeviceManager) shutdown(ctx context.Context, policy ShutdownPolicy) error {
+	if !dm.lockWithin(ctx) {
+		_ = level.Warn(dm.logger).Log("msg", "timed out waiting for the device manager; state was not saved", "path", dm.stateFile)
+		return errors.Wrap(ctx.Err(), "timed out waiting for the device manager")
+	}
+	// stop attaching devices in Allocate calls that are still in flight
+	dm.stopped = true
+
+	var toDetach []string
+	switch policy {
+	case ShutdownKeep:
+	case ShutdownDetachAll:
+		for devId := range dm.attachedDevices {
+			toDetach = append(toDetach, devId)
+		}
+	case ShutdownDetachUnused:
+		var err error
+		if toDetach, err = dm.unusedDevices(ctx); err != nil {
+			_ = level.Warn(dm.logger).Log("msg", "failed to determine unused devices; leaving all devices attached", "err", err)
+		}
+	default:
+		dm.mu.Unlock()
+		return errors.Newf("unknown shutdown policy %q", policy)
+	}
+	due := make([]pendingRelease, 0, len(toDetach))
+	for _, devId := range toDetach {
+		att := dm.attachedDevices[devId]
+		if att.releasing {
+			// a refresh is already releasing the device
+			continue
+		}
+		due = append(due, dm.newPendingRelease(devId, att))
+	}
+	dm.mu.Unlock()
+
+	dm.runPreDetachHooks(ctx, due)
+
+	if !dm.lockWithin(ctx) {
+		_ = level.Warn(dm.logger).Log("msg", "timed out waiting for the device manager after pre-detach hooks; state was not saved", "path", dm.stateFile)
+		return errors.Wrap(ctx.Err(), "timed out waiting for the device manager")
+	}
+	defer dm.mu.Unlock()
+	var err error
+	for _, pending := range due {
+		devId, att := pending.devId, pending.att
+		att.releasing = false
+		if ctx.Err() != nil || dm.attachedDevices[devId] != att {
+			continue
+		}
+		if policy == ShutdownDetachUnused && len(att.holders) > 0 {
+			_ = level.Info(dm.logger).Log("msg", "device was allocated during pre-detach hook; not detaching", "devId", devId)
+			continue
+		}
+		_ = level.Info(dm.logger).Log("msg", "detaching device on shutdown", "devId", devId, "port", att.Port, "holders", len(att.holders))
+		if detachErr := dm.detachReleased(ctx, devId, att); detachErr != nil {
+			_ = dm.logger.Log("msg", fmt.Sprintf("failed to detach %s", devId), "err", detachErr)
+			err = detachErr
+			continue
+		}
+		dm.forgetAttached(devId)
+	}
+	for devId, att := range dm.attachedDevices {
+		_ = level.Info(dm.logger).Log("msg", "leaving device attached", "devId", devId, "port", att.Port)
+	}
+	if saveErr := dm.saveState(); saveErr != nil {
+		_ = level.Warn(dm.logger).Log("msg", "failed to save state", "path", dm.stateFile, "err", saveErr)
+	}
+	if err != nil {
+		return errors.Wrap(err, "there were errors detaching some devices")
+	}
+	return ctx.Err()
+}
+
+// unusedDevices lists the attached devices that no pod holds according to the kubelet. Only devices that were already
+// seen unused during an earlier refresh qualify, so devices allocated to pods that the kubelet doesn't report yet
+// stay attached. The caller must hold dm.mu.
+func (dm *DeviceManager) unusedDevices(ctx context.Context) ([]string, error) {
+	if len(dm.attachedDevices) == 0 {
+		return nil, nil
+	}
+	snapshot, err := dm.podResources.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[string]bool, len(snapshot.witnesses))
+	for advertisedId := range snapshot.witnesses {
+		inUse[dm.deviceId(advertisedId)] = true
+	}
+	result := make([]string, 0)
+	for devId, att := range dm.attachedDevices {
+		if _, reserved := dm.reservations[devId]; reserved || inUse[devId] || att.releasedSince.IsZero() || dm.kubeletLagsBehind(snapshot, devId) {
+			continue
+		}
+		result = append(result, devId)
+	}
+	return result, nil
+}
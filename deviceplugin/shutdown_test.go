@@ -0,0 +1,188 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+)
+
+func TestShutdownPolicies(t *testing.T) {
+	if _, err := ParseShutdownPolicy("detach-some"); err == nil {
+		t.Errorf("expected unknown policy to be rejected")
+	}
+	newDevice := func() *KnownDevice {
+		return &KnownDevice{
+			Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+			Selector: driver.USBDevice{Vendor: 0x1050, Product: 0x0407},
+		}
+	}
+
+	t.Run("detach-unused", func(t *testing.T) {
+		dm, vhci, devId := newTestDeviceManager(t, newDevice())
+		pods := &fakePodResources{snapshot: &podResourcesSnapshot{
+			witnesses: map[string]podRef{devId: {Namespace: "default", Name: "pod"}},
+		}}
+		dm.podResources = pods
+		if err := dm.Shutdown(context.Background(), ShutdownDetachUnused); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := dm.attachedDevices[devId]; !ok || vhci.slots[0].IsEmpty() {
+			t.Fatalf("device held by a pod should stay attached")
+		}
+
+		// unused, but not seen unused before: the pod may not have shown up yet
+		pods.snapshot = &podResourcesSnapshot{witnesses: map[string]podRef{}}
+		if err := dm.Shutdown(context.Background(), ShutdownDetachUnused); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := dm.attachedDevices[devId]; !ok {
+			t.Fatalf("device that was only just released should stay attached")
+		}
+
+		dm.attachedDevices[devId].releasedSince = time.Now()
+		if err := dm.Shutdown(context.Background(), ShutdownDetachUnused); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := dm.attachedDevices[devId]; ok || !vhci.slots[0].IsEmpty() {
+			t.Errorf("unused device should have been detached")
+		}
+	})
+
+	t.Run("detach-all", func(t *testing.T) {
+		dm, vhci, devId := newTestDeviceManager(t, newDevice())
+		if err := dm.Shutdown(context.Background(), ShutdownDetachAll); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := dm.attachedDevices[devId]; ok || !vhci.slots[0].IsEmpty() {
+			t.Errorf("device should have been detached")
+		}
+		if _, err := dm.attachDevice(context.Background(), devId); err == nil {
+			t.Errorf("devices should no longer be attached after shutdown")
+		}
+	})
+}
+
+func TestShutdownHooks(t *testing.T) {
+	dm, vhci, devId := newTestDeviceManager(t, &KnownDevice{
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1050, Product: 0x0407},
+	})
+	var ran, locked bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ran = true
+		// the hook must not run under the device manager lock
+		if locked = !dm.mu.TryLock(); !locked {
+			dm.mu.Unlock()
+		}
+	}))
+	defer srv.Close()
+	dm.resourceOptions["device"] = ResourceOptions{PreDetachHook: &PreDetachHook{HTTP: &HTTPHook{URL: srv.URL}}}
+
+	if err := dm.Shutdown(context.Background(), ShutdownDetachAll); err != nil {
+		t.Fatal(err)
+	}
+	if !ran || locked {
+		t.Errorf("pre-detach hook should have run without the lock (ran: %v, locked: %v)", ran, locked)
+	}
+	if _, ok := dm.attachedDevices[devId]; ok || !vhci.slots[0].IsEmpty() {
+		t.Errorf("device should have been detached")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	dm, _, _ := newTestDeviceManager(t, &KnownDevice{
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1050, Product: 0x0407},
+	})
+	dm.EnableStateFile(stateFile)
+
+	// e.g. an import that's taking its time
+	dm.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := dm.Shutdown(ctx, ShutdownKeep); err == nil {
+		t.Errorf("expected shutdown to time out")
+	}
+	dm.mu.Unlock()
+
+	// the abandoned shutdown must neither hold on to the lock nor save the state later on
+	time.Sleep(50 * time.Millisecond)
+	dm.mu.Lock()
+	stopped := dm.stopped
+	dm.mu.Unlock()
+	if stopped {
+		t.Errorf("abandoned shutdown should not have gone ahead")
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("state should not be saved after shutdown gave up")
+	}
+	if err := dm.Shutdown(context.Background(), ShutdownKeep); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stateFile); err != nil {
+		t.Errorf("state should be saved: %v", err)
+	}
+}
+
+func TestShutdownState(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state", "state.json")
+	target := usbip.Target{Host: "usbip.example.com", Port: 3240}
+	selector := driver.USBDevice{Vendor: 0x1050, Product: 0x0407}
+	newDevices := func() []*KnownDevice {
+		// two devices that both match the attached device
+		return []*KnownDevice{
+			{StableID: "first", Target: target, Selector: selector},
+			{StableID: "second", Target: target, Selector: selector},
+		}
+	}
+	vhci := &fakeVHCIDriver{slots: []driver.VHCISlot{
+		{Port: 0, Status: driver.VDevStatusUsed, DevMountPath: "/dev/bus/usb/002/033", LocalDeviceInfo: selector},
+	}}
+
+	dm := NewDeviceManager("", nil, vhci, nil)
+	dm.EnableStateFile(stateFile)
+	ids, err := dm.Register("key", ResourceOptions{}, newDevices())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm.attachedDevices[ids[1]] = newAttachment(&usbip.AttachedDevice{
+		USBDevice: driver.USBDevice{Vendor: 0x1050, Product: 0x0407, BusId: "1-1.2"},
+		Target:    target,
+		Port:      0,
+	})
+	if err := dm.Shutdown(context.Background(), ShutdownKeep); err != nil {
+		t.Fatal(err)
+	}
+	if vhci.slots[0].IsEmpty() {
+		t.Fatalf("device should have been left attached")
+	}
+
+	dm = NewDeviceManager("", nil, vhci, nil)
+	dm.EnableStateFile(stateFile)
+	if _, err := dm.Register("key", ResourceOptions{}, newDevices()); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.enumerateAttachedDevices(); err != nil {
+		t.Fatal(err)
+	}
+	att, ok := dm.attachedDevices[ids[1]]
+	if !ok || len(dm.attachedDevices) != 1 {
+		t.Fatalf("attached device should be paired with the recorded device, got %v", dm.attachedDevices)
+	}
+	if att.BusId != "1-1.2" || att.DevMountPath != "/dev/bus/usb/002/033" {
+		t.Errorf("unexpected attachment %+v", att.AttachedDevice)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("state file should be removed once loaded")
+	}
+}
@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// testSpans records the spans of all tests. Tracers obtained from the global provider
+// only ever delegate to the first provider that is set, so this is done once.
+var testSpans = tracetest.NewInMemoryExporter()
+
+func init() {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(testSpans)))
+}
+
+func TestAllocateSpans(t *testing.T) {
+	testSpans.Reset()
+	dev := &KnownDevice{
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1234, Product: 0x5678},
+	}
+	dm := NewDeviceManager("", nil, &fakeVHCIDriver{}, unreachableDialer{})
+	ids, err := dm.Register("device", ResourceOptions{}, []*KnownDevice{dev})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.available = true
+	up := &USBIPPlugin{resource: "usbip.example.com/device", deviceGroup: "device", manager: dm, logger: dm.logger}
+	_, err = up.Allocate(context.Background(), &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIds: ids}},
+	})
+	if err == nil {
+		t.Fatalf("expected allocation to fail")
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range testSpans.GetSpans() {
+		spans[span.Name] = span
+	}
+	allocate, ok := spans["USBIPPlugin.Allocate"]
+	if !ok {
+		t.Fatalf("no Allocate span in %v", spans)
+	}
+	importSpan, ok := spans["usbip.Import"]
+	if !ok {
+		t.Fatalf("no Import span in %v", spans)
+	}
+	dial, ok := spans["usbip.Dial"]
+	if !ok {
+		t.Fatalf("no Dial span in %v", spans)
+	}
+	if importSpan.Parent.SpanID() != allocate.SpanContext.SpanID() {
+		t.Errorf("Import span should be a child of the Allocate span")
+	}
+	if dial.Parent.SpanID() != importSpan.SpanContext.SpanID() {
+		t.Errorf("Dial span should be a child of the Import span")
+	}
+	for _, span := range []tracetest.SpanStub{allocate, importSpan, dial} {
+		if span.Status.Code != codes.Error {
+			t.Errorf("span %s should record the failure, got status %v", span.Name, span.Status)
+		}
+	}
+}
+
+func TestRefreshSpans(t *testing.T) {
+	testSpans.Reset()
+	dm := NewDeviceManager("", nil, &fakeVHCIDriver{}, unreachableDialer{})
+	_, err := dm.Register("device", ResourceOptions{}, []*KnownDevice{
+		{Target: usbip.Target{Host: "usbip.example.com", Port: 3240}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dm.refreshDevices(context.Background()); err == nil {
+		t.Fatalf("expected refresh to fail")
+	}
+	spans := testSpans.GetSpans()
+	if len(spans) != 2 || spans[0].Name != "DeviceManager.refreshTarget" || spans[1].Name != "DeviceManager.refreshDevices" {
+		t.Fatalf("unexpected spans %v", spans)
+	}
+	if spans[0].Parent.SpanID() != spans[1].SpanContext.SpanID() {
+		t.Errorf("refreshTarget span should be a child of the refreshDevices span")
+	}
+}
@@ -24,7 +24,11 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"net"
+	"regexp"
+	"strconv"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
@@ -33,38 +37,248 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/oklog/run"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
-	v1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
 )
 
 const (
 	deviceCheckInterval = 10 * time.Second
+	// defaultReleaseGracePeriod is the time a device must remain unused before it is detached,
+	// to avoid detaching devices based on incomplete data from the kubelet.
+	defaultReleaseGracePeriod = 30 * time.Second
+	// defaultReattachBackoff is the time to wait before the first attempt to re-attach a disconnected device.
+	defaultReattachBackoff = time.Second
+	// maxReattachBackoff caps the time between attempts to re-attach a disconnected device.
+	maxReattachBackoff = time.Minute
+	// reservationTimeout is the time after which a device reserved in lazy attach mode is no longer
+	// kept attached for its container, unless the kubelet reports a pod holding the device.
+	reservationTimeout = 2 * time.Minute
 )
 
+// ResourceOptions holds settings that apply to all devices exposed under a single resource name.
+type ResourceOptions struct {
+	// LazyAttach defers the USB/IP import of a device from Allocate to PreStartContainer.
+	LazyAttach bool `json:"lazy_attach"`
+	// EnvPrefix is the prefix of the environment variables describing the allocated devices.
+	// Defaults to USBIP_DEVICE.
+	EnvPrefix string `json:"env_prefix"`
+	// ReleaseGracePeriod is the time a device must remain unused before it is detached.
+	// Defaults to 30 seconds.
+	ReleaseGracePeriod *time.Duration `json:"release_grace_period"`
+	// PreDetachHook is run before a released device is detached.
+	PreDetachHook *PreDetachHook `json:"pre_detach_hook"`
+	// ReattachLost makes the plugin import devices that were disconnected while in use again,
+	// once their target offers them again.
+	ReattachLost bool `json:"reattach_lost"`
+	// ReattachBackoff is the time to wait before the first attempt to re-attach a disconnected device.
+	// It doubles after every failed attempt, up to a minute. Defaults to 1 second.
+	ReattachBackoff *time.Duration `json:"reattach_backoff"`
+}
+
+func (o *ResourceOptions) releaseGracePeriod() time.Duration {
+	if o.ReleaseGracePeriod == nil {
+		return defaultReleaseGracePeriod
+	}
+	return *o.ReleaseGracePeriod
+}
+
+func (o *ResourceOptions) reattachBackoff() time.Duration {
+	if o.ReattachBackoff == nil {
+		return defaultReattachBackoff
+	}
+	return *o.ReattachBackoff
+}
+
+var envPrefixPattern = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// Validate checks the options for consistency.
+func (o *ResourceOptions) Validate() error {
+	if o.EnvPrefix != "" && !envPrefixPattern.MatchString(o.EnvPrefix) {
+		return errors.Newf("invalid environment variable prefix %q", o.EnvPrefix)
+	}
+	if o.ReleaseGracePeriod != nil && *o.ReleaseGracePeriod < 0 {
+		return errors.New("release grace period must not be negative")
+	}
+	if o.ReattachBackoff != nil && *o.ReattachBackoff <= 0 {
+		return errors.New("re-attach backoff must be positive")
+	}
+	if o.PreDetachHook != nil {
+		if err := o.PreDetachHook.Validate(); err != nil {
+			return errors.Wrap(err, "invalid pre-detach hook")
+		}
+	}
+	return nil
+}
+
+// ResourceConfig describes a resource and its devices in the configuration file.
+type ResourceConfig struct {
+	ResourceOptions `json:",squash"`
+	Devices         []*KnownDevice `json:"devices"`
+}
+
 type KnownDevice struct {
-	Target         usbip.Target         `json:"target"`
-	Selector       driver.USBDevice     `json:"selector"`
-	ExtraDevices   []v1beta1.DeviceSpec `json:"extras"`
-	readProperties driver.USBDevice
-	available      bool
+	// StableID fixes the ID under which the device is advertised to the kubelet.
+	// By default, the ID is derived from the target and the selector.
+	StableID string `json:"id,omitempty"`
+	// Name is a human-readable name for the device, defaulting to <resource>-<index>.
+	Name         string               `json:"name,omitempty"`
+	Target       usbip.Target         `json:"target"`
+	Selector     driver.USBDevice     `json:"selector"`
+	ExtraDevices []v1beta1.DeviceSpec `json:"extras"`
+	// CDI holds additional container edits to include in the CDI spec for this device.
+	CDI *cdispec.ContainerEdits `json:"cdi,omitempty"`
+	// ContainerPath is a template for the path of the USB device node inside the container.
+	// Defaults to the path of the device node on the host.
+	ContainerPath string `json:"container_path,omitempty"`
+	// InterfacePath is a template for the paths of interface device nodes (tty, hidraw) inside the
+	// container. Defaults to the path of the node on the host.
+	InterfacePath string `json:"interface_path,omitempty"`
+	// Replicas is the number of containers that can share the device on a single node.
+	// Each replica is advertised as a separate device to the kubelet.
+	Replicas int `json:"replicas,omitempty"`
+	// Permissions are the cgroup permissions of the USB device node and its interface nodes,
+	// e.g. r for read-only access. Defaults to mrw.
+	Permissions string `json:"permissions,omitempty"`
+	// ReadOnly only grants containers read access to the device, its interface nodes and its extras.
+	// Permissions that allow more are rejected.
+	ReadOnly bool `json:"read_only,omitempty"`
+	id       string
+	// legacyId is the ID that versions before StableID was introduced assigned to the device.
+	legacyId          string
+	resource          string
+	containerPathTmpl *template.Template
+	interfacePathTmpl *template.Template
+	readProperties    driver.USBDevice
+	available         bool
+	// lastSeen is the last time the device was offered by its target.
+	lastSeen time.Time
+	// retired is set on devices that were unregistered while still attached.
+	retired bool
+	// cordoned devices are not advertised to the kubelet.
+	cordoned bool
+}
+
+var stableIdPattern = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$")
+
+// deviceIdentity holds the fields a device ID is derived from. Other fields can be
+// changed without affecting running pods that were allocated the device.
+type deviceIdentity struct {
+	Target   usbip.Target     `json:"target"`
+	Selector driver.USBDevice `json:"selector"`
+}
+
+// deviceIdSource is the representation of a KnownDevice that legacy device IDs were derived from.
+// It predates the hexadecimal JSON encoding of USB IDs, so it encodes them as numbers.
+type deviceIdSource struct {
+	Name     string       `json:"name,omitempty"`
+	Target   usbip.Target `json:"target"`
+	Selector struct {
+		Vendor  uint16 `json:"vendor"`
+		Product uint16 `json:"product"`
+		BusId   string `json:"bus_id"`
+	} `json:"selector"`
+	ExtraDevices  []v1beta1.DeviceSpec    `json:"extras"`
+	CDI           *cdispec.ContainerEdits `json:"cdi,omitempty"`
+	ContainerPath string                  `json:"container_path,omitempty"`
+	InterfacePath string                  `json:"interface_path,omitempty"`
+	Replicas      int                     `json:"replicas,omitempty"`
+}
+
+func newDeviceIdSource(kd *KnownDevice) deviceIdSource {
+	src := deviceIdSource{
+		Name:          kd.Name,
+		Target:        kd.Target,
+		ExtraDevices:  kd.ExtraDevices,
+		CDI:           kd.CDI,
+		ContainerPath: kd.ContainerPath,
+		InterfacePath: kd.InterfacePath,
+		Replicas:      kd.Replicas,
+	}
+	src.Selector.Vendor = uint16(kd.Selector.Vendor)
+	src.Selector.Product = uint16(kd.Selector.Product)
+	src.Selector.BusId = kd.Selector.BusId
+	return src
+}
+
+// allocatable checks whether the device can be allocated to a container.
+func (kd *KnownDevice) allocatable() bool {
+	return kd.available && !kd.cordoned
+}
+
+// ID returns the ID of the device assigned in Register.
+func (kd *KnownDevice) ID() string {
+	return kd.id
 }
 
 func (kd *KnownDevice) SelectorMatches(cand driver.USBDevice) bool {
-	selector := kd.Selector
-	return (selector.BusId == "" || cand.BusId == "" || selector.BusId == cand.BusId) &&
-		(selector.Vendor == 0 || selector.Vendor == cand.Vendor) &&
-		(selector.Product == 0 || selector.Product == cand.Product)
+	return kd.Selector.Matches(cand)
+}
+
+// attachment is a device attached to this node, along with the replicas of the device
+// that are currently allocated to containers.
+type attachment struct {
+	*usbip.AttachedDevice
+	holders map[string]bool
+	// releasedSince is the time at which the device was first seen not to be in use by any pod,
+	// or zero if it is in use.
+	releasedSince time.Time
+	// pods holds the pods that were last seen holding the device.
+	pods []podRef
+	// lostSince is the time at which the device was found disconnected from its VHCI port, or zero.
+	lostSince time.Time
+	// reattaching is set while a goroutine tries to re-attach the disconnected device.
+	reattaching bool
+	// releasing is set while the pre-detach hook of the released device runs.
+	releasing bool
+}
+
+func newAttachment(attachedDevice *usbip.AttachedDevice) *attachment {
+	return &attachment{AttachedDevice: attachedDevice, holders: make(map[string]bool)}
 }
 
 type DeviceManager struct {
-	vhciDriver         driver.VHCIDriver
-	dialer             usbip.Dialer
-	knownDevices       map[string]*KnownDevice
-	attachedDevices    map[string]*usbip.AttachedDevice
+	vhciDriver      driver.VHCIDriver
+	dialer          usbip.Dialer
+	knownDevices    map[string]*KnownDevice
+	attachedDevices map[string]*attachment
+	replicaIds      map[string]string
+	// legacyIds maps the legacy advertised IDs of attached devices to their current device ID,
+	// so allocations made by earlier versions are still accounted for.
+	legacyIds    map[string]string
+	podResources podResourcesSource
+	reservations map[string]time.Time
+	// advertised holds the advertised IDs that the plugins last sent to the kubelet.
+	advertised         map[string]bool
+	resourceOptions    map[string]ResourceOptions
 	podResourcesSocket string
 	logger             log.Logger
 	mu                 sync.Mutex
 	subscribers        []chan []string
+	stopped            bool
+	cdi                *cdiConfig
+	events             *deviceEvents
+	targetStates       map[usbip.Target]*TargetState
+	nodeStatus         *nodeStatusPublisher
+	metrics            *deviceMetrics
+	health             *healthState
+	stateFile          string
+	links              *deviceLinks
+	local              driver.LocalDriver
+}
+
+// TargetState tracks the reachability of a USB/IP target.
+type TargetState struct {
+	Reachable bool
+	// Since is the time at which the target was first seen in its current reachability state.
+	Since time.Time
+	// LastSeen is the last time the target responded to a device list request.
+	LastSeen time.Time
+	// LastError is the error encountered during the last unsuccessful refresh.
+	LastError error
 }
 
 func NewDeviceManager(podResourcesSocket string, logger log.Logger, vhci driver.VHCIDriver, dialer usbip.Dialer) *DeviceManager {
@@ -73,21 +287,65 @@ func NewDeviceManager(podResourcesSocket string, logger log.Logger, vhci driver.
 	}
 	return &DeviceManager{
 		knownDevices:       make(map[string]*KnownDevice),
-		attachedDevices:    make(map[string]*usbip.AttachedDevice),
+		attachedDevices:    make(map[string]*attachment),
+		replicaIds:         make(map[string]string),
+		legacyIds:          make(map[string]string),
+		reservations:       make(map[string]time.Time),
+		advertised:         make(map[string]bool),
+		targetStates:       make(map[usbip.Target]*TargetState),
+		resourceOptions:    make(map[string]ResourceOptions),
 		podResourcesSocket: podResourcesSocket,
+		podResources:       &kubeletPodResources{socket: podResourcesSocket},
 		logger:             logger,
 		subscribers:        make([]chan []string, 0),
-		vhciDriver:         vhci,
+		vhciDriver:         &lockedVHCIDriver{driver: vhci},
 		dialer:             dialer,
+		metrics:            newDeviceMetrics(),
+		health:             newHealthState(),
 	}
 }
 
+// EnableCDI makes the device manager maintain CDI specs for attached devices in specDir.
+// Device kinds are derived from the domain and the resource name.
+func (dm *DeviceManager) EnableCDI(specDir string, domain string) {
+	dm.cdi = &cdiConfig{specDir: specDir, domain: domain}
+}
+
+// EnableNodeStatus makes the device manager publish the reachability of USB/IP targets
+// on the node object, as labels and annotations under the given domain.
+func (dm *DeviceManager) EnableNodeStatus(client kubernetes.Interface, nodeName string, domain string) {
+	dm.nodeStatus = newNodeStatusPublisher(client, nodeName, domain, dm.logger)
+}
+
+// EnableEvents makes the device manager emit Kubernetes events about the devices on the given node.
+// The pod resolver is optional, and used to attach events to the pods holding a device.
+func (dm *DeviceManager) EnableEvents(recorder record.EventRecorder, nodeName string, resolvePod PodResolver) {
+	dm.events = newDeviceEvents(recorder, nodeName, resolvePod, dm.logger)
+}
+
+// EnableMetrics registers the device manager's metrics, including an info metric
+// describing the devices attached to the given node.
+func (dm *DeviceManager) EnableMetrics(reg prometheus.Registerer, nodeName string) {
+	reg.MustRegister(dm.metrics.collectors()...)
+	reg.MustRegister(&deviceInfoCollector{dm: dm, nodeName: nodeName})
+}
+
+// EnableLocalDevices makes the device manager offer the USB devices plugged into the node itself
+// for devices with a local target. Local devices are passed to containers without going through USB/IP.
+func (dm *DeviceManager) EnableLocalDevices(local driver.LocalDriver) {
+	dm.local = local
+}
+
+func (dm *DeviceManager) CDIEnabled() bool {
+	return dm.cdi != nil
+}
+
 func (dm *DeviceManager) Targets() []usbip.Target {
 	targetsSeen := map[usbip.Target]bool{}
 	targets := make([]usbip.Target, 0)
 	for _, dev := range dm.knownDevices {
 		_, seen := targetsSeen[dev.Target]
-		if !seen {
+		if !seen && !dev.retired {
 			targetsSeen[dev.Target] = true
 			targets = append(targets, dev.Target)
 		}
@@ -95,43 +353,237 @@ func (dm *DeviceManager) Targets() []usbip.Target {
 	return targets
 }
 
-func (dm *DeviceManager) Register(resourceName string, knownDevices []*KnownDevice) ([]string, error) {
+// Register adds devices under the given resource name, and returns the device IDs
+// to advertise to the kubelet. Devices with replicas are advertised once per replica.
+func (dm *DeviceManager) Register(resourceName string, options ResourceOptions, knownDevices []*KnownDevice) ([]string, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
 	devices := dm.knownDevices
-	ids := make([]string, len(knownDevices))
+	dm.resourceOptions[resourceName] = options
+	ids := make([]string, 0, len(knownDevices))
+	registered := make(map[string]*KnownDevice, len(knownDevices))
 	for ix, devPtr := range knownDevices {
 		if devPtr == nil {
 			continue
 		}
 		dev := *devPtr
-		idJson, err := json.Marshal(dev)
+		if devPtr.Name == "" {
+			devPtr.Name = fmt.Sprintf("%s-%d", resourceName, ix)
+		}
+		if err := devPtr.parsePathTemplates(); err != nil {
+			return nil, errors.Wrapf(err, "invalid device %s", devPtr.Name)
+		}
+		if err := devPtr.validatePermissions(); err != nil {
+			return nil, errors.Wrapf(err, "invalid device %s", devPtr.Name)
+		}
+		id, err := deviceIdFor(resourceName, devPtr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid device %s", devPtr.Name)
+		}
+		if other, ok := registered[id]; ok {
+			if devPtr.StableID != "" {
+				return nil, errors.Newf("devices %s and %s have the same id %q", other.Name, devPtr.Name, devPtr.StableID)
+			}
+			return nil, errors.Newf("devices %s and %s have the same target and selector; set an explicit id on each", other.Name, devPtr.Name)
+		}
+		registered[id] = devPtr
+		legacyJson, err := json.Marshal(newDeviceIdSource(&dev))
 		if err != nil {
 			return nil, fmt.Errorf("failed to marshal device %v: %v", dev, err)
 		}
-		id := fmt.Sprintf("%s_%x", resourceName, sha256.Sum256(idJson))
-		ids[ix] = id
+		devPtr.id = id
+		devPtr.legacyId = fmt.Sprintf("%s_%x", resourceName, sha256.Sum256(legacyJson))
+		devPtr.resource = resourceName
+		if previous, ok := devices[id]; ok {
+			// re-registration of a device, e.g. one that was unregistered while still attached
+			devPtr.available = previous.available
+			devPtr.readProperties = previous.readProperties
+			devPtr.lastSeen = previous.lastSeen
+			devPtr.cordoned = previous.cordoned
+		}
 		devices[id] = devPtr
+		for _, advertisedId := range devPtr.advertisedIds() {
+			if advertisedId != id {
+				dm.replicaIds[advertisedId] = id
+			}
+			ids = append(ids, advertisedId)
+		}
 	}
 	return ids, nil
 }
 
+// deviceIdFor computes the ID of a device, either from its explicit ID or from its identity.
+func deviceIdFor(resourceName string, kd *KnownDevice) (string, error) {
+	if kd.StableID != "" {
+		if !stableIdPattern.MatchString(kd.StableID) {
+			return "", errors.Newf("invalid id %q: must consist of at most 63 alphanumeric characters, '.', '_' or '-', starting with an alphanumeric character", kd.StableID)
+		}
+		return resourceName + "_" + kd.StableID, nil
+	}
+	identity, err := json.Marshal(deviceIdentity{Target: kd.Target, Selector: kd.Selector})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s_%x", resourceName, sha256.Sum256(identity)), nil
+}
+
+// Unregister removes a device added through Register, so it is no longer advertised.
+// A device that is attached stays attached until it is released.
+func (dm *DeviceManager) Unregister(devId string) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	kd, ok := dm.knownDevices[devId]
+	if !ok {
+		return
+	}
+	delete(dm.reservations, devId)
+	if _, attached := dm.attachedDevices[devId]; attached {
+		kd.retired = true
+		kd.available = false
+		return
+	}
+	dm.forgetDevice(devId)
+}
+
+// forgetDevice removes a device that is not attached from the device manager.
+func (dm *DeviceManager) forgetDevice(devId string) {
+	kd := dm.knownDevices[devId]
+	for _, advertisedId := range kd.advertisedIds() {
+		delete(dm.replicaIds, advertisedId)
+	}
+	delete(dm.knownDevices, devId)
+}
+
+// selectableDevices returns the devices registered for the given resource, keyed by
+// the ID under which they are advertised. The caller must hold dm.mu.
+func (dm *DeviceManager) selectableDevices(resourceName string) map[string]*KnownDevice {
+	result := make(map[string]*KnownDevice)
+	for _, kd := range dm.knownDevices {
+		if kd.resource != resourceName || kd.retired {
+			continue
+		}
+		for _, advertisedId := range kd.advertisedIds() {
+			result[advertisedId] = kd
+		}
+	}
+	return result
+}
+
+// Options returns the options the given resource was registered with.
+func (dm *DeviceManager) Options(resourceName string) ResourceOptions {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	return dm.resourceOptions[resourceName]
+}
+
+// subscribe registers a channel to be notified of changed devices.
+func (dm *DeviceManager) subscribe() chan []string {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	// a pending notification is enough to make the subscriber look at the current state,
+	// so there's no need to queue more than one
+	sub := make(chan []string, 1)
+	dm.subscribers = append(dm.subscribers, sub)
+	return sub
+}
+
+// Notify informs subscribers that the given devices changed, e.g. after devices were
+// registered or unregistered at runtime. It never blocks.
+func (dm *DeviceManager) Notify(changedDevices []string) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.notify(changedDevices)
+}
+
+func (dm *DeviceManager) notify(changedDevices []string) {
+	if dm.stopped {
+		return
+	}
+	for _, sub := range dm.subscribers {
+		select {
+		case sub <- changedDevices:
+		default:
+		}
+	}
+}
+
+// advertisedIds returns the IDs under which the device is advertised to the kubelet.
+func (kd *KnownDevice) advertisedIds() []string {
+	return kd.replicasOf(kd.id)
+}
+
+// replicasOf returns the advertised IDs for the replicas of the device under the given ID.
+func (kd *KnownDevice) replicasOf(id string) []string {
+	if kd.Replicas <= 1 {
+		return []string{id}
+	}
+	ids := make([]string, kd.Replicas)
+	for replica := range ids {
+		ids[replica] = fmt.Sprintf("%s-%d", id, replica)
+	}
+	return ids
+}
+
+// deviceId resolves an advertised device ID, which may refer to a replica or be a
+// legacy ID, to the ID of the underlying device.
+func (dm *DeviceManager) deviceId(advertisedId string) string {
+	if id, ok := dm.replicaIds[advertisedId]; ok {
+		return id
+	}
+	if id, ok := dm.legacyIds[advertisedId]; ok {
+		return id
+	}
+	return advertisedId
+}
+
+// migrateLegacyIds makes the legacy IDs of an attached device resolve to the device, so pods
+// that were allocated the device by an earlier version keep it attached.
+func (dm *DeviceManager) migrateLegacyIds(devId string) {
+	kd := dm.knownDevices[devId]
+	if kd.legacyId == "" || kd.legacyId == devId {
+		return
+	}
+	_ = level.Info(dm.logger).Log("msg", "migrating legacy device ID", "legacyId", kd.legacyId, "devId", devId)
+	for _, legacyId := range kd.replicasOf(kd.legacyId) {
+		dm.legacyIds[legacyId] = devId
+	}
+}
+
+// dropLegacyIds removes the legacy IDs of a device once it is detached. From then on,
+// it's only allocated under its current ID.
+func (dm *DeviceManager) dropLegacyIds(devId string) {
+	for legacyId, id := range dm.legacyIds {
+		if id == devId {
+			delete(dm.legacyIds, legacyId)
+		}
+	}
+	kd, ok := dm.knownDevices[devId]
+	if dm.cdi != nil && ok && kd.legacyId != "" && kd.legacyId != devId {
+		if err := dm.cdi.removeSpec(kd.legacyId); err != nil {
+			_ = dm.logger.Log("msg", "failed to remove legacy CDI spec", "devId", devId, "err", err)
+		}
+	}
+}
+
 func (dm *DeviceManager) AddRefreshJob(group *run.Group) {
 	cancel := make(chan struct{})
 	group.Add(
 		func() error {
 			_ = dm.logger.Log("msg", "starting refresh job")
+			dm.health.refreshJobRunning(true)
+			defer dm.health.refreshJobRunning(false)
 			for {
 				select {
 				case <-time.After(deviceCheckInterval):
 					_ = level.Debug(dm.logger).Log("msg", "scheduled device refresh...")
-					changedDevices, err := dm.refreshDevices()
+					dm.health.refreshTick()
+					changedDevices, err := dm.refreshDevices(context.Background())
+					dm.nodeStatus.publish(dm.TargetStates())
 					if err != nil {
 						_ = dm.logger.Log("msg", "error refreshing devices", "err", err)
 						continue
 					}
-					for _, sub := range dm.subscribers {
-						// we assume this doesn't block _too_ much
-						sub <- changedDevices
-					}
+					dm.Notify(changedDevices)
 				case <-cancel:
 					return nil
 				}
@@ -139,6 +591,9 @@ func (dm *DeviceManager) AddRefreshJob(group *run.Group) {
 		},
 		func(error) {
 			close(cancel)
+			dm.mu.Lock()
+			defer dm.mu.Unlock()
+			dm.stopped = true
 			for _, sub := range dm.subscribers {
 				close(sub)
 			}
@@ -150,40 +605,50 @@ func (dm *DeviceManager) Start() error {
 	if err := dm.enumerateAttachedDevices(); err != nil {
 		return errors.Wrapf(err, "Failed to enumerate attached devices.")
 	}
+	for devId, att := range dm.attachedDevices {
+		if err := dm.prepareAttached(devId, att.AttachedDevice); err != nil {
+			_ = dm.logger.Log("msg", "failed to prepare previously attached device", "devId", devId, "err", err)
+		}
+	}
+	refreshed := false
 	for i := 0; i < 10; i++ {
 		_ = dm.logger.Log("msg", "Refreshing USB/IP devices...")
-		if _, err := dm.refreshDevices(); err == nil {
+		if _, err := dm.refreshDevices(context.Background()); err == nil {
+			refreshed = true
 			break
 		}
 		_ = dm.logger.Log("msg", "Device refresh failed, sleeping for a while...")
 		time.Sleep(10 * time.Second)
 	}
+	if !refreshed {
+		_ = level.Warn(dm.logger).Log("msg", "giving up on initial device refresh; will keep trying in the background")
+	}
 
 	_ = dm.logger.Log("msg", "device manager ready")
 	return nil
 }
 
-func (dm *DeviceManager) refreshTarget(target usbip.Target) ([]string, error) {
-	conn, err := dm.dialer.Dial(target)
-
+func (dm *DeviceManager) refreshTarget(ctx context.Context, target usbip.Target) (_ []string, err error) {
+	_, span := tracer.Start(ctx, "DeviceManager.refreshTarget", trace.WithAttributes(usbip.TargetAttribute(target)))
+	defer func() { endSpan(span, err) }()
+	lst, err := dm.listDevices(target)
 	if err != nil {
 		return nil, err
 	}
 
-	defer conn.Close()
-
-	lst, err := conn.ListRequest()
-
 	changed := make([]string, 0)
 	for devId, kd := range dm.knownDevices {
-		_, attached := dm.attachedDevices[devId]
+		att, attached := dm.attachedDevices[devId]
 		// no use checking the returned devices for one that is already attached to us,
-		// it won't be part of the response anyway
-		if attached {
+		// it won't be part of the response anyway (unless it was disconnected)
+		if attached && att.lostSince.IsZero() {
+			if kd.Target == target {
+				kd.lastSeen = time.Now()
+			}
 			continue
 		}
 
-		if kd.Target != target {
+		if kd.Target != target || kd.retired {
 			continue
 		}
 
@@ -200,6 +665,7 @@ func (dm *DeviceManager) refreshTarget(target usbip.Target) ([]string, error) {
 				_ = dm.logger.Log("msg", "found device or device changed properties", "target", kd.Target, "selector", selector, "found", cand, "previous", kd.readProperties)
 			}
 			kd.readProperties = cand
+			kd.lastSeen = time.Now()
 			break
 		}
 		wasAvailable := kd.available
@@ -209,6 +675,8 @@ func (dm *DeviceManager) refreshTarget(target usbip.Target) ([]string, error) {
 		kd.available = found
 		if wasAvailable && !found {
 			_ = dm.logger.Log("msg", "previously available device no longer available (in use by another node?)", "target", kd.Target, "selector", selector)
+			// routine when devices are shared between nodes, so not a warning
+			dm.events.normal(nil, EventReasonDeviceLost, "Device %s is no longer offered by %s (in use by another node?)", kd.Name, describeTarget(kd.Target))
 			kd.readProperties = driver.USBDevice{}
 		}
 	}
@@ -216,9 +684,273 @@ func (dm *DeviceManager) refreshTarget(target usbip.Target) ([]string, error) {
 	return changed, err
 }
 
+// listDevices lists the devices offered by the given target.
+func (dm *DeviceManager) listDevices(target usbip.Target) ([]driver.USBDevice, error) {
+	if target.Local {
+		if dm.local == nil {
+			return nil, errors.New("local devices are not enabled")
+		}
+		localDevices, err := dm.local.ListDevices()
+		if err != nil {
+			return nil, err
+		}
+		lst := make([]driver.USBDevice, 0, len(localDevices))
+		for _, dev := range localDevices {
+			lst = append(lst, dev.USBDevice)
+		}
+		return lst, nil
+	}
+	conn, err := dm.dialer.Dial(target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ListRequest()
+}
+
+// attachDevice imports the device with the given ID over USB/IP (or claims it, if it's a local device),
+// waits for its /dev nodes to appear and records it as attached. If any step after the import fails,
+// the device is detached again. The caller must hold dm.mu.
+func (dm *DeviceManager) attachDevice(ctx context.Context, devId string) (*attachment, error) {
+	kd, ok := dm.knownDevices[devId]
+	if !ok {
+		return nil, fmt.Errorf("unknown device %s", devId)
+	}
+	if dm.stopped {
+		return nil, fmt.Errorf("not attaching %s, the device manager is shutting down", devId)
+	}
+	attachedDevice, err := dm.importDevice(ctx, kd)
+	if err != nil {
+		return nil, err
+	}
+	return dm.installAttached(ctx, devId, attachedDevice)
+}
+
+// importDevice imports a device over USB/IP (or claims it, if it's a local device) and waits for
+// its /dev nodes to appear, detaching it again if they don't. It only reads kd, so callers that
+// don't hold dm.mu can pass a copy of the known device.
+func (dm *DeviceManager) importDevice(ctx context.Context, kd *KnownDevice) (*usbip.AttachedDevice, error) {
+	var attachedDevice *usbip.AttachedDevice
+	var err error
+	if kd.Target.Local {
+		attachedDevice, err = dm.claimLocal(kd)
+	} else {
+		attachedDevice, err = dm.importRemote(ctx, kd)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = level.Info(dm.logger).Log("msg", "Waiting for /dev nodes for device...", "details", attachedDevice)
+	waitStart := time.Now()
+	err = waitForDevNodes(ctx, kd, attachedDevice)
+	observeSince(dm.metrics.devNodeWait, kd.Target, waitStart)
+	if err != nil {
+		dm.metrics.importFailed(kd.Target, importFailureDevNodes)
+		_ = level.Warn(dm.logger).Log("msg", "/dev nodes for device never appeared", "details", attachedDevice, "err", err)
+		dm.events.warning(nil, EventReasonImportFailed, "Device nodes for %s never appeared: %v", kd.Name, err)
+		dm.rollbackAttach(ctx, kd.id, attachedDevice)
+		return nil, err
+	}
+	return attachedDevice, nil
+}
+
+// installAttached prepares an imported device and records it as attached, detaching it again
+// if it can't be prepared. The caller must hold dm.mu.
+func (dm *DeviceManager) installAttached(ctx context.Context, devId string, attachedDevice *usbip.AttachedDevice) (*attachment, error) {
+	kd := dm.knownDevices[devId]
+	if err := dm.prepareAttached(devId, attachedDevice); err != nil {
+		dm.metrics.importFailed(kd.Target, importFailurePrepare)
+		dm.events.warning(nil, EventReasonImportFailed, "Failed to prepare %s: %v", kd.Name, err)
+		dm.rollbackAttach(ctx, devId, attachedDevice)
+		return nil, err
+	}
+	att := newAttachment(attachedDevice)
+	dm.attachedDevices[devId] = att
+	_ = level.Info(dm.logger).Log("msg", "Attached device", "details", attachedDevice)
+	dm.events.normal(nil, EventReasonDeviceAttached, "Attached %s from %s to %s (%s)", kd.Name, describeTarget(kd.Target), attachedAt(attachedDevice), attachedDevice.DevMountPath)
+	return att, nil
+}
+
+// importRemote imports a device over USB/IP.
+func (dm *DeviceManager) importRemote(ctx context.Context, kd *KnownDevice) (*usbip.AttachedDevice, error) {
+	importStart := time.Now()
+	attachedDevice, err := usbip.Import(
+		ctx,
+		kd.readProperties.BusId,
+		kd.Target,
+		dm.vhciDriver,
+		dm.dialer,
+	)
+	observeSince(dm.metrics.importDuration, kd.Target, importStart)
+	if err != nil {
+		dm.metrics.importFailed(kd.Target, usbip.ReasonForImportFailure(err))
+		_ = level.Info(dm.logger).Log("msg", "USB/IP import failed", "device", kd, "err", err)
+		dm.events.warning(nil, EventReasonImportFailed, "Failed to import %s from %s: %v", kd.Name, describeTarget(kd.Target), err)
+		return nil, err
+	}
+	return attachedDevice, nil
+}
+
+// claimLocal records a device plugged into the node itself as attached. There is nothing to import,
+// but the device must still be plugged in.
+func (dm *DeviceManager) claimLocal(kd *KnownDevice) (*usbip.AttachedDevice, error) {
+	if dm.local == nil {
+		return nil, errors.New("local devices are not enabled")
+	}
+	dev, err := dm.local.Describe(kd.readProperties.BusId)
+	if err == nil && !kd.SelectorMatches(dev.USBDevice) {
+		err = errors.Newf("device %s no longer matches the selector", kd.readProperties.BusId)
+	}
+	if err != nil {
+		_ = level.Info(dm.logger).Log("msg", "local device unavailable", "device", kd, "err", err)
+		dm.events.warning(nil, EventReasonImportFailed, "Failed to claim local device %s: %v", kd.Name, err)
+		return nil, err
+	}
+	return &usbip.AttachedDevice{
+		USBDevice:    dev.USBDevice,
+		Target:       kd.Target,
+		DevMountPath: dev.DevMountPath,
+	}, nil
+}
+
+// attachedAt describes where an attached device is plugged in, for use in events.
+func attachedAt(att *usbip.AttachedDevice) string {
+	if att.Target.Local {
+		return "local bus ID " + att.BusId
+	}
+	return "port " + strconv.Itoa(int(att.Port))
+}
+
+// prepareAttached discovers the interface device nodes of an attached device, and
+// writes its CDI spec if CDI support is enabled.
+func (dm *DeviceManager) prepareAttached(devId string, attachedDevice *usbip.AttachedDevice) error {
+	var nodes []string
+	var err error
+	if attachedDevice.Target.Local {
+		nodes, err = dm.local.InterfaceDevNodes(attachedDevice.BusId)
+	} else {
+		nodes, err = dm.vhciDriver.InterfaceDevNodes(attachedDevice.Port)
+	}
+	if err != nil {
+		// not fatal, the main device node is still usable
+		_ = level.Warn(dm.logger).Log("msg", "failed to discover interface device nodes", "devId", devId, "err", err)
+	}
+	attachedDevice.InterfaceDevNodes = nodes
+	if dm.usesLinks(devId) {
+		if err = dm.links.update(devId, attachedDevice); err != nil {
+			return err
+		}
+	}
+	if dm.cdi == nil {
+		return nil
+	}
+	kd := dm.knownDevices[devId]
+	if err = dm.cdi.writeSpec(devId, kd, attachedDevice); err != nil {
+		return err
+	}
+	if legacyIds := kd.replicasOf(kd.legacyId); kd.legacyId != devId && dm.legacyIds[legacyIds[0]] == devId {
+		// containers allocated the device under its legacy ID refer to it by that name
+		if err = dm.cdi.writeSpec(kd.legacyId, kd, attachedDevice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reserveDevice marks a device as allocated to a container that has not been started yet.
+// Reserved devices are not released, until the reservation expires after reservationTimeout
+// without the kubelet reporting a pod holding the device. The caller must hold dm.mu.
+func (dm *DeviceManager) reserveDevice(devId string) {
+	if _, reserved := dm.reservations[devId]; !reserved {
+		dm.reservations[devId] = time.Now()
+	}
+}
+
+// attachReserved attaches the devices for the given (advertised) IDs ahead of a container start,
+// if they aren't attached yet. Reservations are cleared once the device is attached.
+// If any of the imports fail, the devices attached by this call are detached again, and the failed
+// devices lose their reservation, so they can be picked up again. The caller must hold dm.mu.
+func (dm *DeviceManager) attachReserved(ctx context.Context, advertisedIds []string) error {
+	attachedNow := make([]string, 0, len(advertisedIds))
+	for _, advertisedId := range advertisedIds {
+		devId := dm.deviceId(advertisedId)
+		_, attached, err := dm.usableAttachment(devId)
+		if err == nil && attached {
+			delete(dm.reservations, devId)
+			continue
+		}
+		if err == nil {
+			_, err = dm.attachDevice(ctx, devId)
+		}
+		if err != nil {
+			delete(dm.reservations, devId)
+			for _, rollbackId := range attachedNow {
+				dm.rollbackAttach(ctx, rollbackId, dm.attachedDevices[rollbackId].AttachedDevice)
+				dm.forgetAttached(rollbackId)
+			}
+			return errors.Wrapf(err, "failed to attach %s", devId)
+		}
+		delete(dm.reservations, devId)
+		attachedNow = append(attachedNow, devId)
+	}
+	for _, advertisedId := range advertisedIds {
+		dm.attachedDevices[dm.deviceId(advertisedId)].holders[advertisedId] = true
+	}
+	return nil
+}
+
+// usableAttachment looks up the attachment of a device that can be handed out to a container.
+// A disconnected device is not usable: if other containers still hold it, this is an error,
+// and otherwise, it is forgotten so it can be attached again. The caller must hold dm.mu.
+func (dm *DeviceManager) usableAttachment(devId string) (*attachment, bool, error) {
+	att, attached := dm.attachedDevices[devId]
+	if !attached || att.lostSince.IsZero() {
+		return att, attached, nil
+	}
+	// don't hand out the device node of a disconnected device
+	if len(att.holders) > 0 {
+		return nil, false, fmt.Errorf("device %s was disconnected, and is still held by other containers", devId)
+	}
+	dm.forgetAttached(devId)
+	return nil, false, nil
+}
+
+// forgetAttached removes all state associated with an attached device after it was detached.
+func (dm *DeviceManager) forgetAttached(devId string) {
+	delete(dm.attachedDevices, devId)
+	dm.dropLegacyIds(devId)
+	if dm.links != nil {
+		if err := dm.links.remove(devId); err != nil {
+			_ = dm.logger.Log("msg", "failed to remove device links", "devId", devId, "err", err)
+		}
+	}
+	if dm.cdi != nil {
+		if err := dm.cdi.removeSpec(devId); err != nil {
+			_ = dm.logger.Log("msg", "failed to remove CDI spec", "devId", devId, "err", err)
+		}
+	}
+}
+
+// detach detaches the device on the given port, which was imported from the given target.
+// Local devices aren't attached to a port, so there is nothing to detach.
+func (dm *DeviceManager) detach(ctx context.Context, port driver.VirtualPort, target usbip.Target) error {
+	if target.Local {
+		return nil
+	}
+	defer observeSince(dm.metrics.detachDuration, target, time.Now())
+	return usbip.Detach(ctx, port, dm.vhciDriver)
+}
+
+func (dm *DeviceManager) rollbackAttach(ctx context.Context, devId string, attachedDevice *usbip.AttachedDevice) {
+	if err := dm.detach(ctx, attachedDevice.Port, attachedDevice.Target); err != nil {
+		_ = dm.logger.Log("msg", fmt.Sprintf("failed to detach %s after failed attach", devId), "err", err)
+	}
+}
+
 func (dm *DeviceManager) enumerateAttachedDevices() error {
 	vhci := dm.vhciDriver
 	slots := vhci.GetDeviceSlots()
+	previousState := dm.loadState()
 
 	_ = dm.logger.Log("msg", "Enumerating attached devices...", "slots", len(slots))
 
@@ -238,20 +970,24 @@ func (dm *DeviceManager) enumerateAttachedDevices() error {
 			//  the remote bus ID ourselves (like the usbip user-space tools do)
 			BusId: "",
 		}
+		if record, ok := previousState[int(attachedDev.Port)]; ok && dm.pairRecorded(record, attachedDev) {
+			continue
+		}
 		found := false
 		for devId, kd := range dm.knownDevices {
-			if !kd.SelectorMatches(dev) {
+			if _, paired := dm.attachedDevices[devId]; paired || kd.Target.Local || !kd.SelectorMatches(dev) {
 				continue
 			}
 			_ = dm.logger.Log("msg", "attached device matched with known device", "port", attachedDev.Port, "matched", devId)
 			mountPath := attachedDev.DevMountPath
 			found = true
-			dm.attachedDevices[devId] = &usbip.AttachedDevice{
+			dm.attachedDevices[devId] = newAttachment(&usbip.AttachedDevice{
 				USBDevice:    dev,
 				Target:       kd.Target,
 				Port:         attachedDev.Port,
 				DevMountPath: mountPath,
-			}
+			})
+			dm.migrateLegacyIds(devId)
 			break
 		}
 		if !found {
@@ -261,85 +997,336 @@ func (dm *DeviceManager) enumerateAttachedDevices() error {
 	return nil
 }
 
-func (dm *DeviceManager) releaseDevices() error {
-	if len(dm.attachedDevices) == 0 {
-		// nothing to do
-		return nil
+// pairRecorded pairs a device attached to the given slot with the device it was recorded as in the state
+// of the previous run, provided that the recorded device is still registered and matches the slot.
+func (dm *DeviceManager) pairRecorded(record stateRecord, slot *driver.VHCISlot) bool {
+	kd, ok := dm.knownDevices[record.DeviceID]
+	if !ok || record.Device.Vendor != slot.LocalDeviceInfo.Vendor || record.Device.Product != slot.LocalDeviceInfo.Product {
+		return false
+	}
+	if _, paired := dm.attachedDevices[record.DeviceID]; paired || record.Target != kd.Target {
+		return false
 	}
-	conn, err := kubeletClient(dm.podResourcesSocket)
+	_ = dm.logger.Log("msg", "attached device paired using saved state", "port", slot.Port, "matched", record.DeviceID)
+	dm.attachedDevices[record.DeviceID] = newAttachment(&usbip.AttachedDevice{
+		USBDevice:    record.Device,
+		Target:       kd.Target,
+		Port:         slot.Port,
+		DevMountPath: slot.DevMountPath,
+	})
+	dm.migrateLegacyIds(record.DeviceID)
+	return true
+}
+
+// pendingRelease is a released device whose pre-detach hook runs before it is detached.
+type pendingRelease struct {
+	devId   string
+	att     *attachment
+	hook    *PreDetachHook
+	payload hookPayload
+}
+
+// releaseDevices detaches devices that are no longer in use by any pod on this node,
+// once they have been unused for at least releaseGracePeriod.
+// Pre-detach hooks run without holding dm.mu, so the caller must not hold it either.
+func (dm *DeviceManager) releaseDevices(ctx context.Context) error {
+	dm.mu.Lock()
+	due, err := dm.releasedDevices(ctx)
+	dm.mu.Unlock()
 	if err != nil {
-		return fmt.Errorf("failed to connect to kubelet: %v", err)
+		return err
+	}
+	dm.runPreDetachHooks(ctx, due)
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	for _, pending := range due {
+		devId, att := pending.devId, pending.att
+		att.releasing = false
+		if dm.attachedDevices[devId] != att {
+			continue
+		}
+		if len(att.holders) > 0 {
+			// allocated again while the hook ran
+			_ = level.Info(dm.logger).Log("msg", "device was allocated during pre-detach hook; not detaching", "devId", devId)
+			continue
+		}
+		_ = dm.logger.Log("msg", fmt.Sprintf("detaching device %s used", devId))
+		if detachErr := dm.detachReleased(ctx, devId, att); detachErr != nil {
+			_ = dm.logger.Log("msg", fmt.Sprintf("failed to detach %s", devId), "err", detachErr)
+			err = detachErr
+			continue
+		}
+		dm.forgetAttached(devId)
+		if dm.knownDevices[devId].retired {
+			dm.forgetDevice(devId)
+		}
 	}
-	defer func() { _ = conn.Close() }()
 
-	client := v1.NewPodResourcesListerClient(conn)
-	usage, err := client.List(context.TODO(), &v1.ListPodResourcesRequest{})
 	if err != nil {
-		return fmt.Errorf("failed to interrogate kubelet about resource usage: %v", err)
-	}
-	witnesses := make(map[string]string, len(dm.attachedDevices))
-	for _, podResources := range usage.GetPodResources() {
-		for _, containerResources := range podResources.GetContainers() {
-			for _, containerDevices := range containerResources.GetDevices() {
-				for _, devId := range containerDevices.DeviceIds {
-					// record the pod of which the container that holds the device is part
-					// so we can log it later if it's one of ours
-					witnesses[devId] = fmt.Sprintf("%s/%s", podResources.Namespace, podResources.Name)
-				}
-			}
+		return errors.Wrap(err, "There were errors detaching some devices")
+	}
+
+	return nil
+}
+
+// releasedDevices updates the holders of the attached devices, and lists the devices that
+// have been unused for at least releaseGracePeriod. The caller must hold dm.mu.
+func (dm *DeviceManager) releasedDevices(ctx context.Context) ([]pendingRelease, error) {
+	if len(dm.attachedDevices) == 0 && len(dm.reservations) == 0 {
+		// nothing to do
+		return nil, nil
+	}
+	snapshot, err := dm.podResources.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	witnesses := snapshot.witnesses
+	// group the replicas in use by the underlying device
+	holders := make(map[string]map[string]bool, len(witnesses))
+	for advertisedId := range witnesses {
+		devId := dm.deviceId(advertisedId)
+		if holders[devId] == nil {
+			holders[devId] = make(map[string]bool)
 		}
+		holders[devId][advertisedId] = true
 	}
 
-	toRemove := make([]string, 0, len(witnesses))
+	now := time.Now()
+	for devId, since := range dm.reservations {
+		if _, inUse := holders[devId]; !inUse && now.Sub(since) >= reservationTimeout {
+			_ = level.Debug(dm.logger).Log("msg", "dropping expired reservation", "devId", devId, "since", since)
+			delete(dm.reservations, devId)
+		}
+	}
 
-	for devId, attachedDevice := range dm.attachedDevices {
-		podRef, inUse := witnesses[devId]
+	due := make([]pendingRelease, 0)
+
+	for devId, att := range dm.attachedDevices {
+		if att.releasing {
+			continue
+		}
+		devHolders, inUse := holders[devId]
+		if _, reserved := dm.reservations[devId]; reserved && !inUse {
+			// the container the device is reserved for hasn't started yet
+			att.releasedSince = time.Time{}
+			continue
+		}
 		if inUse {
-			_ = level.Debug(dm.logger).Log("msg", "device still in use", "devId", devId, "podRef", podRef)
-		} else {
-			_ = dm.logger.Log("msg", fmt.Sprintf("detaching device %s used", devId))
-			err = usbip.Detach(attachedDevice.Port, dm.vhciDriver)
-			if err != nil {
-				_ = dm.logger.Log("msg", fmt.Sprintf("failed to detach %s", devId), "err", err)
-				continue
+			att.holders = devHolders
+			att.releasedSince = time.Time{}
+			att.pods = att.pods[:0]
+			for advertisedId := range devHolders {
+				att.pods = append(att.pods, witnesses[advertisedId])
 			}
-			toRemove = append(toRemove, devId)
+			for advertisedId := range devHolders {
+				_ = level.Debug(dm.logger).Log("msg", "device still in use", "devId", advertisedId, "podRef", witnesses[advertisedId])
+			}
+			continue
+		}
+		// no pod holds the device any longer, which also stops any attempt to re-attach it
+		att.holders = make(map[string]bool)
+		kd := dm.knownDevices[devId]
+		if dm.kubeletLagsBehind(snapshot, devId) {
+			_ = level.Debug(dm.logger).Log("msg", "kubelet does not report advertised device as allocatable; not releasing", "devId", devId)
+			continue
+		}
+		options := dm.resourceOptions[kd.resource]
+		gracePeriod := options.releaseGracePeriod()
+		if att.releasedSince.IsZero() {
+			_ = level.Info(dm.logger).Log("msg", "device no longer in use, detaching after grace period", "devId", devId, "gracePeriod", gracePeriod)
+			att.releasedSince = now
 		}
+		if now.Sub(att.releasedSince) < gracePeriod {
+			continue
+		}
+		due = append(due, dm.newPendingRelease(devId, att))
 	}
+	return due, nil
+}
 
-	for _, devId := range toRemove {
-		delete(dm.attachedDevices, devId)
+// newPendingRelease marks an attached device as being released, and describes it to its pre-detach hook,
+// if any. The caller must hold dm.mu.
+func (dm *DeviceManager) newPendingRelease(devId string, att *attachment) pendingRelease {
+	kd := dm.knownDevices[devId]
+	att.releasing = true
+	pending := pendingRelease{devId: devId, att: att, hook: dm.resourceOptions[kd.resource].PreDetachHook}
+	if pending.hook != nil {
+		pending.payload = newHookPayload(kd, att)
 	}
+	return pending
+}
 
-	if err != nil {
-		return errors.Wrap(err, "There were errors detaching some devices")
+// runPreDetachHooks runs the pre-detach hooks of the devices that are about to be detached.
+// Hooks can take a while, so the caller must not hold dm.mu.
+func (dm *DeviceManager) runPreDetachHooks(ctx context.Context, due []pendingRelease) {
+	for _, pending := range due {
+		if pending.hook == nil {
+			continue
+		}
+		_ = level.Info(dm.logger).Log("msg", "running pre-detach hook", "devId", pending.devId)
+		if hookErr := pending.hook.run(ctx, pending.payload); hookErr != nil {
+			// the device still goes back to the pool, but flag it loudly
+			_ = level.Warn(dm.logger).Log("msg", "pre-detach hook failed", "devId", pending.devId, "err", hookErr)
+		}
 	}
+}
 
+// detachReleased detaches a released device whose pre-detach hook already ran.
+// The caller must hold dm.mu, and forget the attachment if this succeeds.
+func (dm *DeviceManager) detachReleased(ctx context.Context, devId string, att *attachment) error {
+	kd := dm.knownDevices[devId]
+	// the port of a disconnected device was already freed, and may hold another device by now
+	if att.lostSince.IsZero() {
+		if err := dm.detach(ctx, att.Port, att.Target); err != nil {
+			return err
+		}
+	}
+	dm.events.normal(att.pods, EventReasonDeviceDetached, "Detached %s from %s", kd.Name, attachedAt(att.AttachedDevice))
 	return nil
 }
 
+// updateTargetState records the outcome of a refresh of the given target.
+func (dm *DeviceManager) updateTargetState(target usbip.Target, err error) {
+	state, known := dm.targetStates[target]
+	if !known {
+		state = &TargetState{}
+		dm.targetStates[target] = state
+	}
+	now := time.Now()
+	if err == nil {
+		if !state.Reachable || !known {
+			state.Since = now
+		}
+		state.Reachable = true
+		state.LastSeen = now
+		state.LastError = nil
+		return
+	}
+	if state.Reachable || !known {
+		dm.events.warning(nil, EventReasonTargetUnreachable, "USB/IP target %s is unreachable: %v", describeTarget(target), err)
+		state.Since = now
+	}
+	state.Reachable = false
+	state.LastError = err
+}
+
+// DeviceStatus describes the state of a registered device on this node.
+type DeviceStatus struct {
+	// Available indicates whether the device can be allocated.
+	Available bool
+	// Attached indicates whether the device is attached to this node.
+	Attached bool
+	// LastSeen is the last time the device was offered by its target, or seen attached to this node.
+	LastSeen time.Time
+	// TargetReachable indicates whether the device's target was reachable during the last refresh.
+	TargetReachable bool
+}
+
+// DeviceStatus returns the status of the device with the given ID, if it is registered.
+func (dm *DeviceManager) DeviceStatus(devId string) (DeviceStatus, bool) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	kd, ok := dm.knownDevices[devId]
+	if !ok {
+		return DeviceStatus{}, false
+	}
+	_, attached := dm.attachedDevices[devId]
+	status := DeviceStatus{Available: kd.available, Attached: attached, LastSeen: kd.lastSeen}
+	if state, ok := dm.targetStates[kd.Target]; ok {
+		status.TargetReachable = state.Reachable
+	}
+	return status, true
+}
+
+// TargetStates returns a copy of the reachability state of all targets that were refreshed at least once.
+func (dm *DeviceManager) TargetStates() map[usbip.Target]TargetState {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	result := make(map[usbip.Target]TargetState, len(dm.targetStates))
+	for target, state := range dm.targetStates {
+		result[target] = *state
+	}
+	return result
+}
+
+func describeTarget(target usbip.Target) string {
+	if target.Local {
+		return "local"
+	}
+	return net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+}
+
+// kubeletLagsBehind checks whether a device is advertised to the kubelet, or about to be, while the kubelet
+// doesn't report any of its advertised IDs as allocatable yet. In that case, the kubelet's view of the device's
+// usage can't be trusted. Devices that are deliberately withheld from the kubelet, because they are cordoned,
+// retired or no longer offered by their target, drop out of its allocatable devices as a matter of course.
+func (dm *DeviceManager) kubeletLagsBehind(snapshot *podResourcesSnapshot, devId string) bool {
+	kd, ok := dm.knownDevices[devId]
+	if !ok || kd.retired {
+		return false
+	}
+	advertised := kd.allocatable()
+	for _, advertisedId := range kd.advertisedIds() {
+		if snapshot.knowsAbout(advertisedId) {
+			return false
+		}
+		advertised = advertised || dm.advertised[advertisedId]
+	}
+	return advertised
+}
+
+// recordAdvertised records the advertised IDs that a plugin sent to the kubelet, replacing the ones it sent before.
+// The caller must hold dm.mu.
+func (dm *DeviceManager) recordAdvertised(previous map[string]bool, current map[string]bool) {
+	for advertisedId := range previous {
+		delete(dm.advertised, advertisedId)
+	}
+	for advertisedId := range current {
+		dm.advertised[advertisedId] = true
+	}
+}
+
 // refreshDevices updates the devices available to the
 // USB/IP device plugin and returns a boolean indicating
 // if the state is the same as before.
-func (dm *DeviceManager) refreshDevices() ([]string, error) {
+func (dm *DeviceManager) refreshDevices(ctx context.Context) (_ []string, err error) {
+	ctx, span := tracer.Start(ctx, "DeviceManager.refreshDevices")
+	defer func() { endSpan(span, err) }()
 	dm.mu.Lock()
-	defer dm.mu.Unlock()
-	changed := make([]string, 0)
-	err := dm.releaseDevices()
+	vhciErr := dm.vhciDriver.UpdateAttachedDevices()
+	dm.health.vhciChecked(vhciErr)
+	dm.mu.Unlock()
+	// pre-detach hooks may take a while, so releaseDevices takes the lock itself
+	err = dm.releaseDevices(ctx)
 	if err != nil {
 		_ = dm.logger.Log("msg", "failed to release devices", "err", err)
 	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	changed := make([]string, 0)
+	if vhciErr == nil {
+		dm.reconcileAttached(ctx)
+	}
 	// even if the release fails, go on
-	for _, target := range dm.Targets() {
+	targets := dm.Targets()
+	unreachable := 0
+	defer func() { dm.health.refreshed(len(targets), unreachable, err) }()
+	for _, target := range targets {
 		var changedForTarget []string
-		changedForTarget, err = dm.refreshTarget(target)
+		refreshStart := time.Now()
+		changedForTarget, err = dm.refreshTarget(ctx, target)
+		observeSince(dm.metrics.refreshDuration, target, refreshStart)
+		dm.updateTargetState(target, err)
 
 		if err != nil {
-			_ = dm.logger.Log("warn", fmt.Sprintf("skipping target %s:%d, failed to connect", target.Host, target.Port))
+			unreachable++
+			_ = dm.logger.Log("warn", fmt.Sprintf("skipping target %s, failed to connect", describeTarget(target)))
 		} else {
 			changed = append(changed, changedForTarget...)
 		}
 	}
+	dm.health.setLostDevices(dm.lostDevices())
 
 	return changed, err
 }
@@ -0,0 +1,354 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestRegisterReplicas(t *testing.T) {
+	dm := NewDeviceManager("", nil, nil, nil)
+	ids, err := dm.Register("sensor", ResourceOptions{}, []*KnownDevice{
+		{
+			Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+			Selector: driver.USBDevice{Vendor: 0x1234, Product: 0x5678},
+			Replicas: 3,
+		},
+		{
+			Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+			Selector: driver.USBDevice{Vendor: 0x1234, Product: 0x9abc},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 4 {
+		t.Fatalf("expected 4 advertised IDs, got %v", ids)
+	}
+	if len(dm.knownDevices) != 2 {
+		t.Fatalf("expected 2 known devices, got %d", len(dm.knownDevices))
+	}
+	replicated := dm.deviceId(ids[0])
+	for _, id := range ids[:3] {
+		if dm.deviceId(id) != replicated {
+			t.Errorf("replica %s resolves to %s; want %s", id, dm.deviceId(id), replicated)
+		}
+	}
+	if replicated == ids[0] {
+		t.Errorf("replica ID should differ from the device ID")
+	}
+	if dm.deviceId(ids[3]) != ids[3] {
+		t.Errorf("unreplicated device %s should resolve to itself", ids[3])
+	}
+	if dm.knownDevices[replicated].Name != "sensor-0" || dm.knownDevices[ids[3]].Name != "sensor-1" {
+		t.Errorf("unexpected default names")
+	}
+}
+
+type fakeVHCIDriver struct {
+	slots []driver.VHCISlot
+}
+
+func (f *fakeVHCIDriver) AttachDevice(_ *net.TCPConn, _ uint32, _ driver.USBDeviceSpeed) (driver.VirtualPort, error) {
+	return 0, errors.New("not supported")
+}
+
+func (f *fakeVHCIDriver) DetachDevice(port driver.VirtualPort) error {
+	f.slots[port] = driver.VHCISlot{Port: port, Status: driver.VDevStatusNull}
+	return nil
+}
+
+func (f *fakeVHCIDriver) UpdateAttachedDevices() error {
+	return nil
+}
+
+func (f *fakeVHCIDriver) GetDeviceSlots() []driver.VHCISlot {
+	return f.slots
+}
+
+func (f *fakeVHCIDriver) InterfaceDevNodes(_ driver.VirtualPort) ([]string, error) {
+	return nil, nil
+}
+
+type fakePodResources struct {
+	snapshot *podResourcesSnapshot
+}
+
+func (f *fakePodResources) Snapshot(_ context.Context) (*podResourcesSnapshot, error) {
+	return f.snapshot, nil
+}
+
+// newTestDeviceManager sets up a device manager with a single registered device
+// attached to port 0 of a fake VHCI driver.
+func newTestDeviceManager(t *testing.T, dev *KnownDevice) (*DeviceManager, *fakeVHCIDriver, string) {
+	vhci := &fakeVHCIDriver{slots: []driver.VHCISlot{
+		{Port: 0, Status: driver.VDevStatusUsed, DevMountPath: "/dev/bus/usb/002/033"},
+		{Port: 1, Status: driver.VDevStatusNull},
+	}}
+	dm := NewDeviceManager("", nil, vhci, nil)
+	if _, err := dm.Register("device", ResourceOptions{}, []*KnownDevice{dev}); err != nil {
+		t.Fatal(err)
+	}
+	dev.available = true
+	dm.attachedDevices[dev.id] = newAttachment(&usbip.AttachedDevice{
+		USBDevice:    dev.Selector,
+		Target:       dev.Target,
+		Port:         0,
+		DevMountPath: "/dev/bus/usb/002/033",
+	})
+	return dm, vhci, dev.id
+}
+
+func TestDeviceIDs(t *testing.T) {
+	dm := NewDeviceManager("", nil, nil, nil)
+	target := usbip.Target{Host: "h", Port: 3240}
+	ids, err := dm.Register("res", ResourceOptions{}, []*KnownDevice{
+		{Target: target, Selector: driver.USBDevice{Vendor: 0x1050, Product: 0x0407}},
+		{StableID: "token", Target: target, Selector: driver.USBDevice{Vendor: 0x20a0, Product: 0x4230}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// device IDs end up in the kubelet's checkpoint, so they must not change across versions
+	expected := []string{"res_e9b9c79c22b03fb4cab9973554b004a5fc4614d481d1d34d90f4379b5e375a02", "res_token"}
+	if len(ids) != 2 || ids[0] != expected[0] || ids[1] != expected[1] {
+		t.Fatalf("expected IDs %v, got %v", expected, ids)
+	}
+
+	// cosmetic changes don't affect the ID
+	ids, err = NewDeviceManager("", nil, nil, nil).Register("res", ResourceOptions{}, []*KnownDevice{
+		{
+			Name:         "renamed",
+			Target:       target,
+			Selector:     driver.USBDevice{Vendor: 0x1050, Product: 0x0407},
+			ExtraDevices: []v1beta1.DeviceSpec{{HostPath: "/dev/null", ContainerPath: "/dev/null"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != expected[0] {
+		t.Errorf("expected ID %s, got %v", expected[0], ids)
+	}
+
+	for name, devices := range map[string][]*KnownDevice{
+		"same identity": {{Target: target}, {Target: target, Replicas: 2}},
+		"same id":       {{StableID: "a", Target: target}, {StableID: "a", Target: target, Selector: driver.USBDevice{BusId: "1-1"}}},
+		"invalid id":    {{StableID: "not/valid", Target: target}},
+	} {
+		if _, err := NewDeviceManager("", nil, nil, nil).Register("res", ResourceOptions{}, devices); err == nil {
+			t.Errorf("%s: expected registration to fail", name)
+		}
+	}
+}
+
+func TestLegacyIDMigration(t *testing.T) {
+	vhci := &fakeVHCIDriver{slots: []driver.VHCISlot{
+		{
+			Port: 0, Status: driver.VDevStatusUsed, DevMountPath: "/dev/bus/usb/002/033",
+			LocalDeviceInfo: driver.USBDevice{Vendor: 0x1050, Product: 0x0407},
+		},
+	}}
+	dm := NewDeviceManager("", nil, vhci, nil)
+	ids, err := dm.Register("res", ResourceOptions{}, []*KnownDevice{
+		{
+			Target:   usbip.Target{Host: "h", Port: 3240},
+			Selector: driver.USBDevice{Vendor: 0x1050, Product: 0x0407},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	devId := ids[0]
+	if err := dm.enumerateAttachedDevices(); err != nil {
+		t.Fatal(err)
+	}
+	// the ID assigned to the device by earlier versions
+	legacyId := "res_182ddb01dfa7acc0d51b424c6357d9fbc4d7a008698e0cdab1363c35f46446b3"
+	dm.podResources = &fakePodResources{snapshot: &podResourcesSnapshot{
+		witnesses:   map[string]podRef{legacyId: {Namespace: "default", Name: "pod"}},
+		allocatable: map[string]bool{devId: true},
+	}}
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	att, ok := dm.attachedDevices[devId]
+	if !ok {
+		t.Fatalf("device should still be attached")
+	}
+	if !att.holders[legacyId] || !att.releasedSince.IsZero() {
+		t.Errorf("device should be held under its legacy ID, got holders %v", att.holders)
+	}
+
+	// once the device is detached, the legacy IDs are no longer needed
+	dm.forgetAttached(devId)
+	if len(dm.legacyIds) != 0 {
+		t.Errorf("legacy IDs should have been dropped, got %v", dm.legacyIds)
+	}
+}
+
+func TestReleaseDevices(t *testing.T) {
+	dev := &KnownDevice{
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1234, Product: 0x5678},
+		Replicas: 2,
+	}
+	dm, vhci, devId := newTestDeviceManager(t, dev)
+	replicaIds := dev.advertisedIds()
+	pods := &fakePodResources{snapshot: &podResourcesSnapshot{
+		witnesses:   map[string]podRef{replicaIds[1]: {Namespace: "default", Name: "pod"}},
+		allocatable: map[string]bool{replicaIds[0]: true, replicaIds[1]: true},
+	}}
+	dm.podResources = pods
+
+	// in use by one of the replicas
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	att, ok := dm.attachedDevices[devId]
+	if !ok {
+		t.Fatalf("device should still be attached")
+	}
+	if len(att.holders) != 1 || !att.holders[replicaIds[1]] {
+		t.Errorf("unexpected holders %v", att.holders)
+	}
+
+	// not in use, but the kubelet doesn't know about the device
+	pods.snapshot = &podResourcesSnapshot{witnesses: map[string]podRef{}, allocatable: map[string]bool{}}
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !att.releasedSince.IsZero() {
+		t.Errorf("release should not start if the kubelet doesn't know about the device")
+	}
+
+	// not in use: start of grace period
+	pods.snapshot = &podResourcesSnapshot{witnesses: map[string]podRef{}}
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = dm.attachedDevices[devId]; !ok || att.releasedSince.IsZero() {
+		t.Fatalf("device should be attached and marked as released")
+	}
+
+	// grace period expired
+	att.releasedSince = time.Now().Add(-defaultReleaseGracePeriod)
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = dm.attachedDevices[devId]; ok {
+		t.Errorf("device should have been detached")
+	}
+	if !vhci.slots[0].IsEmpty() {
+		t.Errorf("port should have been freed")
+	}
+}
+
+func TestReleaseWithdrawnDevices(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		withdraw func(dev *KnownDevice)
+		// sent indicates that the device was still part of the last update sent to the kubelet
+		sent     bool
+		released bool
+	}{
+		{name: "cordoned", withdraw: func(dev *KnownDevice) { dev.cordoned = true }, released: true},
+		{name: "unavailable", withdraw: func(dev *KnownDevice) { dev.available = false }, released: true},
+		{name: "withdrawal not sent yet", withdraw: func(dev *KnownDevice) { dev.cordoned = true }, sent: true},
+		{name: "advertised", withdraw: func(dev *KnownDevice) {}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dev := &KnownDevice{
+				Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+				Selector: driver.USBDevice{Vendor: 0x1234, Product: 0x5678},
+			}
+			dm, vhci, devId := newTestDeviceManager(t, dev)
+			tc.withdraw(dev)
+			if tc.sent {
+				dm.recordAdvertised(nil, map[string]bool{devId: true})
+			}
+			// the kubelet no longer lists the device as allocatable, and no pod holds it
+			dm.podResources = &fakePodResources{snapshot: &podResourcesSnapshot{
+				witnesses:   map[string]podRef{},
+				allocatable: map[string]bool{},
+			}}
+			if err := dm.releaseDevices(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if att, ok := dm.attachedDevices[devId]; ok {
+				att.releasedSince = time.Now().Add(-defaultReleaseGracePeriod)
+			}
+			if err := dm.releaseDevices(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if _, attached := dm.attachedDevices[devId]; attached == tc.released {
+				t.Errorf("expected released=%t, but device attached=%t", tc.released, attached)
+			}
+			if vhci.slots[0].IsEmpty() != tc.released {
+				t.Errorf("expected port to be freed=%t", tc.released)
+			}
+		})
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	dev := &KnownDevice{
+		Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+		Selector: driver.USBDevice{Vendor: 0x1234, Product: 0x5678},
+	}
+	dm, _, devId := newTestDeviceManager(t, dev)
+	dm.podResources = &fakePodResources{snapshot: &podResourcesSnapshot{witnesses: map[string]podRef{}, allocatable: map[string]bool{}}}
+
+	dm.Unregister(devId)
+	if len(dm.selectableDevices("device")) != 0 {
+		t.Errorf("unregistered device should not be advertised")
+	}
+	if _, ok := dm.knownDevices[devId]; !ok {
+		t.Fatalf("attached device should be kept until it is released")
+	}
+
+	// the kubelet no longer knows about the device, but that shouldn't keep it attached
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	dm.attachedDevices[devId].releasedSince = time.Now().Add(-defaultReleaseGracePeriod)
+	if err := dm.releaseDevices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dm.knownDevices[devId]; ok {
+		t.Errorf("device should have been forgotten after release")
+	}
+}
+
+func TestPluginForReplicas(t *testing.T) {
+	dm := NewDeviceManager("", nil, nil, nil)
+	ids, err := dm.Register("sensor", ResourceOptions{}, []*KnownDevice{
+		{
+			Target:   usbip.Target{Host: "usbip.example.com", Port: 3240},
+			Selector: driver.USBDevice{Vendor: 0x1234, Product: 0x5678},
+			Replicas: 2,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPluginForDeviceGroup(dm, "sensor", "usbip.example.com/sensor", ResourceOptions{}, t.TempDir(), nil, nil)
+	up := p.(*plugin).DevicePluginServer.(*USBIPPlugin)
+	selectable := dm.selectableDevices(up.deviceGroup)
+	if len(selectable) != len(ids) {
+		t.Fatalf("expected %d selectable devices, got %d", len(ids), len(selectable))
+	}
+	for _, id := range ids {
+		if dev, ok := selectable[id]; !ok || dev.id != dm.deviceId(id) {
+			t.Errorf("replica %s should select device %s", id, dm.deviceId(id))
+		}
+	}
+}
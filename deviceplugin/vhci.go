@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package deviceplugin
+
+import (
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+)
+
+// lockedVHCIDriver serializes access to a VHCI driver, whose view of the ports is not safe for
+// concurrent use. Devices are re-attached without holding dm.mu, so the driver can't rely on it.
+type lockedVHCIDriver struct {
+	mu     sync.Mutex
+	driver driver.VHCIDriver
+}
+
+func (d *lockedVHCIDriver) AttachDevice(conn *net.TCPConn, deviceId uint32, speed driver.USBDeviceSpeed) (driver.VirtualPort, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	port, err := d.driver.AttachDevice(conn, deviceId, speed)
+	if err == nil {
+		// don't hand out the same free port to a concurrent import before the next update
+		_ = d.driver.UpdateAttachedDevices()
+	}
+	return port, err
+}
+
+func (d *lockedVHCIDriver) DetachDevice(port driver.VirtualPort) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.driver.DetachDevice(port)
+}
+
+func (d *lockedVHCIDriver) UpdateAttachedDevices() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.driver.UpdateAttachedDevices()
+}
+
+// GetDeviceSlots returns a copy of the ports, since the driver updates them in place.
+func (d *lockedVHCIDriver) GetDeviceSlots() []driver.VHCISlot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.driver.GetDeviceSlots())
+}
+
+func (d *lockedVHCIDriver) InterfaceDevNodes(port driver.VirtualPort) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.driver.InterfaceDevNodes(port)
+}
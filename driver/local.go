@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"io/fs"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+)
+
+const (
+	usbipHostDriverPath = "bus/usb/drivers/usbip-host"
+	// usbDeviceClassHub is the device class of USB hubs, which aren't useful to containers.
+	usbDeviceClassHub = 0x09
+)
+
+// busIdPattern matches the bus IDs of USB devices, as opposed to those of root hubs and interfaces.
+var busIdPattern = regexp.MustCompile(`^[0-9]+-[0-9]+(\.[0-9]+)*$`)
+
+type sysfsLocalDriver struct {
+	sysfsReader
+
+	logger log.Logger
+}
+
+// vhciBuses returns the numbers of the USB buses provided by VHCI controllers. The devices
+// on those buses were imported over USB/IP, so they aren't local.
+func (d *sysfsLocalDriver) vhciBuses() map[uint16]bool {
+	buses := make(map[uint16]bool)
+	controllers, err := fs.ReadDir(d.fsys, path.Join(sysBus, VHCIControllerBusType, "devices"))
+	if err != nil {
+		// no platform devices, so no VHCI controllers either
+		return buses
+	}
+	for _, controller := range controllers {
+		if !strings.HasPrefix(controller.Name(), "vhci_hcd.") {
+			continue
+		}
+		entries, err := fs.ReadDir(d.fsys, path.Join(sysBus, VHCIControllerBusType, "devices", controller.Name()))
+		if err != nil {
+			continue
+		}
+		// each controller has a root hub (usb<busnum>) per speed
+		for _, entry := range entries {
+			busnum, err := strconv.ParseUint(strings.TrimPrefix(entry.Name(), "usb"), 10, 16)
+			if strings.HasPrefix(entry.Name(), "usb") && err == nil {
+				buses[uint16(busnum)] = true
+			}
+		}
+	}
+	return buses
+}
+
+// isLocal checks whether the device with the given bus ID can be handed to containers as-is:
+// it must not be a hub, nor be imported over USB/IP or bound to usbip-host for export.
+func (d *sysfsLocalDriver) isLocal(busId string, vhciBuses map[uint16]bool) (bool, error) {
+	sysPath := usbSysPath(busId)
+	class, err := d.readDeviceUint8HexAttribute(sysPath, "bDeviceClass")
+	if err != nil {
+		return false, err
+	}
+	busnum, err := d.readDeviceUint16Attribute(sysPath, "busnum")
+	if err != nil {
+		return false, err
+	}
+	if _, err := fs.Lstat(d.fsys, path.Join(usbipHostDriverPath, busId)); err == nil {
+		return false, nil
+	}
+	return class != usbDeviceClassHub && !vhciBuses[busnum], nil
+}
+
+func (d *sysfsLocalDriver) ListDevices() ([]LocalDevice, error) {
+	entries, err := fs.ReadDir(d.fsys, path.Join(sysBus, "usb", "devices"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read USB devices")
+	}
+	vhciBuses := d.vhciBuses()
+	devices := make([]LocalDevice, 0)
+	for _, entry := range entries {
+		if !busIdPattern.MatchString(entry.Name()) {
+			continue
+		}
+		local, err := d.isLocal(entry.Name(), vhciBuses)
+		if err != nil {
+			// devices can disappear while we're looking at them
+			_ = d.logger.Log("msg", "skipping device that could not be described", "busId", entry.Name(), "err", err)
+			continue
+		}
+		if !local {
+			continue
+		}
+		dev, mountPath, err := d.describeUsb(entry.Name())
+		if err != nil {
+			_ = d.logger.Log("msg", "skipping device that could not be described", "busId", entry.Name(), "err", err)
+			continue
+		}
+		devices = append(devices, LocalDevice{USBDevice: dev, DevMountPath: mountPath})
+	}
+	return devices, nil
+}
+
+func (d *sysfsLocalDriver) Describe(busId string) (*LocalDevice, error) {
+	if !busIdPattern.MatchString(busId) {
+		return nil, errors.Newf("invalid bus ID %q", busId)
+	}
+	local, err := d.isLocal(busId, d.vhciBuses())
+	if err != nil {
+		return nil, errors.Wrapf(err, "device %s not found", busId)
+	}
+	if !local {
+		return nil, errors.Newf("device %s is not a local device", busId)
+	}
+	dev, mountPath, err := d.describeUsb(busId)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalDevice{USBDevice: dev, DevMountPath: mountPath}, nil
+}
+
+// InterfaceDevNodes returns the /dev nodes created by the interface drivers bound to the local device
+// with the given bus ID (e.g. /dev/ttyUSB0 or /dev/hidraw1).
+func (d *sysfsLocalDriver) InterfaceDevNodes(busId string) ([]string, error) {
+	if !busIdPattern.MatchString(busId) {
+		return nil, errors.Newf("invalid bus ID %q", busId)
+	}
+	return d.interfaceDevNodes(usbSysPath(busId), busId)
+}
+
+// NewSysfsLocalDriver sets up a driver that enumerates the USB devices plugged into the node
+// through fsys, which should be rooted at /sys.
+func NewSysfsLocalDriver(fsys fs.FS, logger log.Logger) LocalDriver {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &sysfsLocalDriver{sysfsReader: sysfsReader{fsys: fsys}, logger: logger}
+}
@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func localDeviceFixture(fsys fstest.MapFS, busId string, busnum string, devnum string, class string) {
+	dir := "bus/usb/devices/" + busId + "/"
+	fsys[dir+"idVendor"] = &fstest.MapFile{Data: []byte("10c4\n")}
+	fsys[dir+"idProduct"] = &fstest.MapFile{Data: []byte("ea60\n")}
+	fsys[dir+"busnum"] = &fstest.MapFile{Data: []byte(busnum + "\n")}
+	fsys[dir+"devnum"] = &fstest.MapFile{Data: []byte(devnum + "\n")}
+	fsys[dir+"bDeviceClass"] = &fstest.MapFile{Data: []byte(class + "\n")}
+}
+
+func TestLocalDevices(t *testing.T) {
+	fsys := fstest.MapFS{
+		"bus/platform/devices/vhci_hcd.0/usb3/busnum":           {Data: []byte("3\n")},
+		"bus/platform/devices/vhci_hcd.0/usb4/busnum":           {Data: []byte("4\n")},
+		"bus/usb/devices/usb1/busnum":                           {Data: []byte("1\n")},
+		"bus/usb/devices/1-1:1.0/bInterfaceClass":               {Data: []byte("ff\n")},
+		"bus/usb/devices/1-1/1-1:1.0/ttyUSB0/tty/ttyUSB0/dev":   {Data: []byte("188:0\n")},
+		"bus/usb/drivers/usbip-host/1-3":                        {Mode: fs.ModeSymlink, Data: []byte("../../../../devices/pci0000:00/usb1/1-3")},
+		"bus/usb/devices/1-2.1/1-2.1:1.0/0003:1/hidraw/hidraw2": {Mode: fs.ModeDir},
+	}
+	// a serial adapter, a hub with a device behind it, a device exported over USB/IP and an imported device
+	localDeviceFixture(fsys, "1-1", "1", "4", "00")
+	localDeviceFixture(fsys, "1-2", "1", "5", "09")
+	localDeviceFixture(fsys, "1-2.1", "1", "6", "00")
+	localDeviceFixture(fsys, "1-3", "1", "7", "00")
+	localDeviceFixture(fsys, "3-1", "3", "2", "00")
+
+	d := NewSysfsLocalDriver(fsys, nil)
+	devices, err := d.ListDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []LocalDevice{
+		{USBDevice: USBDevice{Vendor: 0x10c4, Product: 0xea60, BusId: "1-1"}, DevMountPath: "/dev/bus/usb/001/004"},
+		{USBDevice: USBDevice{Vendor: 0x10c4, Product: 0xea60, BusId: "1-2.1"}, DevMountPath: "/dev/bus/usb/001/006"},
+	}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Errorf("got %+v; want %+v", devices, expected)
+	}
+
+	dev, err := d.Describe("1-2.1")
+	if err != nil || !reflect.DeepEqual(*dev, expected[1]) {
+		t.Errorf("unexpected description %+v (%v)", dev, err)
+	}
+	for _, busId := range []string{"1-2", "1-3", "3-1", "1-9", "../1-1"} {
+		if _, err := d.Describe(busId); err == nil {
+			t.Errorf("%s should not be described as a local device", busId)
+		}
+	}
+
+	for busId, want := range map[string][]string{"1-1": {"/dev/ttyUSB0"}, "1-2.1": {"/dev/hidraw2"}} {
+		nodes, err := d.InterfaceDevNodes(busId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(nodes, want) {
+			t.Errorf("%s: got interface nodes %v; want %v", busId, nodes, want)
+		}
+	}
+}
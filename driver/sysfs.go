@@ -16,8 +16,13 @@ import (
 	"github.com/go-kit/log"
 )
 
-type sysfsVHCIDriver struct {
+// sysfsReader reads device attributes from a filesystem rooted at /sys.
+type sysfsReader struct {
 	fsys fs.FS
+}
+
+type sysfsVHCIDriver struct {
+	sysfsReader
 
 	AvailableControllers uint
 
@@ -31,6 +36,13 @@ const (
 	sysBus = "bus"
 )
 
+// interfaceDevClasses lists the sysfs class directories below a USB interface
+// that correspond to device nodes we want to expose alongside the USB device itself.
+var interfaceDevClasses = map[string]bool{
+	"tty":    true,
+	"hidraw": true,
+}
+
 func hostControllerPath() string {
 	return path.Join(sysBus, VHCIControllerBusType, "devices", VHCIControllerDeviceName)
 }
@@ -43,16 +55,16 @@ func (d *sysfsVHCIDriver) GetDeviceSlots() []VHCISlot {
 	return d.AttachedDevices
 }
 
-func (d *sysfsVHCIDriver) readDeviceAttribute(sysPath string, attributeName string) (string, error) {
-	content, err := fs.ReadFile(d.fsys, path.Join(sysPath, attributeName))
+func (r sysfsReader) readDeviceAttribute(sysPath string, attributeName string) (string, error) {
+	content, err := fs.ReadFile(r.fsys, path.Join(sysPath, attributeName))
 	if err != nil {
 		return "", err
 	}
 	return strings.TrimSpace(string(content)), nil
 }
 
-func (d *sysfsVHCIDriver) readDeviceUint16Attribute(sysPath string, attributeName string) (uint16, error) {
-	attrStr, err := d.readDeviceAttribute(sysPath, attributeName)
+func (r sysfsReader) readDeviceUint16Attribute(sysPath string, attributeName string) (uint16, error) {
+	attrStr, err := r.readDeviceAttribute(sysPath, attributeName)
 	if err != nil {
 		return 0, err
 	}
@@ -64,8 +76,8 @@ func (d *sysfsVHCIDriver) readDeviceUint16Attribute(sysPath string, attributeNam
 	return result, nil
 }
 
-func (d *sysfsVHCIDriver) readDeviceUint8HexAttribute(sysPath string, attributeName string) (uint8, error) {
-	attrStr, err := d.readDeviceAttribute(sysPath, attributeName)
+func (r sysfsReader) readDeviceUint8HexAttribute(sysPath string, attributeName string) (uint8, error) {
+	attrStr, err := r.readDeviceAttribute(sysPath, attributeName)
 	if err != nil {
 		return 0, err
 	}
@@ -77,8 +89,8 @@ func (d *sysfsVHCIDriver) readDeviceUint8HexAttribute(sysPath string, attributeN
 	return result, nil
 }
 
-func (d *sysfsVHCIDriver) readDeviceUint16HexAttribute(sysPath string, attributeName string) (uint16, error) {
-	attrStr, err := d.readDeviceAttribute(sysPath, attributeName)
+func (r sysfsReader) readDeviceUint16HexAttribute(sysPath string, attributeName string) (uint16, error) {
+	attrStr, err := r.readDeviceAttribute(sysPath, attributeName)
 	if err != nil {
 		return 0, err
 	}
@@ -126,28 +138,38 @@ func (d *sysfsVHCIDriver) countControllers() error {
 	return nil
 }
 
-func (d *sysfsVHCIDriver) describeUsbFromBusId(attachedDevice *VHCISlot, busId string) error {
+// describeUsb reads the identity and the device node of the USB device with the given bus ID.
+func (r sysfsReader) describeUsb(busId string) (USBDevice, string, error) {
 	sysPath := usbSysPath(busId)
 
-	vendor, vendErr := d.readDeviceUint16HexAttribute(sysPath, "idVendor")
-	product, prodErr := d.readDeviceUint16HexAttribute(sysPath, "idProduct")
+	vendor, vendErr := r.readDeviceUint16HexAttribute(sysPath, "idVendor")
+	product, prodErr := r.readDeviceUint16HexAttribute(sysPath, "idProduct")
 
 	// TODO check base convention
-	busnum, busnumErr := d.readDeviceUint16Attribute(sysPath, "busnum")
-	devnum, devnumErr := d.readDeviceUint16Attribute(sysPath, "devnum")
+	busnum, busnumErr := r.readDeviceUint16Attribute(sysPath, "busnum")
+	devnum, devnumErr := r.readDeviceUint16Attribute(sysPath, "devnum")
 
 	totalErr := baseerrors.Join(vendErr, prodErr, busnumErr, devnumErr)
 
 	if totalErr != nil {
-		return errors.Wrap(totalErr, "failed to describe device")
+		return USBDevice{}, "", errors.Wrap(totalErr, "failed to describe device")
 	}
 
-	attachedDevice.LocalDeviceInfo = USBDevice{
+	dev := USBDevice{
 		BusId:   busId,
 		Vendor:  USBID(vendor),
 		Product: USBID(product),
 	}
-	attachedDevice.DevMountPath = fmt.Sprintf("/dev/bus/usb/%03d/%03d", busnum, devnum)
+	return dev, fmt.Sprintf("/dev/bus/usb/%03d/%03d", busnum, devnum), nil
+}
+
+func (d *sysfsVHCIDriver) describeUsbFromBusId(attachedDevice *VHCISlot, busId string) error {
+	dev, mountPath, err := d.describeUsb(busId)
+	if err != nil {
+		return err
+	}
+	attachedDevice.LocalDeviceInfo = dev
+	attachedDevice.DevMountPath = mountPath
 	return nil
 }
 
@@ -278,6 +300,55 @@ func (d *sysfsVHCIDriver) DetachDevice(port VirtualPort) error {
 	return d.writeStringToFile(detachPath, detachStr)
 }
 
+// InterfaceDevNodes returns the /dev nodes created by the interface drivers bound to the device
+// attached to the given port (e.g. /dev/ttyACM0 or /dev/hidraw1).
+func (d *sysfsVHCIDriver) InterfaceDevNodes(port VirtualPort) ([]string, error) {
+	if int(port) >= len(d.AttachedDevices) {
+		return nil, errors.Newf("port number %d out of bounds", port)
+	}
+	slot := d.AttachedDevices[port]
+	if !slot.IsDeviceConnected() {
+		return nil, errors.Newf("no device attached to port %d", port)
+	}
+	return d.interfaceDevNodes(slot.SysPath, slot.LocalDeviceInfo.BusId)
+}
+
+// interfaceDevNodes returns the /dev nodes created by the interface drivers bound to the device
+// with the given sysfs path and bus ID.
+func (r sysfsReader) interfaceDevNodes(sysPath string, busId string) ([]string, error) {
+	entries, err := fs.ReadDir(r.fsys, sysPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", sysPath)
+	}
+	nodes := make([]string, 0)
+	for _, entry := range entries {
+		// interfaces are named <busid>:<config>.<interface>
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), busId+":") {
+			continue
+		}
+		err = fs.WalkDir(r.fsys, path.Join(sysPath, entry.Name()), func(p string, de fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !de.IsDir() || !interfaceDevClasses[de.Name()] {
+				return nil
+			}
+			classEntries, err := fs.ReadDir(r.fsys, p)
+			if err != nil {
+				return err
+			}
+			for _, classEntry := range classEntries {
+				nodes = append(nodes, path.Join("/dev", classEntry.Name()))
+			}
+			return fs.SkipDir
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to scan interface %s", entry.Name())
+		}
+	}
+	return nodes, nil
+}
+
 func (d *sysfsVHCIDriver) writeStringToFile(path string, content string) error {
 	f, err := os.OpenFile(filepath.Join(Sys, path), os.O_WRONLY, 0)
 	if err != nil {
@@ -301,8 +372,8 @@ func NewSysfsVHCIDriver(fsys fs.FS, logger log.Logger) (VHCIDriver, error) {
 	}
 
 	driver := &sysfsVHCIDriver{
-		fsys:   fsys,
-		logger: logger,
+		sysfsReader: sysfsReader{fsys: fsys},
+		logger:      logger,
 	}
 
 	err := driver.initPorts()
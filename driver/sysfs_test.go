@@ -238,3 +238,47 @@ func TestAttachUpdate(t *testing.T) {
 
 	compareSlots(t, driver, expectedSlots)
 }
+
+func TestInterfaceDevNodes(t *testing.T) {
+	var fsys = fstest.MapFS{
+		"bus/platform/devices/vhci_hcd.0/nports": {Data: []byte("4\n")},
+		"bus/platform/devices/vhci_hcd.0/status": {Data: []byte(
+			statusHeader +
+				"hs  0000 006 002 00010002 000010 2-1\n" +
+				"hs  0001 004 000 00000000 000000 0-0\n" +
+				"hs  0002 004 000 00000000 000000 0-0\n" +
+				"ss  0003 004 000 00080000 000000 0-0\n",
+		)},
+		"bus/usb/devices/2-1/idVendor":                                       {Data: []byte("dead\n")},
+		"bus/usb/devices/2-1/idProduct":                                      {Data: []byte("beef\n")},
+		"bus/usb/devices/2-1/busnum":                                         {Data: []byte("02\n")},
+		"bus/usb/devices/2-1/devnum":                                         {Data: []byte("33\n")},
+		"bus/usb/devices/2-1/2-1:1.0/tty/ttyACM0/dev":                        {Data: []byte("166:0\n")},
+		"bus/usb/devices/2-1/2-1:1.1/ttyUSB0/tty/ttyUSB0/dev":                {Data: []byte("188:0\n")},
+		"bus/usb/devices/2-1/2-1:1.2/0003:DEAD:BEEF.0001/hidraw/hidraw3/dev": {Data: []byte("241:3\n")},
+		"bus/usb/devices/2-1/2-1:1.2/0003:DEAD:BEEF.0001/input/input7/name":  {Data: []byte("whatever\n")},
+	}
+
+	driver, err := NewSysfsVHCIDriver(fsys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := driver.InterfaceDevNodes(VirtualPort(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/dev/ttyACM0", "/dev/ttyUSB0", "/dev/hidraw3"}
+	if len(nodes) != len(expected) {
+		t.Fatalf("got %v; want %v", nodes, expected)
+	}
+	for i, node := range expected {
+		if nodes[i] != node {
+			t.Errorf("node %d: got %s; want %s", i, nodes[i], node)
+		}
+	}
+
+	if _, err = driver.InterfaceDevNodes(VirtualPort(1)); err == nil {
+		t.Errorf("expected error for empty port")
+	}
+}
@@ -68,4 +68,19 @@ type VHCIDriver interface {
 	DetachDevice(port VirtualPort) error
 	UpdateAttachedDevices() error
 	GetDeviceSlots() []VHCISlot
+	InterfaceDevNodes(port VirtualPort) ([]string, error)
+}
+
+// LocalDevice is a USB device plugged into the node itself.
+type LocalDevice struct {
+	USBDevice
+	DevMountPath string
+}
+
+// LocalDriver enumerates the USB devices plugged into the node itself, as opposed to those
+// imported over USB/IP.
+type LocalDriver interface {
+	ListDevices() ([]LocalDevice, error)
+	Describe(busId string) (*LocalDevice, error)
+	InterfaceDevNodes(busId string) ([]string, error)
 }
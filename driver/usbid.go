@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// String formats the ID as 4 hexadecimal digits, like lsusb does.
+func (id USBID) String() string {
+	return fmt.Sprintf("%04x", uint16(id))
+}
+
+// ParseUSBID parses a USB vendor or product ID in hexadecimal, with or without 0x prefix.
+func ParseUSBID(value string) (USBID, error) {
+	digits := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(value), "0x"), "0X")
+	id, err := strconv.ParseUint(digits, 16, 16)
+	if err != nil {
+		return 0, errors.Newf("invalid USB ID %q: expected up to 4 hexadecimal digits", value)
+	}
+	return USBID(id), nil
+}
+
+func (id USBID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText parses an ID in hexadecimal. Decimal IDs can be specified as numbers instead of strings.
+func (id *USBID) UnmarshalText(text []byte) error {
+	parsed, err := ParseUSBID(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// UnmarshalJSON accepts hexadecimal strings, as well as (decimal) numbers.
+func (id *USBID) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		return id.UnmarshalText([]byte(text))
+	}
+	var value uint16
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.Newf("invalid USB ID %s: expected a number between 0 and 65535 or a hexadecimal string", data)
+	}
+	*id = USBID(value)
+	return nil
+}
+
+// Matches checks whether a device matches d, used as a selector: unset fields match any value.
+// Devices of which the bus ID isn't known match selectors with a bus ID.
+func (d USBDevice) Matches(cand USBDevice) bool {
+	return (d.BusId == "" || cand.BusId == "" || d.BusId == cand.BusId) &&
+		(d.Vendor == 0 || d.Vendor == cand.Vendor) &&
+		(d.Product == 0 || d.Product == cand.Product)
+}
+
+// UnmarshalText parses an lsusb-style vvvv:pppp device selector.
+func (d *USBDevice) UnmarshalText(text []byte) error {
+	vendor, product, ok := strings.Cut(string(text), ":")
+	if !ok {
+		return errors.Newf("invalid device %q: expected vvvv:pppp", text)
+	}
+	var err error
+	result := USBDevice{}
+	if result.Vendor, err = ParseUSBID(vendor); err != nil {
+		return err
+	}
+	if result.Product, err = ParseUSBID(product); err != nil {
+		return err
+	}
+	*d = result
+	return nil
+}
+
+// UnmarshalJSON accepts both the object form and the lsusb-style vvvv:pppp shorthand.
+func (d *USBDevice) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		return d.UnmarshalText([]byte(text))
+	}
+	// avoid recursing into this method
+	type usbDevice USBDevice
+	var result usbDevice
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	*d = USBDevice(result)
+	return nil
+}
@@ -0,0 +1,83 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUSBIDJSON(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected USBID
+		fail     bool
+	}{
+		{input: `1027`, expected: 0x0403},
+		{input: `"0403"`, expected: 0x0403},
+		{input: `"0x0403"`, expected: 0x0403},
+		{input: `"0XFFFF"`, expected: 0xffff},
+		{input: `"10000"`, fail: true},
+		{input: `65536`, fail: true},
+		{input: `-1`, fail: true},
+		{input: `"usb"`, fail: true},
+		{input: `""`, fail: true},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			var id USBID
+			err := json.Unmarshal([]byte(tc.input), &id)
+			if tc.fail {
+				if err == nil {
+					t.Fatalf("expected error, got %v", id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != tc.expected {
+				t.Errorf("got %v; want %v", id, tc.expected)
+			}
+		})
+	}
+}
+
+func TestUSBDeviceJSON(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected USBDevice
+		fail     bool
+	}{
+		{input: `"1050:0407"`, expected: USBDevice{Vendor: 0x1050, Product: 0x0407}},
+		{input: `"0x1050:0x0407"`, expected: USBDevice{Vendor: 0x1050, Product: 0x0407}},
+		{input: `{"vendor": 4176, "product": "0407", "bus_id": "1-1"}`, expected: USBDevice{Vendor: 0x1050, Product: 0x0407, BusId: "1-1"}},
+		{input: `"1050"`, fail: true},
+		{input: `"1050:"`, fail: true},
+		{input: `{"vendor": "zz"}`, fail: true},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			var dev USBDevice
+			err := json.Unmarshal([]byte(tc.input), &dev)
+			if tc.fail {
+				if err == nil {
+					t.Fatalf("expected error, got %v", dev)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dev != tc.expected {
+				t.Errorf("got %v; want %v", dev, tc.expected)
+			}
+		})
+	}
+
+	out, err := json.Marshal(USBDevice{Vendor: 0x1050, Product: 0x0407, BusId: "1-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"vendor":"1050","product":"0407","bus_id":"1-1"}`; string(out) != expected {
+		t.Errorf("got %s; want %s", out, expected)
+	}
+}
@@ -0,0 +1,69 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/crd"
+	"github.com/MatthiasValvekens/usbip-device-plugin/deviceplugin"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+)
+
+const (
+	eventComponent    = "usbip-device-plugin"
+	podResyncInterval = 10 * time.Minute
+)
+
+// newCRDController sets up a controller registering the devices declared through custom resources.
+func newCRDController(config *rest.Config, dm *deviceplugin.DeviceManager, nodeName string, ensurePlugin func(string), logger log.Logger) (*crd.Controller, error) {
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return crd.NewController(client, dm, nodeName, ensurePlugin, logger)
+}
+
+// newEventRecorder sets up an event recorder, along with a resolver that looks up pods
+// so events can be attached to them. The resolver is backed by a cache of the pods on the
+// node, so it never waits on the API server.
+func newEventRecorder(clientset kubernetes.Interface, nodeName string, logger log.Logger) (record.EventRecorder, deviceplugin.PodResolver, func()) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent, Host: nodeName})
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, podResyncInterval,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+		}))
+	pods := factory.Core().V1().Pods().Lister()
+	stop := make(chan struct{})
+	factory.Start(stop)
+
+	resolvePod := func(namespace string, name string) (*corev1.ObjectReference, error) {
+		pod, err := pods.Pods(namespace).Get(name)
+		if err != nil {
+			_ = level.Debug(logger).Log("msg", "failed to look up pod", "pod", namespace+"/"+name, "err", err)
+			return nil, err
+		}
+		return reference.GetReference(scheme.Scheme, pod)
+	}
+	shutdown := func() {
+		close(stop)
+		factory.Shutdown()
+		broadcaster.Shutdown()
+	}
+	return recorder, resolvePod, shutdown
+}
@@ -0,0 +1,40 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEventPodResolver(t *testing.T) {
+	clientset := fake.NewClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod", UID: "1234"},
+		Spec:       corev1.PodSpec{NodeName: "node"},
+	})
+	_, resolvePod, shutdown := newEventRecorder(clientset, "node", log.NewNopLogger())
+	defer shutdown()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ref, err := resolvePod("default", "pod")
+		if err == nil {
+			if ref.Kind != "Pod" || ref.UID != "1234" {
+				t.Errorf("unexpected reference %+v", ref)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pod was not resolved from the cache: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := resolvePod("default", "other"); err == nil {
+		t.Errorf("unknown pod should not resolve")
+	}
+}
@@ -26,10 +26,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"path"
 	"strings"
 	"syscall"
 
+	"github.com/MatthiasValvekens/usbip-device-plugin/admin"
 	"github.com/MatthiasValvekens/usbip-device-plugin/deviceplugin"
 	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
 	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
@@ -42,6 +42,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
 	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 const (
@@ -75,34 +77,30 @@ func Main() error {
 		return fmt.Errorf("failed to parse domain %q: %s", domain, strings.Join(errs, ", "))
 	}
 
-	deviceSpecs, err := getConfiguredDevices()
+	deviceSpecs, issues, err := checkConfiguredDevices(domain)
 	if err != nil {
 		return err
 	}
-	if len(deviceSpecs) == 0 {
+	if errs := issues.errors(); len(errs) > 0 {
+		return errs
+	}
+	if len(deviceSpecs) == 0 && !viper.GetBool("crds") {
 		return fmt.Errorf("at least one device must be specified")
 	}
+	shutdownPolicy, err := deviceplugin.ParseShutdownPolicy(viper.GetString("shutdown-policy"))
+	if err != nil {
+		return err
+	}
 
-	logger := log.NewJSONLogger(log.NewSyncWriter(os.Stdout))
-	logLevel := viper.GetString("log-level")
-	switch logLevel {
-	case logLevelAll:
-		logger = level.NewFilter(logger, level.AllowAll())
-	case logLevelDebug:
-		logger = level.NewFilter(logger, level.AllowDebug())
-	case logLevelInfo:
-		logger = level.NewFilter(logger, level.AllowInfo())
-	case logLevelWarn:
-		logger = level.NewFilter(logger, level.AllowWarn())
-	case logLevelError:
-		logger = level.NewFilter(logger, level.AllowError())
-	case logLevelNone:
-		logger = level.NewFilter(logger, level.AllowNone())
-	default:
-		return fmt.Errorf("log level %v unknown; possible values are: %s", logLevel, availableLogLevels)
+	logger, err := filterLogLevel(log.NewJSONLogger(log.NewSyncWriter(os.Stdout)), viper.GetString("log-level"))
+	if err != nil {
+		return err
 	}
 	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
 	logger = log.With(logger, "caller", log.DefaultCaller)
+	for _, issue := range issues {
+		_ = level.Warn(logger).Log("msg", "configuration warning", "path", issue.Path, "warning", issue.Message)
+	}
 
 	r := prometheus.NewRegistry()
 	r.MustRegister(
@@ -111,9 +109,9 @@ func Main() error {
 	)
 
 	var g run.Group
+	mux := http.NewServeMux()
 	{
 		// Run the HTTP server.
-		mux := http.NewServeMux()
 		mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
 			w.WriteHeader(http.StatusOK)
 		})
@@ -169,39 +167,160 @@ func Main() error {
 		return errors.Wrap(err, "failed to set up VHCI driver")
 	}
 	dm := deviceplugin.NewDeviceManager(podResourcesSocket, logger, vhci, usbip.NetDialer{})
-	for name, devs := range deviceSpecs {
-		registeredIds, err := dm.Register(name, devs)
+	dm.EnableLocalDevices(driver.NewSysfsLocalDriver(sysroot.FS(), logger))
+	if stateFile := viper.GetString("state-file"); stateFile != "" {
+		dm.EnableStateFile(stateFile)
+	}
+	if linkDir := viper.GetString("device-link-directory"); linkDir != "" {
+		dm.EnableDeviceLinks(linkDir)
+	}
+	if viper.GetBool("cdi") {
+		dm.EnableCDI(viper.GetString("cdi-spec-directory"), domain)
+	}
+	nodeName := viper.GetString("node-name")
+	dm.EnableMetrics(r, nodeName)
+	if endpoint := viper.GetString("tracing-endpoint"); endpoint != "" {
+		shutdownTracing, err := setupTracing(context.Background(), endpoint, viper.GetBool("tracing-insecure"), viper.GetFloat64("tracing-sample-ratio"), nodeName)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+			defer cancel()
+			if err := shutdownTracing(ctx); err != nil {
+				_ = level.Warn(logger).Log("msg", "failed to flush traces", "err", err)
+			}
+		}()
+	}
+	var kubeConfig *rest.Config
+	if viper.GetBool("events") || viper.GetBool("node-labels") || viper.GetBool("crds") {
+		if nodeName == "" {
+			return fmt.Errorf("events, node labels and custom resources require the node name to be set")
+		}
+		kubeConfig, err = rest.InClusterConfig()
+		if err != nil {
+			return errors.Wrap(err, "failed to load in-cluster Kubernetes configuration")
+		}
+		clientset, err := kubernetes.NewForConfig(kubeConfig)
+		if err != nil {
+			return errors.Wrap(err, "failed to set up Kubernetes client")
+		}
+		if viper.GetBool("events") {
+			recorder, resolvePod, shutdown := newEventRecorder(clientset, nodeName, logger)
+			defer shutdown()
+			dm.EnableEvents(recorder, nodeName, resolvePod)
+		}
+		if viper.GetBool("node-labels") {
+			dm.EnableNodeStatus(clientset, nodeName, domain)
+		}
+	}
+	// the resources were validated along with the rest of the configuration
+	for name, resource := range deviceSpecs {
+		if resource.LazyAttach && !dm.CDIEnabled() {
+			return fmt.Errorf("resource %s: lazy_attach requires CDI to be enabled", name)
+		}
+		registeredIds, err := dm.Register(name, resource.ResourceOptions, resource.Devices)
 		if err != nil {
 			return errors.Wrapf(err, "failed to register devices for %s", name)
 		}
 		idsByResource[name] = registeredIds
 	}
-	err = dm.Start()
+	adminToken, err := readAdminToken(viper.GetString("admin-token-file"))
 	if err != nil {
-		return errors.Wrapf(err, "error starting device manager")
+		return err
 	}
-	dm.AddRefreshJob(&g)
+	mux.Handle(admin.Prefix, admin.NewHandler(dm, adminToken, log.With(logger, "component", "admin")))
+	mux.Handle("/readyz", admin.HealthHandler(dm.Readiness))
+	mux.Handle("/livez", admin.HealthHandler(dm.Liveness))
 
-	for name, devIds := range idsByResource {
+	plugins := newPluginRunner(dm, domain, pluginPath, logger, r)
+	for name := range idsByResource {
+		plugins.ensure(name)
+	}
+	if viper.GetBool("crds") {
+		controller, err := newCRDController(kubeConfig, dm, nodeName, plugins.ensure, log.With(logger, "component", "crd"))
+		if err != nil {
+			return errors.Wrap(err, "failed to set up custom resource controller")
+		}
 		ctx, cancel := context.WithCancel(context.Background())
-		fullName := path.Join(domain, name)
-		p := deviceplugin.NewPluginForDeviceGroup(
-			devIds, dm, fullName, pluginPath,
-			log.With(logger, "resource", fullName),
-			prometheus.WrapRegistererWith(prometheus.Labels{"resource": fullName}, r),
-		)
+		// register the devices declared through custom resources before the device manager starts,
+		// so they can be paired with devices that are still attached
+		if err := controller.Start(ctx); err != nil {
+			cancel()
+			return errors.Wrap(err, "failed to start custom resource controller")
+		}
 		g.Add(func() error {
-			_ = logger.Log("msg", fmt.Sprintf("Starting the usbip-device-plugin for %s.", fullName))
-			return p.Run(ctx)
+			return controller.Run(ctx)
 		}, func(error) {
 			cancel()
 		})
 	}
+	err = dm.Start()
+	if err != nil {
+		return errors.Wrapf(err, "error starting device manager")
+	}
+	dm.AddRefreshJob(&g)
 
-	return g.Run()
+	plugins.start()
+	g.Add(plugins.run, plugins.stop)
+
+	err = g.Run()
+	shutdownTimeout := viper.GetDuration("shutdown-timeout")
+	_ = level.Info(logger).Log("msg", "applying shutdown policy", "policy", shutdownPolicy, "timeout", shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if shutdownErr := dm.Shutdown(ctx, shutdownPolicy); shutdownErr != nil {
+		_ = level.Warn(logger).Log("msg", "failed to apply shutdown policy", "policy", shutdownPolicy, "err", shutdownErr)
+	}
+	return err
+}
+
+// filterLogLevel makes the logger drop messages below the given level.
+func filterLogLevel(logger log.Logger, logLevel string) (log.Logger, error) {
+	switch logLevel {
+	case logLevelAll:
+		return level.NewFilter(logger, level.AllowAll()), nil
+	case logLevelDebug:
+		return level.NewFilter(logger, level.AllowDebug()), nil
+	case logLevelInfo:
+		return level.NewFilter(logger, level.AllowInfo()), nil
+	case logLevelWarn:
+		return level.NewFilter(logger, level.AllowWarn()), nil
+	case logLevelError:
+		return level.NewFilter(logger, level.AllowError()), nil
+	case logLevelNone:
+		return level.NewFilter(logger, level.AllowNone()), nil
+	default:
+		return nil, fmt.Errorf("log level %v unknown; possible values are: %s", logLevel, availableLogLevels)
+	}
+}
+
+// readAdminToken reads the bearer token for the admin API from the given file, if any.
+func readAdminToken(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read admin token")
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("admin token file %s is empty", path)
+	}
+	return token, nil
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if _, ok := commands[os.Args[1]]; ok {
+			if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 	if err := Main(); err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "Execution failed: %v\n", err)
 		os.Exit(1)
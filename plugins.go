@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/deviceplugin"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pluginRunner runs a device plugin for every resource, including resources
+// that only appear at runtime.
+type pluginRunner struct {
+	dm         *deviceplugin.DeviceManager
+	domain     string
+	pluginPath string
+	logger     log.Logger
+	reg        prometheus.Registerer
+
+	mu      sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	started bool
+	running map[string]bool
+	errs    chan error
+}
+
+func newPluginRunner(dm *deviceplugin.DeviceManager, domain string, pluginPath string, logger log.Logger, reg prometheus.Registerer) *pluginRunner {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pluginRunner{
+		dm:         dm,
+		domain:     domain,
+		pluginPath: pluginPath,
+		logger:     logger,
+		reg:        reg,
+		ctx:        ctx,
+		cancel:     cancel,
+		running:    make(map[string]bool),
+		errs:       make(chan error, 1),
+	}
+}
+
+// ensure makes sure a plugin runs for the given resource. Plugins requested before
+// start is called are only started then.
+func (pr *pluginRunner) ensure(name string) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if _, ok := pr.running[name]; ok {
+		return
+	}
+	pr.running[name] = false
+	if pr.started {
+		pr.launch(name)
+	}
+}
+
+func (pr *pluginRunner) launch(name string) {
+	fullName := path.Join(pr.domain, name)
+	p := deviceplugin.NewPluginForDeviceGroup(
+		pr.dm, name, fullName, pr.dm.Options(name), pr.pluginPath,
+		log.With(pr.logger, "resource", fullName),
+		prometheus.WrapRegistererWith(prometheus.Labels{"resource": fullName}, pr.reg),
+	)
+	pr.running[name] = true
+	go func() {
+		_ = pr.logger.Log("msg", fmt.Sprintf("Starting the usbip-device-plugin for %s.", fullName))
+		if err := p.Run(pr.ctx); err != nil {
+			select {
+			case pr.errs <- err:
+			default:
+			}
+		}
+	}()
+}
+
+// start launches all plugins requested so far.
+func (pr *pluginRunner) start() {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.started = true
+	for name, launched := range pr.running {
+		if !launched {
+			pr.launch(name)
+		}
+	}
+}
+
+// run blocks until a plugin fails or stop is called.
+func (pr *pluginRunner) run() error {
+	select {
+	case err := <-pr.errs:
+		return err
+	case <-pr.ctx.Done():
+		return nil
+	}
+}
+
+func (pr *pluginRunner) stop(error) {
+	pr.cancel()
+}
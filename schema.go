@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+//go:generate sh -c "go run . schema > config.schema.json"
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/deviceplugin"
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip/host"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	schemaDialect = "https://json-schema.org/draft/2020-12/schema"
+	schemaID      = "https://github.com/MatthiasValvekens/usbip-device-plugin/config.schema.json"
+
+	usbIDPattern    = "(0[xX])?[0-9a-fA-F]{1,4}"
+	durationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+)
+
+type jsonSchema map[string]interface{}
+
+var (
+	durationType  = reflect.TypeFor[time.Duration]()
+	usbIDType     = reflect.TypeFor[driver.USBID]()
+	usbDeviceType = reflect.TypeFor[driver.USBDevice]()
+	networkType   = reflect.TypeFor[host.ClientNetwork]()
+)
+
+// typeSchema derives a schema from the way decodeConfig maps the configuration onto the given type.
+func typeSchema(t reflect.Type) jsonSchema {
+	switch t {
+	case durationType:
+		return jsonSchema{"type": "string", "pattern": durationPattern, "description": "A duration, e.g. 30s or 1m30s."}
+	case usbIDType:
+		return jsonSchema{"oneOf": []jsonSchema{
+			{"type": "integer", "minimum": 0, "maximum": 65535},
+			{"type": "string", "pattern": "^" + usbIDPattern + "$"},
+		}, "description": "A USB vendor or product ID, as a number or a hexadecimal string."}
+	case networkType:
+		return jsonSchema{"type": "string", "description": "An IP address or CIDR range, e.g. 192.0.2.0/24."}
+	case usbDeviceType:
+		return jsonSchema{"oneOf": []jsonSchema{
+			structSchema(t),
+			{"type": "string", "pattern": "^" + usbIDPattern + ":" + usbIDPattern + "$", "description": "lsusb-style vvvv:pppp shorthand."},
+		}}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.Struct:
+		return structSchema(t)
+	case reflect.Slice, reflect.Array:
+		return jsonSchema{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	default:
+		return jsonSchema{}
+	}
+}
+
+// structSchema describes a struct as an object that only allows the fields that are decoded,
+// just like decodeConfig rejects unused keys.
+func structSchema(t reflect.Type) jsonSchema {
+	properties := make(map[string]jsonSchema)
+	collectProperties(t, properties)
+	return jsonSchema{"type": "object", "properties": properties, "additionalProperties": false}
+}
+
+func collectProperties(t reflect.Type, properties map[string]jsonSchema) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && (name == "" || strings.Contains(opts, "squash")) {
+			collectProperties(field.Type, properties)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = typeSchema(field.Type)
+	}
+}
+
+// flagSchema describes a setting defined by defineFlags.
+func flagSchema(f *flag.Flag) jsonSchema {
+	result := jsonSchema{"description": f.Usage}
+	switch f.Value.Type() {
+	case "bool":
+		result["type"] = "boolean"
+		result["default"] = f.DefValue == "true"
+	case "int":
+		result["type"] = "integer"
+	case "duration":
+		result["type"] = "string"
+		result["pattern"] = durationPattern
+		result["default"] = f.DefValue
+	case "float64":
+		result["type"] = "number"
+		if value, err := strconv.ParseFloat(f.DefValue, 64); err == nil {
+			result["default"] = value
+		}
+	default:
+		result["type"] = "string"
+		result["default"] = f.DefValue
+	}
+	return result
+}
+
+// configSchema returns a JSON schema for the configuration file.
+func configSchema() jsonSchema {
+	properties := make(map[string]jsonSchema)
+	flags := flag.NewFlagSet("config", flag.ContinueOnError)
+	defineFlags(flags)
+	flags.VisitAll(func(f *flag.Flag) {
+		properties[f.Name] = flagSchema(f)
+	})
+
+	properties["resources"] = jsonSchema{
+		"type":        "object",
+		"description": "The resources to advertise, keyed by name. A resource is either a plain list of devices, or a set of options along with its devices.",
+		"additionalProperties": jsonSchema{"oneOf": []jsonSchema{
+			typeSchema(reflect.TypeFor[deviceplugin.ResourceConfig]()),
+			typeSchema(reflect.TypeFor[[]*deviceplugin.KnownDevice]()),
+		}},
+	}
+	export := typeSchema(reflect.TypeFor[host.Policy]())
+	export["description"] = "The clients that the serve command allows to list and import devices."
+	properties["export"] = export
+	return jsonSchema{
+		"$schema":    schemaDialect,
+		"$id":        schemaID,
+		"title":      "usbip-device-plugin configuration",
+		"type":       "object",
+		"properties": properties,
+	}
+}
+
+func schemaCommand(env *commandEnv, _ []string) (*commandOutput, error) {
+	// the schema is only useful as JSON, regardless of the output format
+	out, err := json.MarshalIndent(configSchema(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintln(env.stdout, string(out))
+	return nil, err
+}
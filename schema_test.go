@@ -0,0 +1,23 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestConfigSchemaUpToDate(t *testing.T) {
+	var out bytes.Buffer
+	if _, err := schemaCommand(&commandEnv{stdout: &out}, nil); err != nil {
+		t.Fatal(err)
+	}
+	committed, err := os.ReadFile("config.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), committed) {
+		t.Errorf("config.schema.json is out of date; run go generate")
+	}
+}
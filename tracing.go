@@ -0,0 +1,51 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+const (
+	serviceName            = "usbip-device-plugin"
+	tracingShutdownTimeout = 5 * time.Second
+)
+
+// setupTracing installs a global tracer provider that exports spans to the given
+// OTLP (gRPC) endpoint, and returns a function that flushes and stops the exporter.
+func setupTracing(ctx context.Context, endpoint string, insecure bool, sampleRatio float64, nodeName string) (func(context.Context) error, error) {
+	if sampleRatio < 0 || sampleRatio > 1 {
+		return nil, fmt.Errorf("tracing sample ratio %v must be between 0 and 1", sampleRatio)
+	}
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up OTLP exporter: %w", err)
+	}
+	attrs := []attribute.KeyValue{semconv.ServiceName(serviceName)}
+	if nodeName != "" {
+		attrs = append(attrs, semconv.K8SNodeName(nodeName))
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, attrs...)),
+		// follow the caller's sampling decision if there is one
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
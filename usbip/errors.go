@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package usbip
+
+import (
+	baseerrors "errors"
+)
+
+// ImportFailureReason classifies the ways in which importing a device can fail.
+type ImportFailureReason string
+
+const (
+	// ImportFailureConnect means the target could not be reached.
+	ImportFailureConnect ImportFailureReason = "connect"
+	// ImportFailureProtocol means the exchange with the target failed or was malformed.
+	ImportFailureProtocol ImportFailureReason = "protocol"
+	// ImportFailureRejected means the target refused to export the device, e.g. because
+	// it is in use by another node.
+	ImportFailureRejected ImportFailureReason = "rejected"
+	// ImportFailureAttach means the VHCI driver failed to attach the imported device.
+	ImportFailureAttach ImportFailureReason = "attach"
+	// ImportFailureDescribe means the attached device never showed up in sysfs.
+	ImportFailureDescribe ImportFailureReason = "describe"
+	// ImportFailureUnknown is used for errors that don't carry a reason.
+	ImportFailureUnknown ImportFailureReason = "unknown"
+)
+
+// ImportError is returned by Import, and records at which stage the import failed.
+type ImportError struct {
+	Reason ImportFailureReason
+	Err    error
+}
+
+func (e *ImportError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+func importError(reason ImportFailureReason, err error) error {
+	return &ImportError{Reason: reason, Err: err}
+}
+
+// ReasonForImportFailure returns the reason recorded in an ImportError in the chain of err.
+func ReasonForImportFailure(err error) ImportFailureReason {
+	var importErr *ImportError
+	if baseerrors.As(err, &importErr) {
+		return importErr.Reason
+	}
+	return ImportFailureUnknown
+}
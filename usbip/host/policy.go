@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package host
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/efficientgo/core/errors"
+)
+
+// ClientNetwork is an IP address or CIDR range of clients.
+type ClientNetwork struct {
+	prefix netip.Prefix
+}
+
+// ParseClientNetwork parses an IP address (e.g. 192.0.2.1) or CIDR range (e.g. 192.0.2.0/24).
+func ParseClientNetwork(value string) (ClientNetwork, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return ClientNetwork{}, errors.Newf("invalid CIDR range %q", value)
+		}
+		return ClientNetwork{prefix: prefix.Masked()}, nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return ClientNetwork{}, errors.Newf("invalid IP address %q", value)
+	}
+	return ClientNetwork{prefix: netip.PrefixFrom(addr, addr.BitLen())}, nil
+}
+
+func (n ClientNetwork) String() string {
+	if n.prefix.IsSingleIP() {
+		return n.prefix.Addr().String()
+	}
+	return n.prefix.String()
+}
+
+// Contains checks whether the given client address is part of the network.
+func (n ClientNetwork) Contains(addr netip.Addr) bool {
+	return n.prefix.Contains(addr.Unmap())
+}
+
+func (n ClientNetwork) MarshalText() ([]byte, error) {
+	return []byte(n.String()), nil
+}
+
+func (n *ClientNetwork) UnmarshalText(text []byte) error {
+	parsed, err := ParseClientNetwork(string(text))
+	if err != nil {
+		return err
+	}
+	*n = parsed
+	return nil
+}
+
+// Rule grants a set of clients access to a set of devices.
+type Rule struct {
+	// Clients lists the IP addresses and CIDR ranges of the clients the rule applies to.
+	Clients []ClientNetwork `json:"clients"`
+	// Devices lists selectors for the devices the clients may list and import.
+	// An empty list grants access to all devices.
+	Devices []driver.USBDevice `json:"devices"`
+}
+
+func (r *Rule) allows(client netip.Addr, dev driver.USBDevice) bool {
+	clientMatches := false
+	for _, network := range r.Clients {
+		if network.Contains(client) {
+			clientMatches = true
+			break
+		}
+	}
+	if !clientMatches {
+		return false
+	}
+	if len(r.Devices) == 0 {
+		return true
+	}
+	for _, selector := range r.Devices {
+		if selector.Matches(dev) {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy determines which clients may list and import which devices. Clients may access a device
+// if any of the rules allows it, so a policy without rules denies everything. A nil policy allows everything.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Allows checks whether the client with the given address may list and import the device.
+func (p *Policy) Allows(client netip.Addr, dev driver.USBDevice) bool {
+	if p == nil {
+		return true
+	}
+	for i := range p.Rules {
+		if p.Rules[i].allows(client, dev) {
+			return true
+		}
+	}
+	return false
+}
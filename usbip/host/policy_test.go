@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package host
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+)
+
+func mustParseNetwork(t *testing.T, value string) ClientNetwork {
+	t.Helper()
+	network, err := ParseClientNetwork(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+func TestPolicy(t *testing.T) {
+	policy := &Policy{Rules: []Rule{
+		{
+			Clients: []ClientNetwork{mustParseNetwork(t, "192.0.2.0/24")},
+			Devices: []driver.USBDevice{{Vendor: 0x10c4, Product: 0xea60}},
+		},
+		{
+			Clients: []ClientNetwork{mustParseNetwork(t, "198.51.100.7"), mustParseNetwork(t, "2001:db8::/32")},
+		},
+	}}
+	zigbee := driver.USBDevice{Vendor: 0x10c4, Product: 0xea60, BusId: "1-1"}
+	yubikey := driver.USBDevice{Vendor: 0x1050, Product: 0x0407, BusId: "1-2"}
+	for _, tc := range []struct {
+		client  string
+		device  driver.USBDevice
+		allowed bool
+	}{
+		{"192.0.2.10", zigbee, true},
+		{"192.0.2.10", yubikey, false},
+		{"::ffff:192.0.2.10", zigbee, true},
+		{"198.51.100.7", yubikey, true},
+		{"198.51.100.8", zigbee, false},
+		{"2001:db8::42", yubikey, true},
+		{"203.0.113.1", zigbee, false},
+	} {
+		if allowed := policy.Allows(netip.MustParseAddr(tc.client), tc.device); allowed != tc.allowed {
+			t.Errorf("%s, %v: got %v; want %v", tc.client, tc.device, allowed, tc.allowed)
+		}
+	}
+
+	if !(*Policy)(nil).Allows(netip.MustParseAddr("203.0.113.1"), zigbee) {
+		t.Errorf("nil policy should allow everything")
+	}
+	if (&Policy{}).Allows(netip.MustParseAddr("203.0.113.1"), zigbee) {
+		t.Errorf("policy without rules should deny everything")
+	}
+	if (&Policy{Rules: []Rule{{Clients: []ClientNetwork{mustParseNetwork(t, "0.0.0.0/0")}}}}).Allows(netip.Addr{}, zigbee) {
+		t.Errorf("unknown clients should be denied")
+	}
+
+	for _, invalid := range []string{"192.0.2.0/33", "192.0.2", "example.com"} {
+		if _, err := ParseClientNetwork(invalid); err == nil {
+			t.Errorf("%q should be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package host
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	protocolVersion = 0x0111
+
+	opReqDevlist = 0x8005
+	opRepDevlist = 0x0005
+	opReqImport  = 0x8003
+	opRepImport  = 0x0003
+
+	// request timeout for the initial exchange; once a device is exported, the kernel owns the connection
+	requestTimeout = 5 * time.Second
+)
+
+// OpStatus is the status code in a USB/IP reply.
+type OpStatus uint32
+
+const (
+	StatusOK OpStatus = iota
+	// StatusNA means the request failed for an unspecified reason.
+	StatusNA
+	// StatusDevBusy means the device is already exported.
+	StatusDevBusy
+	// StatusDevErr means the device is in an error state.
+	StatusDevErr
+	// StatusNoDev means the device is not bound to usbip-host.
+	StatusNoDev
+	// StatusError means the device could not be exported.
+	StatusError
+)
+
+type opHeader struct {
+	Version uint16
+	Code    uint16
+	Status  OpStatus
+}
+
+type devlistReplyHeader struct {
+	opHeader
+	NumDevices uint32
+}
+
+// errDenied is returned when the policy doesn't allow a client to import a device.
+var errDenied = errors.New("client is not allowed to import the device")
+
+// Server answers device list and import requests from USB/IP clients.
+type Server struct {
+	driver Driver
+	// policy determines which clients may see and import which devices; nil allows everything
+	policy *Policy
+	logger log.Logger
+	// mu serializes imports, so a device is never exported to two clients at once
+	mu sync.Mutex
+}
+
+func NewServer(driver Driver, policy *Policy, logger log.Logger) *Server {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &Server{driver: driver, policy: policy, logger: logger}
+}
+
+// clientAddr returns the IP address of the client on the other end of conn,
+// or an invalid address, which no policy allows, if it can't be determined.
+func clientAddr(conn net.Conn) netip.Addr {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+// Serve handles the connections accepted by listener until ctx is done.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "failed to accept connection")
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		// the kernel holds its own reference to exported connections
+		_ = conn.Close()
+	}()
+	client := clientAddr(conn)
+	logger := log.With(s.logger, "client", client)
+	if err := conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		_ = level.Warn(logger).Log("msg", "failed to set deadline", "err", err)
+		return
+	}
+	var hdr opHeader
+	if err := binary.Read(conn, binary.BigEndian, &hdr); err != nil {
+		_ = level.Warn(logger).Log("msg", "failed to read request", "err", err)
+		return
+	}
+	if hdr.Version != protocolVersion {
+		_ = level.Warn(logger).Log("msg", "unsupported protocol version", "version", hdr.Version)
+		return
+	}
+	var err error
+	switch hdr.Code {
+	case opReqDevlist:
+		err = s.handleDevlist(conn, client)
+	case opReqImport:
+		err = s.handleImport(conn, client)
+	default:
+		err = errors.Newf("unknown request code %#04x", hdr.Code)
+	}
+	if err != nil {
+		_ = level.Warn(logger).Log("msg", "failed to handle request", "code", hdr.Code, "err", err)
+	}
+}
+
+func (s *Server) handleDevlist(conn net.Conn, client netip.Addr) error {
+	exportable, err := s.driver.ExportableDevices()
+	if err != nil {
+		_ = binary.Write(conn, binary.BigEndian, devlistReplyHeader{opHeader: opHeader{protocolVersion, opRepDevlist, StatusNA}})
+		return errors.Wrap(err, "failed to list devices")
+	}
+	// clients don't get to see the devices they can't import
+	devices := make([]Device, 0, len(exportable))
+	for i := range exportable {
+		if s.policy.Allows(client, exportable[i].USBDevice()) {
+			devices = append(devices, exportable[i])
+		}
+	}
+	reply := devlistReplyHeader{
+		opHeader:   opHeader{protocolVersion, opRepDevlist, StatusOK},
+		NumDevices: uint32(len(devices)),
+	}
+	if err := binary.Write(conn, binary.BigEndian, reply); err != nil {
+		return errors.Wrap(err, "failed to write devlist reply")
+	}
+	for i := range devices {
+		if err := binary.Write(conn, binary.BigEndian, devices[i].Description); err != nil {
+			return errors.Wrap(err, "failed to write devlist reply")
+		}
+		if err := binary.Write(conn, binary.BigEndian, devices[i].Interfaces); err != nil {
+			return errors.Wrap(err, "failed to write devlist reply")
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleImport(conn net.Conn, client netip.Addr) error {
+	var busIdBin [32]byte
+	if err := binary.Read(conn, binary.BigEndian, &busIdBin); err != nil {
+		return errors.Wrap(err, "failed to read import request")
+	}
+	busId := cString(busIdBin[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dev, status, err := s.export(busId, client, conn)
+	s.audit(client, busId, dev, err)
+	if err != nil {
+		_ = binary.Write(conn, binary.BigEndian, opHeader{protocolVersion, opRepImport, status})
+		return errors.Wrapf(err, "refused to export %s", busId)
+	}
+	if err := binary.Write(conn, binary.BigEndian, opHeader{protocolVersion, opRepImport, StatusOK}); err != nil {
+		return errors.Wrap(err, "failed to write import reply")
+	}
+	if err := binary.Write(conn, binary.BigEndian, dev.Description); err != nil {
+		return errors.Wrap(err, "failed to write import reply")
+	}
+	return nil
+}
+
+// export hands the connection to usbip-host to export the given device, if the client is allowed to import it.
+// The caller must hold s.mu.
+func (s *Server) export(busId string, client netip.Addr, conn net.Conn) (*Device, OpStatus, error) {
+	dev, err := s.driver.Describe(busId)
+	if err != nil {
+		return nil, StatusNoDev, err
+	}
+	if !s.policy.Allows(client, dev.USBDevice()) {
+		// don't reveal whether the device exists
+		return dev, StatusNoDev, errDenied
+	}
+	switch dev.Status {
+	case driver.SDevStatusAvailable:
+	case driver.SDevStatusUsed:
+		return dev, StatusDevBusy, errors.New("device is already exported")
+	default:
+		return dev, StatusDevErr, errors.Newf("device is in state %d", dev.Status)
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return dev, StatusError, errors.New("only TCP connections can be handed to usbip-host")
+	}
+	// the deadline only applies to the request itself
+	if err := tcpConn.SetDeadline(time.Time{}); err != nil {
+		return dev, StatusError, err
+	}
+	if err := s.driver.Export(busId, tcpConn); err != nil {
+		return dev, StatusError, err
+	}
+	return dev, StatusOK, nil
+}
+
+// audit records the outcome of an import request. Audit entries don't have a level,
+// so they're logged regardless of the log level.
+func (s *Server) audit(client netip.Addr, busId string, dev *Device, err error) {
+	keyvals := []interface{}{"msg", "import request", "audit", true, "client", client, "busId", busId}
+	if dev != nil {
+		usbDev := dev.USBDevice()
+		keyvals = append(keyvals, "vendor", usbDev.Vendor, "product", usbDev.Product)
+	}
+	switch {
+	case err == nil:
+		keyvals = append(keyvals, "result", "exported")
+	case errors.Is(err, errDenied):
+		keyvals = append(keyvals, "result", "denied")
+	default:
+		keyvals = append(keyvals, "result", "failed", "err", err)
+	}
+	_ = s.logger.Log(keyvals...)
+}
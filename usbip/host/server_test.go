@@ -0,0 +1,163 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package host
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/efficientgo/core/errors"
+)
+
+type fakeDriver struct {
+	devices  map[string]*Device
+	exported []string
+}
+
+func (f *fakeDriver) ExportableDevices() ([]Device, error) {
+	result := make([]Device, 0, len(f.devices))
+	for _, dev := range f.devices {
+		result = append(result, *dev)
+	}
+	return result, nil
+}
+
+func (f *fakeDriver) Describe(busId string) (*Device, error) {
+	dev, ok := f.devices[busId]
+	if !ok {
+		return nil, errors.Newf("device %s is not bound to usbip-host", busId)
+	}
+	return dev, nil
+}
+
+func (f *fakeDriver) Bind(_ string) error {
+	return nil
+}
+
+func (f *fakeDriver) Unbind(_ string) error {
+	return nil
+}
+
+func (f *fakeDriver) Export(busId string, _ *net.TCPConn) error {
+	f.exported = append(f.exported, busId)
+	f.devices[busId].Status = driver.SDevStatusUsed
+	return nil
+}
+
+func testDevice(busId string, vendor uint16, product uint16) *Device {
+	dev := &Device{
+		Interfaces: []Interface{{Class: 0xff}, {Class: 0x03, SubClass: 0x01}},
+		Status:     driver.SDevStatusAvailable,
+	}
+	copy(dev.Description.BusId[:], busId)
+	dev.Description.Vendor = vendor
+	dev.Description.Product = product
+	dev.Description.NumInterfaces = uint8(len(dev.Interfaces))
+	dev.Description.Speed = driver.USBSpeedFull
+	return dev
+}
+
+func startTestServer(t *testing.T, d Driver, policy *Policy) usbip.Target {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- NewServer(d, policy, nil).Serve(ctx, listener)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("server failed: %v", err)
+		}
+	})
+	addr := listener.Addr().(*net.TCPAddr)
+	return usbip.Target{Host: addr.IP.String(), Port: addr.Port}
+}
+
+func TestServer(t *testing.T) {
+	d := &fakeDriver{devices: map[string]*Device{"1-1": testDevice("1-1", 0x10c4, 0xea60)}}
+	target := startTestServer(t, d, nil)
+
+	client, err := usbip.NetDialer{}.Dial(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := client.ListRequest()
+	client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0] != (driver.USBDevice{Vendor: 0x10c4, Product: 0xea60, BusId: "1-1"}) {
+		t.Errorf("unexpected device list %v", devices)
+	}
+
+	client, err = usbip.NetDialer{}.Dial(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := client.ImportRequest(context.Background(), "1-1")
+	client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Vendor != 0x10c4 || desc.Speed != driver.USBSpeedFull || len(d.exported) != 1 {
+		t.Errorf("unexpected import %+v (exported: %v)", desc, d.exported)
+	}
+
+	// exported devices and unknown devices are refused
+	for _, busId := range []string{"1-1", "1-2"} {
+		client, err = usbip.NetDialer{}.Dial(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.ImportRequest(context.Background(), busId)
+		client.Close()
+		if err == nil {
+			t.Errorf("import of %s should have been refused", busId)
+		}
+	}
+	if len(d.exported) != 1 {
+		t.Errorf("refused devices should not be exported, got %v", d.exported)
+	}
+}
+
+func TestServerPolicy(t *testing.T) {
+	d := &fakeDriver{devices: map[string]*Device{
+		"1-1": testDevice("1-1", 0x10c4, 0xea60),
+		"1-2": testDevice("1-2", 0x1050, 0x0407),
+	}}
+	policy := &Policy{Rules: []Rule{{
+		Clients: []ClientNetwork{mustParseNetwork(t, "127.0.0.0/8")},
+		Devices: []driver.USBDevice{{Vendor: 0x10c4}},
+	}}}
+	target := startTestServer(t, d, policy)
+
+	client, err := usbip.NetDialer{}.Dial(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := client.ListRequest()
+	client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].BusId != "1-1" {
+		t.Errorf("only the allowed device should be listed, got %v", devices)
+	}
+
+	client, err = usbip.NetDialer{}.Dial(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.ImportRequest(context.Background(), "1-2")
+	client.Close()
+	if err == nil || len(d.exported) != 0 {
+		t.Errorf("import of a device that isn't allowed should be refused (exported: %v)", d.exported)
+	}
+}
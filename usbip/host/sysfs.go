@@ -0,0 +1,285 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package host
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+)
+
+const (
+	usbipHostDriverPath = "bus/usb/drivers/usbip-host"
+	// usbDeviceClassHub is the device class of USB hubs, which can't be exported.
+	usbDeviceClassHub = 0x09
+)
+
+// busIdPattern matches the bus IDs of USB devices, as opposed to those of root hubs and interfaces.
+var busIdPattern = regexp.MustCompile(`^[0-9]+-[0-9]+(\.[0-9]+)*$`)
+
+// speeds maps the speed attribute of USB devices (in Mbit/s) to the speeds used by the USB/IP protocol.
+var speeds = map[string]driver.USBDeviceSpeed{
+	"1.5":      driver.USBSpeedLow,
+	"12":       driver.USBSpeedFull,
+	"480":      driver.USBSpeedHigh,
+	"53.3-480": driver.USBSpeedWireless,
+	"5000":     driver.USBSpeedSuper,
+	"10000":    driver.USBSpeedSuper,
+	"20000":    driver.USBSpeedSuper,
+}
+
+type sysfsHostDriver struct {
+	fsys fs.FS
+	// writeFile writes to a sysfs attribute; replaced in tests.
+	writeFile func(path string, content string) error
+
+	logger log.Logger
+}
+
+func usbSysPath(busId string) string {
+	return path.Join("bus", "usb", "devices", busId)
+}
+
+func (d *sysfsHostDriver) readAttribute(sysPath string, name string) (string, error) {
+	content, err := fs.ReadFile(d.fsys, path.Join(sysPath, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// readUintAttribute reads an attribute holding an unsigned integer in the given base.
+func (d *sysfsHostDriver) readUintAttribute(sysPath string, name string, base int, bitSize int) (uint64, error) {
+	value, err := d.readAttribute(sysPath, name)
+	if err != nil {
+		return 0, err
+	}
+	result, err := strconv.ParseUint(value, base, bitSize)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read device attribute %s", name)
+	}
+	return result, nil
+}
+
+func (d *sysfsHostDriver) checkLoaded() error {
+	if _, err := fs.Stat(d.fsys, usbipHostDriverPath); err != nil {
+		return errors.Wrap(err, "usbip-host driver is not loaded")
+	}
+	return nil
+}
+
+// isBound checks whether the device with the given bus ID is bound to usbip-host.
+func (d *sysfsHostDriver) isBound(busId string) bool {
+	_, err := fs.Lstat(d.fsys, path.Join(usbipHostDriverPath, busId))
+	return err == nil
+}
+
+func (d *sysfsHostDriver) ExportableDevices() ([]Device, error) {
+	if err := d.checkLoaded(); err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(d.fsys, usbipHostDriverPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read usbip-host driver directory")
+	}
+	devices := make([]Device, 0)
+	for _, entry := range entries {
+		if !busIdPattern.MatchString(entry.Name()) {
+			continue
+		}
+		dev, err := d.describe(entry.Name())
+		if err != nil {
+			_ = d.logger.Log("msg", "skipping device that could not be described", "busId", entry.Name(), "err", err)
+			continue
+		}
+		devices = append(devices, *dev)
+	}
+	return devices, nil
+}
+
+func (d *sysfsHostDriver) Describe(busId string) (*Device, error) {
+	if !busIdPattern.MatchString(busId) {
+		return nil, errors.Newf("invalid bus ID %q", busId)
+	}
+	if !d.isBound(busId) {
+		return nil, errors.Newf("device %s is not bound to usbip-host", busId)
+	}
+	return d.describe(busId)
+}
+
+func (d *sysfsHostDriver) describe(busId string) (*Device, error) {
+	sysPath := usbSysPath(busId)
+	dev := &Device{}
+	desc := &dev.Description
+	copy(desc.Path[:], path.Join(driver.Sys, sysPath))
+	copy(desc.BusId[:], busId)
+
+	var err error
+	read := func(name string, base int, bitSize int) uint64 {
+		if err != nil {
+			return 0
+		}
+		var value uint64
+		value, err = d.readUintAttribute(sysPath, name, base, bitSize)
+		return value
+	}
+	desc.BusNum = uint32(read("busnum", 10, 32))
+	desc.DevNum = uint32(read("devnum", 10, 32))
+	desc.Vendor = uint16(read("idVendor", 16, 16))
+	desc.Product = uint16(read("idProduct", 16, 16))
+	desc.BCDDevice = uint16(read("bcdDevice", 16, 16))
+	desc.DeviceClass = uint8(read("bDeviceClass", 16, 8))
+	desc.DeviceSubClass = uint8(read("bDeviceSubClass", 16, 8))
+	desc.DeviceProtocol = uint8(read("bDeviceProtocol", 16, 8))
+	desc.NumConfigurations = uint8(read("bNumConfigurations", 10, 8))
+	desc.NumInterfaces = uint8(read("bNumInterfaces", 10, 8))
+	dev.Status = driver.USBIPStatus(read("usbip_status", 10, 32))
+	// empty if the device isn't configured
+	if value, _ := d.readAttribute(sysPath, "bConfigurationValue"); value != "" {
+		desc.DeviceConfigurationValue = uint8(read("bConfigurationValue", 10, 8))
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to describe device %s", busId)
+	}
+	speed, err := d.readAttribute(sysPath, "speed")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to describe device %s", busId)
+	}
+	desc.Speed = speeds[speed]
+
+	for i := 0; i < int(desc.NumInterfaces); i++ {
+		// interfaces are named <busid>:<config>.<interface>
+		ifName := fmt.Sprintf("%s:%d.%d", busId, desc.DeviceConfigurationValue, i)
+		iface := Interface{
+			Class:    uint8(read(path.Join(ifName, "bInterfaceClass"), 16, 8)),
+			SubClass: uint8(read(path.Join(ifName, "bInterfaceSubClass"), 16, 8)),
+			Protocol: uint8(read(path.Join(ifName, "bInterfaceProtocol"), 16, 8)),
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to describe interface %d of device %s", i, busId)
+		}
+		dev.Interfaces = append(dev.Interfaces, iface)
+	}
+	return dev, nil
+}
+
+func (d *sysfsHostDriver) Bind(busId string) error {
+	if !busIdPattern.MatchString(busId) {
+		return errors.Newf("invalid bus ID %q", busId)
+	}
+	if err := d.checkLoaded(); err != nil {
+		return err
+	}
+	if d.isBound(busId) {
+		return nil
+	}
+	sysPath := usbSysPath(busId)
+	class, err := d.readUintAttribute(sysPath, "bDeviceClass", 16, 8)
+	if err != nil {
+		return errors.Wrapf(err, "device %s not found", busId)
+	}
+	if class == usbDeviceClassHub {
+		return errors.Newf("device %s is a hub, which can't be exported", busId)
+	}
+	if _, err := fs.Stat(d.fsys, path.Join(sysPath, "driver")); err == nil {
+		if err := d.writeFile(path.Join(sysPath, "driver", "unbind"), busId); err != nil {
+			return errors.Wrapf(err, "failed to unbind %s from its driver", busId)
+		}
+	}
+	if err := d.writeFile(path.Join(usbipHostDriverPath, "match_busid"), "add "+busId); err != nil {
+		return errors.Wrapf(err, "failed to register %s with usbip-host", busId)
+	}
+	if err := d.writeFile(path.Join(usbipHostDriverPath, "bind"), busId); err != nil {
+		_ = d.writeFile(path.Join(usbipHostDriverPath, "match_busid"), "del "+busId)
+		return errors.Wrapf(err, "failed to bind %s to usbip-host", busId)
+	}
+	return nil
+}
+
+func (d *sysfsHostDriver) Unbind(busId string) error {
+	if !busIdPattern.MatchString(busId) {
+		return errors.Newf("invalid bus ID %q", busId)
+	}
+	if !d.isBound(busId) {
+		return errors.Newf("device %s is not bound to usbip-host", busId)
+	}
+	if err := d.writeFile(path.Join(usbipHostDriverPath, "unbind"), busId); err != nil {
+		return errors.Wrapf(err, "failed to unbind %s from usbip-host", busId)
+	}
+	if err := d.writeFile(path.Join(usbipHostDriverPath, "match_busid"), "del "+busId); err != nil {
+		return errors.Wrapf(err, "failed to unregister %s from usbip-host", busId)
+	}
+	// give the device back to the driver it had before
+	if err := d.writeFile(path.Join("bus", "usb", "drivers_probe"), busId); err != nil {
+		return errors.Wrapf(err, "failed to reprobe %s", busId)
+	}
+	return nil
+}
+
+func (d *sysfsHostDriver) Export(busId string, conn *net.TCPConn) error {
+	dev, err := d.Describe(busId)
+	if err != nil {
+		return err
+	}
+	if dev.Status != driver.SDevStatusAvailable {
+		return errors.Newf("device %s is not available for export (status %d)", busId, dev.Status)
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return errors.Wrap(err, "failed to access raw connection")
+	}
+	var exportErr error
+	err = rawConn.Control(func(fd uintptr) {
+		exportErr = d.writeFile(path.Join(usbSysPath(busId), "usbip_sockfd"), strconv.Itoa(int(fd)))
+	})
+	if exportErr != nil {
+		return errors.Wrapf(exportErr, "failed to export %s", busId)
+	}
+	if err != nil {
+		return errors.Wrap(err, "raw I/O to export device failed")
+	}
+	return nil
+}
+
+func writeSysfsFile(path string, content string) error {
+	f, err := os.OpenFile(filepath.Join(driver.Sys, path), os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s for writing", path)
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	_, err = f.WriteString(content)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write command to %s", path)
+	}
+	return nil
+}
+
+// NewSysfsHostDriver sets up a driver that reads the state of local devices from fsys,
+// which should be rooted at /sys.
+func NewSysfsHostDriver(fsys fs.FS, logger log.Logger) (Driver, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	d := &sysfsHostDriver{
+		fsys:      fsys,
+		writeFile: writeSysfsFile,
+		logger:    logger,
+	}
+	if err := d.checkLoaded(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
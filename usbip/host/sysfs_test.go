@@ -0,0 +1,163 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package host
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+)
+
+func deviceFixture(fsys fstest.MapFS, busId string, class string) {
+	dir := "bus/usb/devices/" + busId + "/"
+	fsys[dir+"busnum"] = &fstest.MapFile{Data: []byte("1\n")}
+	fsys[dir+"devnum"] = &fstest.MapFile{Data: []byte("4\n")}
+	fsys[dir+"speed"] = &fstest.MapFile{Data: []byte("12\n")}
+	fsys[dir+"idVendor"] = &fstest.MapFile{Data: []byte("10c4\n")}
+	fsys[dir+"idProduct"] = &fstest.MapFile{Data: []byte("ea60\n")}
+	fsys[dir+"bcdDevice"] = &fstest.MapFile{Data: []byte("0100\n")}
+	fsys[dir+"bDeviceClass"] = &fstest.MapFile{Data: []byte(class + "\n")}
+	fsys[dir+"bDeviceSubClass"] = &fstest.MapFile{Data: []byte("00\n")}
+	fsys[dir+"bDeviceProtocol"] = &fstest.MapFile{Data: []byte("00\n")}
+	fsys[dir+"bConfigurationValue"] = &fstest.MapFile{Data: []byte("1\n")}
+	fsys[dir+"bNumConfigurations"] = &fstest.MapFile{Data: []byte("1\n")}
+	fsys[dir+"bNumInterfaces"] = &fstest.MapFile{Data: []byte(" 1\n")}
+	fsys[dir+busId+":1.0/bInterfaceClass"] = &fstest.MapFile{Data: []byte("ff\n")}
+	fsys[dir+busId+":1.0/bInterfaceSubClass"] = &fstest.MapFile{Data: []byte("00\n")}
+	fsys[dir+busId+":1.0/bInterfaceProtocol"] = &fstest.MapFile{Data: []byte("00\n")}
+}
+
+type recordedWrite struct {
+	path    string
+	content string
+}
+
+func newTestDriver(fsys fstest.MapFS) (*sysfsHostDriver, *[]recordedWrite) {
+	writes := make([]recordedWrite, 0)
+	return &sysfsHostDriver{
+		fsys: fsys,
+		writeFile: func(path string, content string) error {
+			writes = append(writes, recordedWrite{path, content})
+			return nil
+		},
+		logger: log.NewNopLogger(),
+	}, &writes
+}
+
+func TestDescribe(t *testing.T) {
+	fsys := fstest.MapFS{
+		"bus/usb/drivers/usbip-host/match_busid": {Data: []byte{}},
+		"bus/usb/drivers/usbip-host/1-1":         {Mode: fs.ModeSymlink, Data: []byte("../../../../devices/pci0000:00/usb1/1-1")},
+	}
+	deviceFixture(fsys, "1-1", "00")
+	fsys["bus/usb/devices/1-1/usbip_status"] = &fstest.MapFile{Data: []byte("1\n")}
+	deviceFixture(fsys, "1-2", "00")
+
+	d, _ := newTestDriver(fsys)
+	devices, err := d.ExportableDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("expected only the bound device, got %d", len(devices))
+	}
+	dev := devices[0]
+	if usbDev := dev.USBDevice(); usbDev != (driver.USBDevice{Vendor: 0x10c4, Product: 0xea60, BusId: "1-1"}) {
+		t.Errorf("unexpected device %v", usbDev)
+	}
+	desc := dev.Description
+	if desc.BusNum != 1 || desc.DevNum != 4 || desc.Speed != driver.USBSpeedFull || desc.BCDDevice != 0x0100 ||
+		desc.DeviceConfigurationValue != 1 || desc.NumInterfaces != 1 {
+		t.Errorf("unexpected description %+v", desc)
+	}
+	if cString(desc.Path[:]) != "/sys/bus/usb/devices/1-1" {
+		t.Errorf("unexpected path %q", cString(desc.Path[:]))
+	}
+	if !reflect.DeepEqual(dev.Interfaces, []Interface{{Class: 0xff}}) {
+		t.Errorf("unexpected interfaces %+v", dev.Interfaces)
+	}
+	if dev.Status != driver.SDevStatusAvailable {
+		t.Errorf("unexpected status %d", dev.Status)
+	}
+
+	if _, err := d.Describe("1-2"); err == nil {
+		t.Errorf("unbound device should not be described")
+	}
+	if _, err := d.Describe("../1-1"); err == nil {
+		t.Errorf("invalid bus ID should be rejected")
+	}
+}
+
+func TestBind(t *testing.T) {
+	fsys := fstest.MapFS{
+		"bus/usb/drivers/usbip-host/match_busid": {Data: []byte{}},
+		"bus/usb/devices/1-1/driver/unbind":      {Data: []byte{}},
+	}
+	deviceFixture(fsys, "1-1", "00")
+	deviceFixture(fsys, "1-2", "09")
+
+	d, writes := newTestDriver(fsys)
+	if err := d.Bind("1-1"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []recordedWrite{
+		{"bus/usb/devices/1-1/driver/unbind", "1-1"},
+		{"bus/usb/drivers/usbip-host/match_busid", "add 1-1"},
+		{"bus/usb/drivers/usbip-host/bind", "1-1"},
+	}
+	if !reflect.DeepEqual(*writes, expected) {
+		t.Errorf("unexpected writes %v", *writes)
+	}
+	if err := d.Bind("1-2"); err == nil {
+		t.Errorf("hubs should not be bound")
+	}
+
+	// once bound, binding is a no-op and unbinding gives the device back
+	fsys["bus/usb/drivers/usbip-host/1-1"] = &fstest.MapFile{Mode: fs.ModeSymlink, Data: []byte("../../../../devices/pci0000:00/usb1/1-1")}
+	*writes = (*writes)[:0]
+	if err := d.Bind("1-1"); err != nil || len(*writes) != 0 {
+		t.Errorf("binding a bound device should do nothing, got %v (%v)", *writes, err)
+	}
+	if err := d.Unbind("1-1"); err != nil {
+		t.Fatal(err)
+	}
+	expected = []recordedWrite{
+		{"bus/usb/drivers/usbip-host/unbind", "1-1"},
+		{"bus/usb/drivers/usbip-host/match_busid", "del 1-1"},
+		{"bus/usb/drivers_probe", "1-1"},
+	}
+	if !reflect.DeepEqual(*writes, expected) {
+		t.Errorf("unexpected writes %v", *writes)
+	}
+
+	// failing to bind undoes the registration with usbip-host
+	*writes = (*writes)[:0]
+	d.writeFile = func(path string, content string) error {
+		*writes = append(*writes, recordedWrite{path, content})
+		if path == "bus/usb/drivers/usbip-host/bind" {
+			return errors.New("no such device")
+		}
+		return nil
+	}
+	if err := d.Bind("1-3"); err == nil {
+		t.Errorf("binding an unknown device should fail")
+	}
+	delete(fsys, "bus/usb/drivers/usbip-host/1-1")
+	if err := d.Bind("1-1"); err == nil {
+		t.Errorf("failed bind should be reported")
+	}
+	if last := (*writes)[len(*writes)-1]; last != (recordedWrite{"bus/usb/drivers/usbip-host/match_busid", "del 1-1"}) {
+		t.Errorf("registration should have been undone, got %v", *writes)
+	}
+}
+
+func TestDriverNotLoaded(t *testing.T) {
+	if _, err := NewSysfsHostDriver(fstest.MapFS{}, nil); err == nil {
+		t.Errorf("expected missing usbip-host driver to be reported")
+	}
+}
@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package host implements the exporting side of USB/IP: it binds local devices to the usbip-host
+// driver, and serves them to USB/IP clients.
+package host
+
+import (
+	"net"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+)
+
+// Interface describes an interface of an exportable device, as reported in device lists.
+type Interface struct {
+	Class    uint8
+	SubClass uint8
+	Protocol uint8
+	Padding  uint8
+}
+
+// Device describes a local device bound to the usbip-host driver.
+type Device struct {
+	Description usbip.DeviceDescription
+	Interfaces  []Interface
+	// Status is the export status reported by usbip-host (one of the driver.SDevStatus values).
+	Status driver.USBIPStatus
+}
+
+// USBDevice returns the identity of the device.
+func (d *Device) USBDevice() driver.USBDevice {
+	return driver.USBDevice{
+		Vendor:  driver.USBID(d.Description.Vendor),
+		Product: driver.USBID(d.Description.Product),
+		BusId:   cString(d.Description.BusId[:]),
+	}
+}
+
+// Driver manages the binding and exporting of local devices.
+type Driver interface {
+	// ExportableDevices lists the devices bound to usbip-host.
+	ExportableDevices() ([]Device, error)
+	// Describe describes the device with the given bus ID, which must be bound to usbip-host.
+	Describe(busId string) (*Device, error)
+	// Bind detaches the device with the given bus ID from its current driver and binds it to usbip-host.
+	Bind(busId string) error
+	// Unbind releases the device with the given bus ID from usbip-host, and lets the kernel reprobe it.
+	Unbind(busId string) error
+	// Export hands the connection over to usbip-host, which then serves the device over it.
+	Export(busId string, conn *net.TCPConn) error
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
@@ -3,11 +3,13 @@
 package usbip
 
 import (
+	"context"
 	"encoding/binary"
 	"time"
 
 	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
 	"github.com/efficientgo/core/errors"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -25,16 +27,20 @@ type usbipImportResponse struct {
 	DeviceDescription
 }
 
-func (c *Connection) ImportRequest(busId string) (*DeviceDescription, error) {
+func (c *Connection) ImportRequest(ctx context.Context, busId string) (desc *DeviceDescription, err error) {
+	_, span := tracer.Start(ctx, "usbip.ImportRequest")
+	span.SetAttributes(TargetAttribute(c.Target), attribute.String("usbip.bus_id", busId))
+	defer func() { endSpan(span, err) }()
+
 	var now = time.Now()
 	var busIdBin [32]byte
 	copy(busIdBin[:], busId)
 
 	conn := c.connection
 
-	err := conn.SetReadDeadline(now.Add(5 * time.Second))
+	err = conn.SetReadDeadline(now.Add(5 * time.Second))
 	if err != nil {
-		return nil, err
+		return nil, importError(ImportFailureProtocol, err)
 	}
 
 	err = binary.Write(
@@ -46,54 +52,49 @@ func (c *Connection) ImportRequest(busId string) (*DeviceDescription, error) {
 	)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to write import command")
+		return nil, importError(ImportFailureProtocol, errors.Wrap(err, "failed to write import command"))
 	}
 
 	resp := usbipImportResponse{}
 	err = binary.Read(conn, binary.BigEndian, &resp)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to read import response")
+		return nil, importError(ImportFailureProtocol, errors.Wrap(err, "failed to read import response"))
 	}
 	if resp.Status != 0 {
-		return nil, errors.New("import command returned error")
+		return nil, importError(ImportFailureRejected, errors.New("import command returned error"))
 	}
 
 	if resp.BusId != busIdBin {
-		return nil, errors.New("import command returned unexpected busId")
+		return nil, importError(ImportFailureProtocol, errors.New("import command returned unexpected busId"))
 	}
 
 	return &resp.DeviceDescription, nil
 }
 
-func Import(busId string, t Target, vhci driver.VHCIDriver, dialer Dialer) (*AttachedDevice, error) {
-	c, err := dialer.Dial(t)
+func Import(ctx context.Context, busId string, t Target, vhci driver.VHCIDriver, dialer Dialer) (_ *AttachedDevice, err error) {
+	ctx, span := tracer.Start(ctx, "usbip.Import")
+	span.SetAttributes(TargetAttribute(t), attribute.String("usbip.bus_id", busId))
+	defer func() { endSpan(span, err) }()
+
+	c, err := dial(ctx, t, dialer)
 	if err != nil {
-		return nil, err
+		return nil, importError(ImportFailureConnect, err)
 	}
 
 	defer c.Close()
 
-	resp, err := c.ImportRequest(busId)
+	resp, err := c.ImportRequest(ctx, busId)
 	if err != nil {
 		return nil, err
 	}
 
-	port, err := attachImported(c, *resp, vhci)
+	port, err := attachImported(ctx, c, *resp, vhci)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to attach imported device")
-	}
-	var slot *driver.VHCISlot
-	for i := 0; i < waitForDeviceReadyAttempts; i++ {
-		if err = vhci.UpdateAttachedDevices(); err != nil {
-			break
-		}
-		if slot, err = driver.DescribeAttached(port, vhci); err == nil {
-			break
-		}
-		time.Sleep(waitForDeviceReadyStep)
+		return nil, importError(ImportFailureAttach, errors.Wrap(err, "failed to attach imported device"))
 	}
+	slot, err := waitForSlot(ctx, port, vhci)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to describe attached device")
+		return nil, importError(ImportFailureDescribe, errors.Wrap(err, "failed to describe attached device"))
 	}
 	attachedDev := &AttachedDevice{
 		USBDevice: driver.USBDevice{
@@ -109,8 +110,37 @@ func Import(busId string, t Target, vhci driver.VHCIDriver, dialer Dialer) (*Att
 	return attachedDev, nil
 }
 
-func Detach(port driver.VirtualPort, vhci driver.VHCIDriver) error {
-	err := vhci.DetachDevice(port)
+func dial(ctx context.Context, t Target, dialer Dialer) (_ Client, err error) {
+	_, span := tracer.Start(ctx, "usbip.Dial")
+	span.SetAttributes(TargetAttribute(t))
+	defer func() { endSpan(span, err) }()
+	return dialer.Dial(t)
+}
+
+// waitForSlot polls the VHCI driver until the device attached to the given port shows up.
+func waitForSlot(ctx context.Context, port driver.VirtualPort, vhci driver.VHCIDriver) (slot *driver.VHCISlot, err error) {
+	_, span := tracer.Start(ctx, "usbip.WaitForSlot")
+	span.SetAttributes(attribute.Int("usbip.port", int(port)))
+	defer func() { endSpan(span, err) }()
+	for i := 0; i < waitForDeviceReadyAttempts; i++ {
+		span.SetAttributes(attribute.Int("usbip.attempts", i+1))
+		if err = vhci.UpdateAttachedDevices(); err != nil {
+			break
+		}
+		if slot, err = driver.DescribeAttached(port, vhci); err == nil {
+			break
+		}
+		time.Sleep(waitForDeviceReadyStep)
+	}
+	return slot, err
+}
+
+func Detach(ctx context.Context, port driver.VirtualPort, vhci driver.VHCIDriver) (err error) {
+	_, span := tracer.Start(ctx, "usbip.Detach")
+	span.SetAttributes(attribute.Int("usbip.port", int(port)))
+	defer func() { endSpan(span, err) }()
+
+	err = vhci.DetachDevice(port)
 	if err != nil {
 		return err
 	}
@@ -125,8 +155,13 @@ func Detach(port driver.VirtualPort, vhci driver.VHCIDriver) error {
 	return err
 }
 
-func attachImported(c Client, resp DeviceDescription, vhci driver.VHCIDriver) (driver.VirtualPort, error) {
-	port, err := vhci.AttachDevice(
+func attachImported(ctx context.Context, c Client, resp DeviceDescription, vhci driver.VHCIDriver) (port driver.VirtualPort, err error) {
+	_, span := tracer.Start(ctx, "vhci.AttachDevice")
+	defer func() {
+		span.SetAttributes(attribute.Int("usbip.port", int(port)))
+		endSpan(span, err)
+	}()
+	port, err = vhci.AttachDevice(
 		c.getConnection(),
 		resp.BusNum<<16|resp.DevNum,
 		resp.Speed,
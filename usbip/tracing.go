@@ -0,0 +1,32 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package usbip
+
+import (
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer uses the global tracer provider, which doesn't record anything unless tracing is set up.
+var tracer = otel.Tracer("github.com/MatthiasValvekens/usbip-device-plugin/usbip")
+
+// TargetAttribute describes a target in span attributes.
+func TargetAttribute(t Target) attribute.KeyValue {
+	if t.Local {
+		return attribute.String("usbip.target", "local")
+	}
+	return attribute.String("usbip.target", t.Host+":"+strconv.Itoa(t.Port))
+}
+
+// endSpan records the outcome of an operation on its span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -3,6 +3,7 @@
 package usbip
 
 import (
+	"context"
 	"net"
 
 	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
@@ -31,6 +32,9 @@ type USBID uint16
 type Target struct {
 	Host string `json:"host"`
 	Port int    `json:"port"`
+	// Local designates the USB devices plugged into the node itself, which are passed to
+	// containers directly instead of being imported over USB/IP. Host and Port must be empty.
+	Local bool `json:"local,omitempty"`
 }
 
 type Connection struct {
@@ -43,13 +47,16 @@ type AttachedDevice struct {
 	Target       Target             `json:"target"`
 	Port         driver.VirtualPort `json:"vhc_port"`
 	DevMountPath string             `json:"dev_mount_path"`
+	// InterfaceDevNodes lists the additional /dev nodes (tty, hidraw, ...) that were
+	// created for the device's interfaces.
+	InterfaceDevNodes []string `json:"interface_dev_nodes,omitempty"`
 }
 
 type Client interface {
 	GetTarget() Target
 	Close()
 	ListRequest() ([]driver.USBDevice, error)
-	ImportRequest(busId string) (*DeviceDescription, error)
+	ImportRequest(ctx context.Context, busId string) (*DeviceDescription, error)
 	getConnection() *net.TCPConn
 }
 
@@ -0,0 +1,250 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/MatthiasValvekens/usbip-device-plugin/deviceplugin"
+	"github.com/MatthiasValvekens/usbip-device-plugin/driver"
+	"github.com/MatthiasValvekens/usbip-device-plugin/usbip"
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/api/validate/content"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// configIssue is a problem found in the configuration, along with the path
+// of the offending value (e.g. resources.some-device[0].target.port).
+type configIssue struct {
+	Path     string `json:"path"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+func (i configIssue) String() string {
+	return fmt.Sprintf("%s: %s", i.Path, i.Message)
+}
+
+type configIssues []configIssue
+
+func (issues *configIssues) errorf(path string, format string, args ...interface{}) {
+	*issues = append(*issues, configIssue{Path: path, Severity: severityError, Message: fmt.Sprintf(format, args...)})
+}
+
+func (issues *configIssues) warnf(path string, format string, args ...interface{}) {
+	*issues = append(*issues, configIssue{Path: path, Severity: severityWarning, Message: fmt.Sprintf(format, args...)})
+}
+
+// errors returns the issues that prevent the configuration from being used.
+func (issues configIssues) errors() configIssues {
+	result := make(configIssues, 0)
+	for _, issue := range issues {
+		if issue.Severity == severityError {
+			result = append(result, issue)
+		}
+	}
+	return result
+}
+
+func (issues configIssues) Error() string {
+	lines := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		lines = append(lines, issue.String())
+	}
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(lines, "\n  "))
+}
+
+// resourcePath returns the config path of a resource.
+func resourcePath(name string) string {
+	return "resources." + name
+}
+
+// devicePath returns the config path of a device, taking into account whether the
+// resource was declared as a plain list of devices.
+func devicePath(resourceName string, ix int) string {
+	if _, shorthand := viper.GetStringMap("resources")[resourceName].([]interface{}); shorthand {
+		return fmt.Sprintf("%s[%d]", resourcePath(resourceName), ix)
+	}
+	return fmt.Sprintf("%s.devices[%d]", resourcePath(resourceName), ix)
+}
+
+// validateUSBIDs checks the numeric USB IDs in the device selectors as written in the configuration.
+// Decoding rejects IDs that are out of range as well, but without pointing at the offending value.
+func validateUSBIDs(issues *configIssues, resourceDefs map[string]interface{}) {
+	names := make([]string, 0, len(resourceDefs))
+	for name := range resourceDefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		devices, shorthand := resourceDefs[name].([]interface{})
+		if !shorthand {
+			group, _ := resourceDefs[name].(map[string]interface{})
+			devices, _ = group["devices"].([]interface{})
+		}
+		for ix, rawDevice := range devices {
+			device, _ := rawDevice.(map[string]interface{})
+			selector, _ := device["selector"].(map[string]interface{})
+			for _, field := range []string{"vendor", "product"} {
+				value, ok := selector[field]
+				if _, isString := value.(string); !ok || isString {
+					continue
+				}
+				if _, valid := numericUSBID(value); !valid {
+					issues.errorf(fmt.Sprintf("%s.selector.%s", devicePath(name, ix), field), "USB ID %v is out of range: expected a number between 0 and 0xffff", value)
+				}
+			}
+		}
+	}
+}
+
+// selectorsOverlap checks whether a device could match both selectors.
+func selectorsOverlap(a driver.USBDevice, b driver.USBDevice) bool {
+	return (a.Vendor == 0 || b.Vendor == 0 || a.Vendor == b.Vendor) &&
+		(a.Product == 0 || b.Product == 0 || a.Product == b.Product) &&
+		(a.BusId == "" || b.BusId == "" || a.BusId == b.BusId)
+}
+
+func validateTarget(issues *configIssues, devPath string, target usbip.Target) {
+	if target.Local {
+		if target.Host != "" || target.Port != 0 {
+			issues.errorf(devPath+".target", "local targets can't have a host or port")
+		}
+		return
+	}
+	switch {
+	case target.Host == "":
+		issues.errorf(devPath+".target.host", "host must be set")
+	case net.ParseIP(target.Host) == nil && len(validation.IsDNS1123Subdomain(strings.ToLower(target.Host))) > 0:
+		issues.errorf(devPath+".target.host", "%q is neither an IP address nor a valid host name", target.Host)
+	}
+	if target.Port == 0 {
+		issues.errorf(devPath+".target.port", "port must be set (the default USB/IP port is %d)", defaultUSBIPPort)
+	} else if target.Port < 0 || target.Port > 65535 {
+		issues.errorf(devPath+".target.port", "port %d out of range", target.Port)
+	}
+}
+
+// selectorRef refers to a configured device for the purpose of detecting overlapping selectors.
+type selectorRef struct {
+	path     string
+	selector driver.USBDevice
+}
+
+// validateConfig checks the configured resources for problems that would otherwise
+// only show up at runtime.
+func validateConfig(domain string, resources map[string]*deviceplugin.ResourceConfig) configIssues {
+	issues := make(configIssues, 0)
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	selectorsByTarget := make(map[usbip.Target][]selectorRef)
+	for _, name := range names {
+		resource := resources[name]
+		resPath := resourcePath(name)
+		for _, msg := range validation.IsDNS1123Label(name) {
+			issues.errorf(resPath, "invalid resource name: %s", msg)
+		}
+		for _, msg := range content.IsLabelKey(path.Join(domain, name)) {
+			issues.errorf(resPath, "invalid extended resource name %s: %s", path.Join(domain, name), msg)
+		}
+		if err := resource.Validate(); err != nil {
+			issues.errorf(resPath, "%v", err)
+		}
+
+		deviceNames := make(map[string]string)
+		for ix, kd := range resource.Devices {
+			devPath := devicePath(name, ix)
+			if kd == nil {
+				issues.errorf(devPath, "empty device")
+				continue
+			}
+			validateTarget(&issues, devPath, kd.Target)
+			if kd.Selector == (driver.USBDevice{}) {
+				issues.warnf(devPath+".selector", "empty selector matches any device exported by the target")
+			}
+			if kd.Replicas < 0 {
+				issues.errorf(devPath+".replicas", "replicas must not be negative")
+			}
+			if kd.Name != "" {
+				if other, ok := deviceNames[kd.Name]; ok {
+					issues.errorf(devPath+".name", "duplicate device name %q (also used by %s)", kd.Name, other)
+				}
+				deviceNames[kd.Name] = devPath
+			}
+			for extraIx := range kd.ExtraDevices {
+				extra := &kd.ExtraDevices[extraIx]
+				if !filepath.IsAbs(extra.HostPath) {
+					issues.errorf(fmt.Sprintf("%s.extras[%d].host_path", devPath, extraIx), "host path %q must be absolute", extra.HostPath)
+				}
+			}
+			for _, other := range selectorsByTarget[kd.Target] {
+				if selectorsOverlap(kd.Selector, other.selector) {
+					issues.warnf(devPath+".selector", "selector overlaps with %s on the same target", other.path)
+				}
+			}
+			selectorsByTarget[kd.Target] = append(selectorsByTarget[kd.Target], selectorRef{path: devPath, selector: kd.Selector})
+		}
+
+		// registration checks the remaining settings, such as path templates
+		dm := deviceplugin.NewDeviceManager("", nil, nil, nil)
+		devices := make([]*deviceplugin.KnownDevice, len(resource.Devices))
+		for ix, kd := range resource.Devices {
+			if kd != nil {
+				dev := *kd
+				devices[ix] = &dev
+			}
+		}
+		if _, err := dm.Register(name, resource.ResourceOptions, devices); err != nil {
+			issues.errorf(resPath, "%v", err)
+		}
+	}
+	return issues
+}
+
+// checkConfiguredDevices decodes the configured resources and checks them for problems.
+// Issues that prevent decoding are reported as issues as well, as long as their location is known.
+func checkConfiguredDevices(domain string) (map[string]*deviceplugin.ResourceConfig, configIssues, error) {
+	issues := make(configIssues, 0)
+	validateUSBIDs(&issues, viper.GetStringMap("resources"))
+	resources, err := getConfiguredDevices()
+	if err != nil {
+		if len(issues.errors()) > 0 {
+			// decoding failed on the issues found above
+			return nil, issues, nil
+		}
+		return nil, nil, err
+	}
+	return resources, append(issues, validateConfig(domain, resources)...), nil
+}
+
+func validateCommand(env *commandEnv, _ []string) (*commandOutput, error) {
+	if err := readConfigFile(env.configFile); err != nil {
+		return nil, err
+	}
+	_, issues, err := checkConfiguredDevices(env.domain)
+	if err != nil {
+		return nil, err
+	}
+	out := &commandOutput{header: []string{"SEVERITY", "PATH", "MESSAGE"}, value: issues}
+	for _, issue := range issues {
+		out.rows = append(out.rows, []string{issue.Severity, issue.Path, issue.Message})
+	}
+	if errs := issues.errors(); len(errs) > 0 {
+		return out, fmt.Errorf("configuration has %d error(s)", len(errs))
+	}
+	return out, nil
+}
@@ -0,0 +1,170 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func loadTestConfig(t *testing.T, config string) *commandEnv {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	env := &commandEnv{configFile: filepath.Join(t.TempDir(), "config.yaml"), domain: defaultDomain}
+	if err := os.WriteFile(env.configFile, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestValidateConfig(t *testing.T) {
+	env := loadTestConfig(t, `
+resources:
+  some-device:
+    - target:
+        host: usbip.example.com
+      selector:
+        vendor: 0x1050
+    - target:
+        host: usbip.example.com
+        port: 3240
+      selector:
+        vendor: 0x1050
+        product: 0x0407
+    - target:
+        host: usbip.example.com
+        port: 3240
+  Invalid_Name:
+    devices:
+      - target:
+          host: "not a host"
+          port: 3240
+        selector:
+          product: 0x1234
+        extras:
+          - host_path: dev/ttyUSB0
+      - target:
+          local: true
+          port: 3240
+        selector:
+          product: 0x5678
+`)
+	out, err := validateCommand(env, nil)
+	if err == nil {
+		t.Fatalf("expected validation to fail")
+	}
+	issues := out.value.(configIssues)
+	expected := map[string]string{
+		"resources.some-device[0].target.port":                  severityError,
+		"resources.some-device[2].selector":                     severityWarning,
+		"resources.invalid_name":                                severityError,
+		"resources.invalid_name.devices[0].target.host":         severityError,
+		"resources.invalid_name.devices[0].extras[0].host_path": severityError,
+		"resources.invalid_name.devices[1].target":              severityError,
+	}
+	found := make(map[string]bool)
+	for _, issue := range issues {
+		if severity, ok := expected[issue.Path]; ok && severity == issue.Severity {
+			found[issue.Path] = true
+		}
+	}
+	for path := range expected {
+		if !found[path] {
+			t.Errorf("expected issue at %s, got %v", path, issues)
+		}
+	}
+}
+
+func TestStrictDecoding(t *testing.T) {
+	env := loadTestConfig(t, `
+resources:
+  some-device:
+    - target:
+        host: usbip.example.com
+        port: 3240
+      selecter:
+        vendor: 0x1050
+`)
+	_, err := validateCommand(env, nil)
+	if err == nil || !strings.Contains(err.Error(), "selecter") || !strings.Contains(err.Error(), "resources.some-device") {
+		t.Errorf("expected unknown key to be reported, got %v", err)
+	}
+}
+
+func TestValidConfig(t *testing.T) {
+	env := loadTestConfig(t, `
+resources:
+  some-device:
+    lazy_attach: true
+    release_grace_period: 1m
+    devices:
+      - target:
+          host: 10.0.0.1
+          port: 3240
+        selector:
+          vendor: 0x1050
+          product: 0x0407
+      - target:
+          local: true
+        selector:
+          vendor: 0x10c4
+          product: 0xea60
+`)
+	out, err := validateCommand(env, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issues := out.value.(configIssues); len(issues) != 0 {
+		t.Errorf("unexpected issues %v", issues)
+	}
+}
+
+func TestOutOfRangeUSBIDs(t *testing.T) {
+	for selector, path := range map[string]string{
+		"vendor: 0x10000": "resources.some-device[0].selector.vendor",
+		"product: 70000":  "resources.some-device[0].selector.product",
+		"vendor: -1":      "resources.some-device[0].selector.vendor",
+		"vendor: 10.5":    "resources.some-device[0].selector.vendor",
+	} {
+		env := loadTestConfig(t, `
+resources:
+  some-device:
+    - target:
+        host: usbip.example.com
+        port: 3240
+      selector:
+        `+selector+`
+`)
+		out, err := validateCommand(env, nil)
+		if err == nil {
+			t.Errorf("%s: expected out-of-range ID to be rejected", selector)
+			continue
+		}
+		issues := out.value.(configIssues)
+		if len(issues) != 1 || issues[0].Path != path || issues[0].Severity != severityError {
+			t.Errorf("%s: expected an error at %s, got %v", selector, path, issues)
+		}
+	}
+
+	// decoding doesn't silently truncate the ID either
+	env := loadTestConfig(t, `
+resources:
+  some-device:
+    - target:
+        host: usbip.example.com
+        port: 3240
+      selector:
+        vendor: 0x10000
+`)
+	if err := readConfigFile(env.configFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getConfiguredDevices(); err == nil || !strings.Contains(err.Error(), "invalid USB ID") {
+		t.Errorf("expected decoding to fail, got %v", err)
+	}
+}